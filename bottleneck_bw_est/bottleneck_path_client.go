@@ -1,32 +1,86 @@
 // Dedicated client for estimating bottleneck bandwidth
+// Run with: go run bottleneck_path_client.go bw_est_api.go
 
 package main
 
 import (
 	"flag"
-	"encoding/binary"
 	"fmt"
 	"log"
+	"math"
 	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/netsec-ethz/scion-homeworks/lib/bwproto"
+	"github.com/netsec-ethz/scion-homeworks/lib/history"
+	"github.com/netsec-ethz/scion-homeworks/lib/pacer"
 	"github.com/scionproto/scion/go/lib/pathmgr"
 	"github.com/scionproto/scion/go/lib/sciond"
 	"github.com/scionproto/scion/go/lib/snet"
-	"github.com/scionproto/scion/go/lib/spath"
 )
 
 const (
-	DEFAULT_PACKET_SIZE int = 8000
+	DEFAULT_PACKET_SIZE int = 0 /* Derived from the path MTU */
 	DEFAULT_PACKET_NUM int = 10
-	NUM_TRIES int = 3
+	DEFAULT_PACKET_GAP time.Duration = time.Millisecond
+	DEFAULT_PACKET_BURST int = 1
+
+	/* Probe b_i follows a_i this much later in the shared bottleneck test */
+	SBD_OFFSET time.Duration = 500 * time.Microsecond
+	/* Timestamp probes are padded so they are larger than their answers */
+	SBD_PROBE_SIZE int = 64
+	MIN_SBD_SAMPLES int = 30
 )
 
 var (
 	PACKET_SIZE int
 	PACKET_NUM int
+	PACKET_GAP time.Duration
+	PACKET_BURST int
+	PROBE_PMTU bool
+
+	CONCURRENCY int
+	ROUNDS int
+	ISOLATE bool
+	STAGGER time.Duration
+
+	SBD bool
+	SBD_PROBES int
+	SBD_GAP time.Duration
+
+	DB_FILE *string
 )
 
+/* Result of one bandwidth test on one path */
+type Measurement struct {
+	pktSize int
+	wireSize int /* pktSize plus all headers on the path */
+	sentBW float64
+	recvdBW float64 /* Payload goodput at the bottleneck */
+	linkBW float64 /* Bottleneck capacity counting the headers */
+	lost int64
+	timing pacer.Stats
+}
+
+/* All rounds measured on one path */
+type PathSurvey struct {
+	entry *sciond.PathReplyEntry
+	results []*Measurement
+	errors []error
+	/* A round on this path is running, rounds never overlap */
+	active bool
+}
+
+/* Outcome of the delay correlation test on a pair of paths */
+type SBDResult struct {
+	cross float64
+	auto float64
+	samples int
+	err error
+}
 
 func check(e error) {
 	if e != nil {
@@ -35,12 +89,363 @@ func check(e error) {
 }
 
 func printUsage() {
-	fmt.Println("\nbw_est_client -s SourceSCIONAddress -d DestinationSCIONAddress [-p PacketSize] [-n PacketNum]")
+	fmt.Println("\nbw_est_client -s SourceSCIONAddress -d DestinationSCIONAddress [-p PacketSize] [-n PacketNum] [-g PacketGap] [-b BurstSize] [-pmtu]")
+	fmt.Println("\t[-c Concurrency] [-r Rounds] [-isolate] [-stagger Delay] [-db File]")
 	fmt.Println("\tProvides bottleneck bandwidth estimation from source to dedicated destination using simplified packet pair algorithm")
 	fmt.Println("\tThe SCION address is specified as ISD-AS,[IP Address]:Port")
 	fmt.Println("\tIf source port unspecified, a random available one will be used")
 	fmt.Println("\tExample SCION address 1-1,[127.0.0.1]:42002\n")
 	fmt.Println("If packet size (in bytes) and packet num unspecified, defaults used.")
+	fmt.Println("The default packet size is the largest each path's MTU allows, -pmtu probes for it instead.")
+	fmt.Println("Every path is measured -r times, up to -c paths at once. With -isolate, paths sharing")
+	fmt.Println("an interface are never measured at the same time, so they do not skew each other.")
+	fmt.Println("Every round is appended to the history file given with -db, see history/history.go.")
+	fmt.Println("\nbw_est_client -s SourceSCIONAddress -d DestinationSCIONAddress -sbd [-sbd_n Probes] [-sbd_gap MeanGap]")
+	fmt.Println("\tTests every pair of paths for a shared bottleneck with correlated probe streams")
+	fmt.Println("\tand prints the result as a matrix.")
+}
+
+func median(vals []float64) float64 {
+	if len(vals) == 0 {
+		return 0
+	}
+	sort.Float64s(vals)
+	if len(vals)%2 == 0 {
+		return (vals[len(vals)/2-1] + vals[len(vals)/2]) / 2
+	}
+	return vals[len(vals)/2]
+}
+
+/* Median bottleneck estimate over all successful rounds */
+func (s *PathSurvey) capacity() float64 {
+	bws := make([]float64, len(s.results))
+	for i, res := range s.results {
+		bws[i] = res.recvdBW
+	}
+	return median(bws)
+}
+
+/* Median link-layer capacity over all successful rounds */
+func (s *PathSurvey) linkCapacity() float64 {
+	bws := make([]float64, len(s.results))
+	for i, res := range s.results {
+		bws[i] = res.linkBW
+	}
+	return median(bws)
+}
+
+/* Runs one bandwidth test on one path over its own socket. Errors are
+ * returned instead of being fatal, so one broken path does not end the survey. */
+func measurePath(local *snet.Addr, remote *snet.Addr, pathEntry *sciond.PathReplyEntry) (*Measurement, error) {
+	remote = PathAddr(remote, pathEntry)
+
+	udpConn, err := snet.ListenSCION("udp4", local)
+	if err != nil {
+		return nil, err
+	}
+	defer udpConn.Close()
+
+	/* Paths differ in MTU, so the packet size is chosen per path */
+	pktSize, err := ChoosePacketSize(udpConn, local, remote, pathEntry, PACKET_SIZE, PROBE_PMTU)
+	if err != nil {
+		return nil, err
+	}
+
+	/* time.Sleep is far coarser than the gaps measured, so use a pacer. */
+	res, err := RunSession(udpConn, remote, pktSize, PACKET_NUM, 0, pacer.New(PACKET_GAP, PACKET_BURST))
+	if err != nil {
+		return nil, err
+	}
+	if res.recvd_int == 0 {
+		return nil, fmt.Errorf("Not enough packets successfully received (%d of %d)", res.recvd_num, PACKET_NUM)
+	}
+	/* Header overhead differs per path with its hop count */
+	res.wireSize = WireSize(local, remote, pathEntry, pktSize)
+
+	return &Measurement{
+		pktSize: pktSize,
+		wireSize: res.wireSize,
+		sentBW: res.SentBW(),
+		recvdBW: res.PairBW(),
+		linkBW: res.PairCapacity(),
+		lost: res.Lost(),
+		timing: res.timing,
+	}, nil
+}
+
+/* Measures every path ROUNDS times with at most CONCURRENCY tests running.
+ * With ISOLATE, a test only starts when no running test shares an interface
+ * with it; otherwise the next test that does not conflict goes first. */
+func survey(local *snet.Addr, remote *snet.Addr, surveys []*PathSurvey) {
+	type job struct {
+		survey *PathSurvey
+		round int
+		ifs []string
+	}
+	var pending []*job
+	for r := 1; r <= ROUNDS; r += 1 {
+		for _, s := range surveys {
+			pending = append(pending, &job{s, r, PathInterfaces(s.entry)})
+		}
+	}
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+		running int
+		busy = make(map[string]int)
+	)
+	cond := sync.NewCond(&mu)
+
+	conflicts := func(j *job) bool {
+		if j.survey.active {
+			return true
+		}
+		if !ISOLATE {
+			return false
+		}
+		for _, intf := range j.ifs {
+			if busy[intf] > 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	for len(pending) > 0 {
+		mu.Lock()
+		var next *job
+		for next == nil {
+			if running < CONCURRENCY {
+				for i, j := range pending {
+					if !conflicts(j) {
+						next = j
+						pending = append(pending[:i], pending[i+1:]...)
+						break
+					}
+				}
+			}
+			if next == nil {
+				cond.Wait()
+			}
+		}
+		running += 1
+		next.survey.active = true
+		for _, intf := range next.ifs {
+			busy[intf] += 1
+		}
+		mu.Unlock()
+
+		wg.Add(1)
+		go func(j *job) {
+			defer wg.Done()
+			res, err := measurePath(local, remote, j.survey.entry)
+
+			mu.Lock()
+			if err != nil {
+				j.survey.errors = append(j.survey.errors, err)
+				fmt.Printf("[round %d] %s: failed: %v\n", j.round, j.survey.entry.Path, err)
+			} else {
+				j.survey.results = append(j.survey.results, res)
+				fmt.Printf("[round %d] %s: %.3fMbps (send timing %s)\n", j.round, j.survey.entry.Path,
+					res.recvdBW, res.timing)
+			}
+			running -= 1
+			j.survey.active = false
+			for _, intf := range j.ifs {
+				busy[intf] -= 1
+			}
+			cond.Broadcast()
+			mu.Unlock()
+
+			/* Every round is kept, history uses them for the daily percentiles */
+			if err == nil {
+				KeepResult(*DB_FILE, "bottleneck_path_client", local, remote, j.survey.entry, map[string]float64{
+					history.MetricBandwidth: res.recvdBW,
+					history.MetricLink: res.linkBW,
+					history.MetricLoss: float64(res.lost*100) / float64(PACKET_NUM),
+				})
+			}
+		}(next)
+
+		if STAGGER > 0 {
+			time.Sleep(STAGGER)
+		}
+	}
+	wg.Wait()
+}
+
+/* Pearson correlation coefficient of x and y */
+func correlation(x []float64, y []float64) float64 {
+	n := float64(len(x))
+	var sx, sy, sxx, syy, sxy float64
+	for i := range x {
+		sx += x[i]
+		sy += y[i]
+		sxx += x[i] * x[i]
+		syy += y[i] * y[i]
+		sxy += x[i] * y[i]
+	}
+	cov := sxy/n - (sx/n)*(sy/n)
+	vx := sxx/n - (sx/n)*(sx/n)
+	vy := syy/n - (sy/n)*(sy/n)
+	if vx <= 0 || vy <= 0 {
+		return 0
+	}
+	return cov / math.Sqrt(vx*vy)
+}
+
+/* Delay correlation test of Rubenstein, Kurose and Towsley. Probes go out
+ * in pairs, a_i on path a followed SBD_OFFSET later by b_i on path b, with
+ * exponential gaps averaging SBD_GAP between pairs. Packets close in time
+ * see correlated queueing delay if they pass the same queue, so for a shared
+ * bottleneck the cross measure corr(a_i, b_i) exceeds the auto measure
+ * corr(a_i, a_i+1) of packets further apart on one path.
+ * The server answers each probe with its arrival time, the clock offset
+ * between client and server does not affect the correlation. */
+func sharedBottleneckTest(udpConn *snet.Conn, remote *snet.Addr, a *sciond.PathReplyEntry,
+	b *sciond.PathReplyEntry) *SBDResult {
+
+	dsts := []*snet.Addr{PathAddr(remote, a), PathAddr(remote, b)}
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	/* The exponential gaps add up to twice their mean only very rarely */
+	header, err := OpenSession(udpConn, dsts[0], bwproto.ModeTimestamp, 2*SBD_PROBES,
+		2*time.Duration(SBD_PROBES)*SBD_GAP)
+	if err != nil {
+		return &SBDResult{err: err}
+	}
+	sent := make([]int64, 2*SBD_PROBES)
+	recvd := make([]int64, 2*SBD_PROBES)
+
+	/* Collect TimestampReplies while sending */
+	var stop int32
+	done := make(chan bool)
+	go func() {
+		buff := make([]byte, 64)
+		for {
+			udpConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			m, err := udpConn.Read(buff)
+			if err != nil {
+				if atomic.LoadInt32(&stop) != 0 {
+					close(done)
+					return
+				}
+				continue
+			}
+			h, msg, _ := bwproto.Decode(buff[:m])
+			reply, ok := msg.(*bwproto.TimestampReply)
+			if ok && h.Session == header.Session && int(reply.Seq) < len(recvd) {
+				recvd[reply.Seq] = reply.Recvd
+			}
+		}
+	}()
+
+	sendBuff := make([]byte, SBD_PROBE_SIZE)
+	next := time.Now()
+	for i := 0; i < SBD_PROBES && err == nil; i += 1 {
+		for p := 0; p < 2; p += 1 {
+			seq := 2*i + p
+			t := pacer.SleepUntil(next.Add(time.Duration(p)*SBD_OFFSET), pacer.DefaultSpin)
+			sent[seq] = t.UnixNano()
+			err = SendMsg(udpConn, dsts[p], sendBuff, header, &bwproto.Timestamp{Seq: uint32(seq)}, SBD_PROBE_SIZE)
+			if err != nil {
+				break
+			}
+		}
+		next = next.Add(time.Duration(rng.ExpFloat64() * float64(SBD_GAP)))
+	}
+
+	/* Give the last answers time to arrive */
+	time.Sleep(time.Second)
+	atomic.StoreInt32(&stop, 1)
+	<-done
+	if err != nil {
+		return &SBDResult{err: err}
+	}
+
+	/* One-way delays, lost probes are left out */
+	delay := func(seq int) float64 {
+		return float64(recvd[seq] - sent[seq])
+	}
+	var crossA, crossB, autoA, autoNext []float64
+	for i := 0; i < SBD_PROBES; i += 1 {
+		ai, bi := 2*i, 2*i+1
+		if recvd[ai] != 0 && recvd[bi] != 0 {
+			crossA = append(crossA, delay(ai))
+			crossB = append(crossB, delay(bi))
+		}
+		if i+1 < SBD_PROBES && recvd[ai] != 0 && recvd[ai+2] != 0 {
+			autoA = append(autoA, delay(ai))
+			autoNext = append(autoNext, delay(ai+2))
+		}
+	}
+
+	samples := len(crossA)
+	if len(autoA) < samples {
+		samples = len(autoA)
+	}
+	if samples < MIN_SBD_SAMPLES {
+		return &SBDResult{samples: samples,
+			err: fmt.Errorf("Only %d usable probe pairs, need %d", samples, MIN_SBD_SAMPLES)}
+	}
+	return &SBDResult{
+		cross: correlation(crossA, crossB),
+		auto: correlation(autoA, autoNext),
+		samples: samples,
+	}
+}
+
+/* Runs the shared bottleneck test on every pair of paths and prints the matrix */
+func sharedBottleneckMatrix(local *snet.Addr, remote *snet.Addr, paths []*sciond.PathReplyEntry) {
+	udpConn, err := snet.ListenSCION("udp4", local)
+	check(err)
+	defer udpConn.Close()
+
+	for i, entry := range paths {
+		fmt.Printf("[%d] %s\n", i, entry.Path)
+	}
+	fmt.Println()
+
+	results := make([][]*SBDResult, len(paths))
+	for i := range paths {
+		results[i] = make([]*SBDResult, len(paths))
+	}
+	for i := range paths {
+		for j := i + 1; j < len(paths); j += 1 {
+			res := sharedBottleneckTest(udpConn, remote, paths[i], paths[j])
+			results[i][j], results[j][i] = res, res
+			if res.err != nil {
+				fmt.Printf("[%d]-[%d]: inconclusive, %v\n", i, j, res.err)
+			} else {
+				fmt.Printf("[%d]-[%d]: cross %.3f, auto %.3f over %d samples\n",
+					i, j, res.cross, res.auto, res.samples)
+			}
+		}
+	}
+
+	fmt.Println("\nShared bottleneck (S shared, - not shared, ? inconclusive):")
+	fmt.Printf("%4s", "")
+	for j := range paths {
+		fmt.Printf("%4d", j)
+	}
+	fmt.Println()
+	for i := range paths {
+		fmt.Printf("%4d", i)
+		for j := range paths {
+			res := results[i][j]
+			switch {
+			case i == j:
+				fmt.Printf("%4s", ".")
+			case res.err != nil:
+				fmt.Printf("%4s", "?")
+			case res.cross > res.auto:
+				fmt.Printf("%4s", "S")
+			default:
+				fmt.Printf("%4s", "-")
+			}
+		}
+		fmt.Println()
+	}
 }
 
 func main() {
@@ -51,19 +456,24 @@ func main() {
 		err    error
 		local  *snet.Addr
 		remote *snet.Addr
-		udpConn *snet.Conn
-
-		uid uint64
-		times []int64
-		sentBWs map[pathmgr.PathKey]float64
-		recvdBWs map[pathmgr.PathKey]float64
 	)
 
 	/* Fetch arguments from command line */
 	flag.StringVar(&sourceAddress, "s", "", "Source SCION Address")
 	flag.StringVar(&destinationAddress, "d", "", "Destination SCION Address")
-	flag.IntVar(&PACKET_SIZE, "p", DEFAULT_PACKET_SIZE, "Packet Size")
+	flag.IntVar(&PACKET_SIZE, "p", DEFAULT_PACKET_SIZE, "Packet Size (0 uses the path MTU)")
 	flag.IntVar(&PACKET_NUM, "n", DEFAULT_PACKET_NUM, "Packet Num")
+	flag.DurationVar(&PACKET_GAP, "g", DEFAULT_PACKET_GAP, "Average Gap Between Packets")
+	flag.IntVar(&PACKET_BURST, "b", DEFAULT_PACKET_BURST, "Packets Sent Back-To-Back Per Burst")
+	flag.BoolVar(&PROBE_PMTU, "pmtu", false, "Probe The Path MTU To Choose The Packet Size")
+	flag.IntVar(&CONCURRENCY, "c", 1, "Number Of Paths Measured At Once")
+	flag.IntVar(&ROUNDS, "r", 1, "Number Of Measurements Per Path")
+	flag.BoolVar(&ISOLATE, "isolate", false, "Never Measure Paths Sharing An Interface At Once")
+	flag.DurationVar(&STAGGER, "stagger", 0, "Delay Between Starting Two Measurements")
+	flag.BoolVar(&SBD, "sbd", false, "Test All Pairs Of Paths For A Shared Bottleneck")
+	flag.IntVar(&SBD_PROBES, "sbd_n", 200, "Probes Per Path In The Shared Bottleneck Test")
+	flag.DurationVar(&SBD_GAP, "sbd_gap", 10 * time.Millisecond, "Mean Gap Between Probes In The Shared Bottleneck Test")
+	DB_FILE = HistoryFlag()
 	flag.Parse()
 
 	/* Create the SCION UDP socket */
@@ -81,127 +491,84 @@ func main() {
 		printUsage()
 		check(fmt.Errorf("Error, destination address needs to be specified with -d"))
 	}
+	if CONCURRENCY < 1 {
+		CONCURRENCY = 1
+	}
+	/* Concurrent tests need a socket each, so let them pick free ports */
+	if CONCURRENCY > 1 {
+		local.L4Port = 0
+	}
 
 	sciondAddr := fmt.Sprintf("/run/shm/sciond/sd%d-%d.sock", local.IA.I, local.IA.A)
 	dispatcherAddr := "/run/shm/dispatcher/default.sock"
 	snet.Init(local.IA, sciondAddr, dispatcherAddr)
 
-	sentBWs = make(map[pathmgr.PathKey]float64)
-	recvdBWs = make(map[pathmgr.PathKey]float64)
-	sendBuff := make([]byte, PACKET_SIZE + 1)
-	var zero time.Time /* No read deadline */
-
-	udpConn, err = snet.ListenSCION("udp4", local)
-	check(err)
-
 	/* Get Paths to Remote */
-	var pathEntry *sciond.PathReplyEntry
 	var options pathmgr.AppPathSet
 	options = snet.DefNetwork.PathResolver().Query(local.IA, remote.IA)
 	if len(options) == 0 {
 		check(fmt.Errorf("Cannot find a path from source to destination"))
 	}
 
-	for k, entry := range options {
-		pathEntry = entry.Entry
-
-		fmt.Println("\nPath:", pathEntry.Path.String())
-		remote.Path = spath.New(pathEntry.Path.FwdPath)
-		remote.Path.InitOffsets()
-		remote.NextHopHost = pathEntry.HostInfo.Host()
-		remote.NextHopPort = pathEntry.HostInfo.Port
-
-		times = make([]int64, PACKET_NUM)
-
-		/* Send initialization with timeout NUM_TRIES times */
-		seed := rand.NewSource(time.Now().UnixNano())
-		i := 0
-		for i < NUM_TRIES {
-			n := binary.PutVarint(sendBuff, 1)
-			uid = rand.New(seed).Uint64()
-			m := binary.PutUvarint(sendBuff[n:], uid)
-			k := binary.PutVarint(sendBuff[n+m:], int64(PACKET_NUM))
-			sendBuff[n+m+k] = 0
-
-			/* Send [1, unique_id, #packets] */
-			_, err = udpConn.WriteToSCION(sendBuff[:n+m+k], remote)
-			check(err)
-
-			/* Read [1, same_id] */
-			udpConn.SetReadDeadline(time.Now().Add(2*time.Second))
-			_, err = udpConn.Read(sendBuff)
-			if err != nil {
-				i += 1
-				continue
-			}
-
-			udpConn.SetReadDeadline(zero)
-
-			num, n := binary.Varint(sendBuff)
-			id, _ := binary.Uvarint(sendBuff[n:])
-			if (num == 1) && (uid == id) {
-				break
-			}
-			i += 1
-		}
-
-		if i == NUM_TRIES {
-			check(fmt.Errorf("Error, exceeded maximum number of initialization attempts"))
-		}
-
-		/* Initialize data packet */
-		for i := 0; i < PACKET_SIZE; i += 1 {
-			sendBuff[i] = 'a'
+	if SBD {
+		var paths []*sciond.PathReplyEntry
+		for _, entry := range options {
+			paths = append(paths, entry.Entry)
 		}
-		sendBuff[PACKET_SIZE] = 0
+		sort.Slice(paths, func(i, j int) bool {
+			return paths[i].Path.String() < paths[j].Path.String()
+		})
+		sharedBottleneckMatrix(local, remote, paths)
+		return
+	}
 
-		i = 0
-		for i < PACKET_NUM {
-			times[i] = time.Now().UnixNano()
-			_, err = udpConn.WriteToSCION(sendBuff, remote)
-			check(err)
-			i += 1
-			time.Sleep(time.Millisecond)
-		}
+	var surveys []*PathSurvey
+	for _, entry := range options {
+		surveys = append(surveys, &PathSurvey{entry: entry.Entry})
+	}
+	fmt.Printf("Measuring %d paths, %d rounds each, %d at once\n", len(surveys), ROUNDS, CONCURRENCY)
 
+	survey(local, remote, surveys)
 
-		/* Read [unique_id, interval(ns)] */
-		_, err = udpConn.Read(sendBuff)
-		check(err)
-		id, n := binary.Uvarint(sendBuff)
-		if (uid != id) {
-			check(fmt.Errorf("Error, did not receive the correct id back.\nSent: %d\nReceived: %d\n", uid, id))
-		}
+	/* Highest capacity first, paths without any successful round last */
+	sort.SliceStable(surveys, func(i, j int) bool {
+		return surveys[i].capacity() > surveys[j].capacity()
+	})
 
-		recvd_int, _ := binary.Varint(sendBuff[n:])
-
-		/* Calculate send and received bw */
-		var sum int64 = 0
-		for i := 1; i < PACKET_NUM; i+=1 {
-			sum += (times[i] - times[i-1])
+	/* Display Results */
+	fmt.Printf("\nSource: %s\nDestination: %s\n", sourceAddress, destinationAddress);
+	fmt.Printf("\n%-3s %12s %12s %12s %8s %5s %6s %7s %6s %6s  %s\n",
+		"#", "BW(Mbps)", "Link(Mbps)", "Sent(Mbps)", "Loss", "Hops", "MTU", "PktSize", "Wire", "Fails", "Path")
+	for i, s := range surveys {
+		hops := len(s.entry.Path.Interfaces) / 2
+		if len(s.results) == 0 {
+			fmt.Printf("%-3d %12s %12s %12s %8s %5d %6d %7s %6s %6d  %s\n", i, "-", "-", "-", "-", hops,
+				s.entry.Path.Mtu, "-", "-", len(s.errors), s.entry.Path)
+			continue
 		}
-		sent_int := sum / int64(PACKET_NUM - 1)
-
-		/* Calculate BW (Mbps) = (#Bytes*8 / #nanoseconds) / 1e6 */
-		sentBWs[k] = float64(PACKET_SIZE*8*1e3) / float64(sent_int)
-		if recvd_int != 0 {
-			recvdBWs[k] = float64(PACKET_SIZE*8*1e3) / float64(recvd_int)
-		} else {
-			//fmt.Println("\nNot enough packets successfully received.")
-			recvdBWs[k] = 0
+		var sent float64
+		var lost int64
+		for _, res := range s.results {
+			sent += res.sentBW
+			lost += res.lost
 		}
+		loss := float64(lost*100) / float64(PACKET_NUM*len(s.results))
+		fmt.Printf("%-3d %12.3f %12.3f %12.3f %7.1f%% %5d %6d %7d %6d %6d  %s\n", i, s.capacity(),
+			s.linkCapacity(), sent/float64(len(s.results)), loss, hops, s.entry.Path.Mtu,
+			s.results[0].pktSize, s.results[0].wireSize, len(s.errors), s.entry.Path)
 	}
-
-
-	/* Display Results */
-	fmt.Printf("\nSource: %s\nDestination: %s\n", sourceAddress, destinationAddress);
-
-	for k, bw_sent := range sentBWs {
-		fmt.Println("\nPath:", options[k].Entry.Path.String())
-		fmt.Println("Rate sent:")
-		fmt.Printf("\tBW - %.3fMbps\n", bw_sent)
-		fmt.Println("Bottleneck Bandwidth estimate:")
-		fmt.Printf("\tBW - %.3fMbps\n", recvdBWs[k])
+	fmt.Println("\nBW is the payload goodput of the bottleneck, Link its capacity counting SCION,")
+	fmt.Println("UDP/IP underlay and Ethernet headers. Wire is the packet size on the links in bytes.")
+
+	/* Say why paths failed, one line per distinct error */
+	fmt.Println()
+	for _, s := range surveys {
+		seen := make(map[string]bool)
+		for _, err := range s.errors {
+			if !seen[err.Error()] {
+				seen[err.Error()] = true
+				fmt.Printf("Path %s failed: %v\n", s.entry.Path, err)
+			}
+		}
 	}
-
 }
@@ -0,0 +1,753 @@
+// Shared helpers for the bottleneck bandwidth clients and server.
+// Messages are in the format of lib/bwproto.
+// Build together with the program, e.g. go run bw_est_server.go bw_est_api.go
+
+package main
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/netsec-ethz/scion-homeworks/lib/bwproto"
+	"github.com/netsec-ethz/scion-homeworks/lib/history"
+	"github.com/netsec-ethz/scion-homeworks/lib/pacer"
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/sciond"
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/scionproto/scion/go/lib/spath"
+)
+
+const (
+	PMTU_MIN_SIZE int = 64
+	PMTU_TRIES int = 2
+	PMTU_TIMEOUT time.Duration = 500 * time.Millisecond
+
+	COOKIE_MAC_LEN int = 16
+	/* Hellos are zero padded to this, more than a cookie answer takes */
+	HELLO_MIN_LEN int = 64
+	COOKIE_LIFETIME time.Duration = time.Minute
+
+	/* Admission control defaults of the servers. A session keeps 16 bytes
+	 * per packet, at most 1.6 MB each and 100 MB for all sessions. */
+	DEFAULT_MAX_PACKETS int64 = 100000
+	DEFAULT_MAX_BYTES int64 = 1 << 30
+	DEFAULT_MAX_DURATION time.Duration = time.Minute
+	DEFAULT_MAX_SESSIONS int = 64
+	DEFAULT_HOST_SESSIONS float64 = 1
+	DEFAULT_AS_SESSIONS float64 = 10
+	DEFAULT_HOST_PPS float64 = 20000
+	DEFAULT_AS_PPS float64 = 100000
+	SESSION_BURST float64 = 5
+
+	INIT_TRIES int = 3
+	INIT_TIMEOUT time.Duration = 2 * time.Second
+	/* Server answers at most 4s after the last packet was due */
+	REPLY_TIMEOUT time.Duration = 10 * time.Second
+
+	/* Used when neither -p nor the path says how big packets may be */
+	FALLBACK_PACKET_SIZE int = 8000
+
+	MAX_UDP_PAYLOAD int = 65507
+	SCION_CMN_HDR_LEN int = 8
+	SCION_IA_LEN int = 8
+	UDP_HDR_LEN int = 8
+	/* Between routers SCION packets travel in UDP/IP over Ethernet */
+	IPV4_HDR_LEN int = 20
+	IPV6_HDR_LEN int = 40
+	ETH_HDR_LEN int = 18 /* Header and frame check sequence */
+)
+
+/* Encodes m behind header h into buff, padded to size bytes, and sends it */
+func SendMsg(udpConn *snet.Conn, remote *snet.Addr, buff []byte, h bwproto.Header,
+	m bwproto.Message, size int) error {
+
+	n, err := bwproto.Encode(buff, h, m, size)
+	if err != nil {
+		return err
+	}
+	_, err = udpConn.WriteToSCION(buff[:n], remote)
+	return err
+}
+
+/* Reads until a message of the given session arrives or the read deadline
+ * passes. Anything else, e.g. late answers of earlier sessions, is skipped. */
+func RecvMsg(udpConn *snet.Conn, buff []byte, session uint64) (bwproto.Header, bwproto.Message, error) {
+	for {
+		n, err := udpConn.Read(buff)
+		if err != nil {
+			return bwproto.Header{}, nil, err
+		}
+		h, m, err := bwproto.Decode(buff[:n])
+		if err == nil && h.Session == session {
+			return h, m, nil
+		}
+	}
+}
+
+/* Header for messages that belong to no session, in the oldest version so
+ * that any server understands them */
+func StatelessHeader(id uint64) bwproto.Header {
+	return bwproto.Header{Version: bwproto.MinVersion, Session: id}
+}
+
+/* Run of packets with consecutive sequence numbers that arrived together */
+type arrivalBatch struct {
+	first int
+	size int
+}
+
+/* Averages the dispersion over pairs of consecutive sequence numbers that
+ * were both received. A zero entry in recvd means the packet was lost, so
+ * gaps never get folded into an interval. Pairs that arrived closer than
+ * minGap (ns), the transmission time on the fastest link there is, were
+ * compressed in a queue behind the bottleneck and are left out too.
+ * If most pairs are compressed into clusters the receiver delivered the
+ * packets in batches (interrupt coalescing). The gaps between single pairs
+ * then say nothing, instead the time from the start of one batch to the
+ * next is spread over the packets of the batch.
+ * Returns the average received interval, the average sent interval of the
+ * same pairs (both in ns) and which pairs were used. */
+func FilterDispersion(recvd []int64, sent []int64, minGap int64) (int64, int64, *bwproto.PairStats) {
+	stats := &bwproto.PairStats{MinGap: minGap}
+	var recvd_sum, sent_sum int64
+	for i := 1; i < len(recvd); i += 1 {
+		if recvd[i] == 0 || recvd[i-1] == 0 {
+			stats.Lost += 1
+			continue
+		}
+		/* Reordered pair, the dispersion is meaningless */
+		if recvd[i] < recvd[i-1] {
+			stats.Reordered += 1
+			continue
+		}
+		if recvd[i] - recvd[i-1] < minGap {
+			stats.Compressed += 1
+			continue
+		}
+		recvd_sum += (recvd[i] - recvd[i-1])
+		sent_sum += (sent[i] - sent[i-1])
+		stats.Used += 1
+	}
+
+	/* Group arrivals closer than minGap into batches */
+	var batches []arrivalBatch
+	for i := range recvd {
+		if recvd[i] == 0 {
+			continue
+		}
+		if n := len(batches); n > 0 {
+			b := &batches[n-1]
+			last := b.first + b.size - 1
+			if last == i-1 && recvd[i] >= recvd[last] && recvd[i] - recvd[last] < minGap {
+				b.size += 1
+				continue
+			}
+		}
+		batches = append(batches, arrivalBatch{i, 1})
+	}
+	for _, b := range batches {
+		if b.size > 1 {
+			stats.Clusters += 1
+		}
+		if int64(b.size) > stats.MaxCluster {
+			stats.MaxCluster = int64(b.size)
+		}
+	}
+
+	stats.Coalesced = minGap > 0 && stats.Clusters >= 2 && stats.Compressed >= stats.Used
+	if stats.Coalesced {
+		var batch_recvd, batch_sent, packets, samples int64
+		for j := 1; j < len(batches); j += 1 {
+			a, b := batches[j-1], batches[j]
+			/* Only batches with nothing lost or reordered in between */
+			if b.first != a.first + a.size || recvd[b.first] < recvd[a.first] {
+				continue
+			}
+			batch_recvd += recvd[b.first] - recvd[a.first]
+			batch_sent += sent[b.first] - sent[a.first]
+			packets += int64(a.size)
+			samples += 1
+		}
+		if samples > 0 {
+			stats.Clustered = stats.Used
+			stats.Used = samples
+			return batch_recvd / packets, batch_sent / packets, stats
+		}
+		stats.Coalesced = false
+	}
+
+	if stats.Used == 0 {
+		return 0, 0, stats
+	}
+	return recvd_sum / stats.Used, sent_sum / stats.Used, stats
+}
+
+/* Explains which pairs FilterDispersion left out and why, one line each */
+func DescribePairStats(stats *bwproto.PairStats) []string {
+	var lines []string
+	if stats.Lost > 0 {
+		lines = append(lines, fmt.Sprintf("%d pairs dropped, one of the packets was lost", stats.Lost))
+	}
+	if stats.Reordered > 0 {
+		lines = append(lines, fmt.Sprintf("%d pairs dropped, arrived reordered", stats.Reordered))
+	}
+	if stats.Compressed > 0 {
+		lines = append(lines, fmt.Sprintf("%d pairs dropped, arrived less than %v apart, faster than any link "+
+			"(compressed behind the bottleneck)", stats.Compressed, time.Duration(stats.MinGap)))
+	}
+	if stats.Coalesced {
+		lines = append(lines, fmt.Sprintf("arrivals came in %d clusters of up to %d packets, the receiver "+
+			"coalesces interrupts: %d single pairs replaced by %d cluster to cluster samples",
+			stats.Clusters, stats.MaxCluster, stats.Clustered, stats.Used))
+	} else if stats.Clusters > 0 {
+		lines = append(lines, fmt.Sprintf("%d clusters of up to %d packets, too few for interrupt coalescing",
+			stats.Clusters, stats.MaxCluster))
+	}
+	return lines
+}
+
+
+/* Bytes of SCION and UDP headers in front of the payload on the given path */
+func HeaderOverhead(local *snet.Addr, remote *snet.Addr, entry *sciond.PathReplyEntry) int {
+	addrLen := 2*SCION_IA_LEN + local.Host.Size() + remote.Host.Size()
+	/* Address header is padded to a multiple of 8 bytes */
+	addrLen = (addrLen + 7) / 8 * 8
+	return SCION_CMN_HDR_LEN + addrLen + len(entry.Path.FwdPath) + UDP_HDR_LEN
+}
+
+/* Bytes of the UDP/IP underlay and Ethernet framing around each SCION
+ * packet. Links are assumed to use the address family of the first hop. */
+func LinkOverhead(entry *sciond.PathReplyEntry) int {
+	ip := IPV4_HDR_LEN
+	if host := entry.HostInfo.Host(); host != nil && host.Type() == addr.HostTypeIPv6 {
+		ip = IPV6_HDR_LEN
+	}
+	return ip + UDP_HDR_LEN + ETH_HDR_LEN
+}
+
+/* Size on the links of the path of a packet carrying payload bytes */
+func WireSize(local *snet.Addr, remote *snet.Addr, entry *sciond.PathReplyEntry, payload int) int {
+	return payload + HeaderOverhead(local, remote, entry) + LinkOverhead(entry)
+}
+
+/* Largest payload that fits the MTU the path was announced with.
+ * Returns 0 if the path does not carry an MTU. */
+func MaxPayloadSize(local *snet.Addr, remote *snet.Addr, entry *sciond.PathReplyEntry) int {
+	if entry.Path.Mtu == 0 {
+		return 0
+	}
+	size := int(entry.Path.Mtu) - HeaderOverhead(local, remote, entry)
+	if size < PMTU_MIN_SIZE {
+		return 0
+	}
+	return size
+}
+
+/* Binary search for the largest payload in [lo, hi] the server acknowledges.
+ * Every probe is a PMTUProbe padded to its size and acked with a PMTUAck of
+ * the size received. Returns 0 if not even lo made it through. */
+func ProbePathMTU(udpConn *snet.Conn, remote *snet.Addr, lo int, hi int) int {
+	probeBuff := make([]byte, hi)
+	ackBuff := make([]byte, 64)
+	seed := rand.NewSource(time.Now().UnixNano())
+
+	var zero time.Time
+	defer udpConn.SetReadDeadline(zero)
+
+	best := 0
+	for lo <= hi {
+		size := lo + (hi-lo)/2
+		/* Late acks of earlier probes carry another id */
+		uid := rand.New(seed).Uint64()
+
+		acked := false
+		for try := 0; try < PMTU_TRIES && !acked; try += 1 {
+			/* Oversized packets may already be refused locally */
+			err := SendMsg(udpConn, remote, probeBuff, StatelessHeader(uid),
+				&bwproto.PMTUProbe{Size: uint32(size)}, size)
+			if err != nil {
+				break
+			}
+			udpConn.SetReadDeadline(time.Now().Add(PMTU_TIMEOUT))
+			for !acked {
+				_, msg, err := RecvMsg(udpConn, ackBuff, uid)
+				if err != nil {
+					break
+				}
+				ack, ok := msg.(*bwproto.PMTUAck)
+				acked = ok && ack.Recvd == uint32(size)
+			}
+		}
+
+		if acked {
+			best = size
+			lo = size + 1
+		} else {
+			hi = size - 1
+		}
+	}
+	return best
+}
+
+/* Picks the probe packet size for a path. A size of 0 means the largest
+ * payload the announced path MTU allows. With probe set the size is instead
+ * found by path MTU probing, bounded by the given or announced size. */
+func ChoosePacketSize(udpConn *snet.Conn, local *snet.Addr, remote *snet.Addr,
+	entry *sciond.PathReplyEntry, size int, probe bool) (int, error) {
+
+	if size == 0 {
+		size = MaxPayloadSize(local, remote, entry)
+	}
+	if probe {
+		hi := size
+		if hi == 0 {
+			hi = MAX_UDP_PAYLOAD
+		}
+		size = ProbePathMTU(udpConn, remote, PMTU_MIN_SIZE, hi)
+		if size == 0 {
+			return 0, fmt.Errorf("No path MTU probe was acknowledged, is the server up?")
+		}
+	}
+	if size == 0 {
+		size = FALLBACK_PACKET_SIZE
+	}
+	return size, nil
+}
+
+/* Copy of remote that is sent along the given path */
+func PathAddr(remote *snet.Addr, entry *sciond.PathReplyEntry) *snet.Addr {
+	dst := remote.Copy()
+	dst.Path = spath.New(entry.Path.FwdPath)
+	dst.Path.InitOffsets()
+	dst.NextHopHost = entry.HostInfo.Host()
+	dst.NextHopPort = entry.HostInfo.Port
+	return dst
+}
+
+/* Interfaces a path traverses, as ISD-AS#IfID */
+func PathInterfaces(entry *sciond.PathReplyEntry) []string {
+	var ifs []string
+	for _, intf := range entry.Path.Interfaces {
+		ifs = append(ifs, fmt.Sprintf("%s#%d", intf.ISD_AS(), intf.IfID))
+	}
+	return ifs
+}
+
+/* Registers -db, the history file results are appended to */
+func HistoryFlag() *string {
+	return flag.String("db", history.DefaultFile(), "History File To Append Results To, Empty To Not Keep Them")
+}
+
+/* Appends a result to the history file. The path is identified by its
+ * interfaces, entry is nil if sciond chose it. Failing to keep a result
+ * only warns, it was printed already. */
+func KeepResult(file string, program string, local *snet.Addr, remote *snet.Addr,
+	entry *sciond.PathReplyEntry, values map[string]float64) {
+
+	rec := &history.Record{
+		Kind: history.KindBandwidth,
+		Program: program,
+		Src: history.Endpoint(local.IA.String(), local.Host.String()),
+		Dst: history.Endpoint(remote.IA.String(), remote.Host.String()),
+		Values: values,
+	}
+	if entry != nil {
+		rec.Hops = PathInterfaces(entry)
+	}
+	history.Keep(file, rec)
+}
+
+/* Outcome of one bandwidth test session */
+type SessionResult struct {
+	pktSize int
+	wireSize int /* Packet size on the links, 0 if the path is not known */
+	times []int64 /* Send time of every packet */
+	timing pacer.Stats
+
+	/* As reported by the server */
+	recvd_int int64 /* Average dispersion of received pairs (ns) */
+	pair_sent_int int64 /* Average send gap of the same pairs (ns) */
+	recvd_num int64
+	pairs int64
+	recvd_bytes int64
+	recvd_dur int64 /* First to last arrival (ns) */
+	filter *bwproto.PairStats /* Pairs left out by the server, nil if the server did not send them */
+}
+
+/* Average rate the packets were sent at in Mbps */
+func (r *SessionResult) SentBW() float64 {
+	n := len(r.times)
+	if n < 2 || r.times[n-1] == r.times[0] {
+		return 0
+	}
+	return float64(int64(r.pktSize*8*(n-1))*1e3) / float64(r.times[n-1] - r.times[0])
+}
+
+/* Packet pair bottleneck estimate in Mbps */
+func (r *SessionResult) PairBW() float64 {
+	if r.recvd_int == 0 {
+		return 0
+	}
+	return float64(r.pktSize*8*1e3) / float64(r.recvd_int)
+}
+
+/* Throughput the server saw in Mbps. The first packet only marks the start. */
+func (r *SessionResult) Throughput() float64 {
+	if r.recvd_num < 2 || r.recvd_dur == 0 {
+		return 0
+	}
+	return float64((r.recvd_bytes*int64(r.recvd_num-1)/r.recvd_num)*8*1e3) / float64(r.recvd_dur)
+}
+
+/* Bytes on the wire per payload byte */
+func (r *SessionResult) wireScale() float64 {
+	if r.wireSize == 0 {
+		return 1
+	}
+	return float64(r.wireSize) / float64(r.pktSize)
+}
+
+/* Packet pair estimate of the bottleneck link's capacity in Mbps, counting
+ * the headers as well. PairBW is what is left of it for payload. */
+func (r *SessionResult) PairCapacity() float64 {
+	return r.PairBW() * r.wireScale()
+}
+
+/* Throughput the server saw in Mbps including all headers */
+func (r *SessionResult) WireThroughput() float64 {
+	return r.Throughput() * r.wireScale()
+}
+
+func (r *SessionResult) Lost() int64 {
+	return int64(len(r.times)) - r.recvd_num
+}
+
+/* Opens a session of numPackets probes sent over duration (0 for short
+ * tests) in the given bwproto mode. The Hello offers all versions we speak
+ * and is repeated with the server's cookie if it asks for one.
+ * Returns the header all probes of the session are sent with. */
+func OpenSession(udpConn *snet.Conn, remote *snet.Addr, mode uint8, numPackets int,
+	duration time.Duration) (bwproto.Header, error) {
+
+	var zero time.Time
+	defer udpConn.SetReadDeadline(zero)
+
+	buff := make([]byte, 512)
+	id := rand.New(rand.NewSource(time.Now().UnixNano())).Uint64()
+	hello := &bwproto.Hello{
+		MinVersion: bwproto.MinVersion,
+		MaxVersion: bwproto.MaxVersion,
+		Mode: mode,
+		NumPackets: uint32(numPackets),
+		Duration: int64(duration),
+	}
+
+	/* Send the Hello with timeout INIT_TRIES times. The same id is used for
+	 * all of them, the server only acks repeated ones again. */
+	for i := 0; i < INIT_TRIES; i += 1 {
+		err := SendMsg(udpConn, remote, buff, StatelessHeader(id), hello, HELLO_MIN_LEN)
+		if err != nil {
+			return bwproto.Header{}, err
+		}
+
+		udpConn.SetReadDeadline(time.Now().Add(INIT_TIMEOUT))
+		retry := false
+		for !retry {
+			h, msg, err := RecvMsg(udpConn, buff, id)
+			if err != nil {
+				break
+			}
+			switch msg := msg.(type) {
+			case *bwproto.HelloAck:
+				/* Probes go out in the version the server picked */
+				return bwproto.Header{Version: h.Version, Session: id}, nil
+			case *bwproto.Reject:
+				return bwproto.Header{}, fmt.Errorf("Server refused the test: %s (speaks versions %d-%d)",
+					bwproto.RejectReason(msg.Reason), msg.MinVersion, msg.MaxVersion)
+			case *bwproto.Cookie:
+				/* Proves we own our address, retrying with it is no new attempt */
+				if hello.Cookie == nil {
+					i -= 1
+				}
+				hello.Cookie = msg.Cookie
+				retry = true
+			}
+		}
+	}
+	return bwproto.Header{}, fmt.Errorf("Exceeded maximum number of initialization attempts")
+}
+
+/* Most packets of pktSize a session may have within the default limits of
+ * the servers */
+func MaxSessionPackets(pktSize int) int {
+	maxPackets := DEFAULT_MAX_BYTES / int64(pktSize)
+	if maxPackets > DEFAULT_MAX_PACKETS {
+		maxPackets = DEFAULT_MAX_PACKETS
+	}
+	return int(maxPackets)
+}
+
+/* Runs one train session with the server over udpConn: numPackets Probes of
+ * pktSize bytes are sent as paced by pace after OpenSession, the last one
+ * flagged, and the server answers with a Result.
+ * duration tells the server how long the packets take to send, 0 for short tests. */
+func RunSession(udpConn *snet.Conn, remote *snet.Addr, pktSize int, numPackets int,
+	duration time.Duration, pace *pacer.Pacer) (*SessionResult, error) {
+
+	var zero time.Time
+	defer udpConn.SetReadDeadline(zero)
+
+	h, err := OpenSession(udpConn, remote, bwproto.ModeTrain, numPackets, duration)
+	if err != nil {
+		return nil, err
+	}
+
+	/* Send Probes padded to pktSize */
+	sendBuff := make([]byte, pktSize)
+	res := &SessionResult{pktSize: pktSize, times: make([]int64, numPackets)}
+	probe := &bwproto.Probe{}
+	for i := 0; i < numPackets; i += 1 {
+		res.times[i] = pace.Wait().UnixNano()
+		probe.Seq, probe.Sent = uint32(i), res.times[i]
+		if i == numPackets-1 {
+			h.Flags |= bwproto.FlagLast
+		}
+		err = SendMsg(udpConn, remote, sendBuff, h, probe, pktSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	res.timing = pace.Stats()
+
+	/* Skip late acks of repeated Hellos */
+	udpConn.SetReadDeadline(time.Now().Add(REPLY_TIMEOUT))
+	for {
+		_, msg, err := RecvMsg(udpConn, sendBuff, h.Session)
+		if err != nil {
+			return nil, fmt.Errorf("No result from server: %v", err)
+		}
+		if result, ok := msg.(*bwproto.Result); ok {
+			res.recvd_int = result.RecvdInt
+			res.pair_sent_int = result.PairSentInt
+			res.recvd_num = result.Received
+			res.pairs = result.Pairs
+			res.recvd_bytes = result.Bytes
+			res.recvd_dur = result.RecvDuration
+			res.filter = result.Stats
+			return res, nil
+		}
+	}
+}
+
+/* Token buckets per key, e.g. per host or per AS. Each bucket refills at
+ * rate tokens per second up to burst, a rate <= 0 allows everything. */
+type RateLimiter struct {
+	rate float64
+	burst float64
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last time.Time
+}
+
+func NewRateLimiter(rate float64, burst float64) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{rate: rate, burst: burst, buckets: make(map[string]*bucket)}
+}
+
+/* Takes a token from the bucket of key if there is one */
+func (l *RateLimiter) Allow(key string, now time.Time) bool {
+	if l.rate <= 0 {
+		return true
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens -= 1
+	return true
+}
+
+/* Forgets buckets that refilled completely, they start out full anyway */
+func (l *RateLimiter) Prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+/* Decides which clients a public bandwidth server answers and which tests it
+ * runs for them. Fill in with AdmissionFlags before flag.Parse and call Init after. */
+type Admission struct {
+	MaxPackets int64
+	MaxBytes int64
+	MaxDuration time.Duration
+	MaxSessions int
+	Cookies bool
+
+	allowList, denyList string
+	allow, deny []addr.IA
+
+	hostSessionRate, asSessionRate float64
+	hostReplyRate, asReplyRate float64
+	hostSessions, asSessions *RateLimiter
+	hostReplies, asReplies *RateLimiter
+
+	secret []byte
+}
+
+/* Registers the admission control flags. Servers without sessions (v1)
+ * only get the access lists and reply rate limits. */
+func AdmissionFlags(sessions bool) *Admission {
+	a := &Admission{}
+	flag.StringVar(&a.allowList, "allow", "", "Only Serve These ISD-ASes, Comma Separated (AS 0 Matches The Whole ISD)")
+	flag.StringVar(&a.denyList, "deny", "", "Never Serve These ISD-ASes, Comma Separated (AS 0 Matches The Whole ISD)")
+	flag.Float64Var(&a.hostReplyRate, "host_pps", DEFAULT_HOST_PPS, "Replies Per Second To A Single Host (0 Unlimited)")
+	flag.Float64Var(&a.asReplyRate, "as_pps", DEFAULT_AS_PPS, "Replies Per Second To A Single AS (0 Unlimited)")
+	if sessions {
+		flag.Int64Var(&a.MaxPackets, "max_packets", DEFAULT_MAX_PACKETS, "Most Packets A Test May Send")
+		flag.Int64Var(&a.MaxBytes, "max_bytes", DEFAULT_MAX_BYTES, "Most Bytes A Test May Send")
+		flag.DurationVar(&a.MaxDuration, "max_duration", DEFAULT_MAX_DURATION, "Longest Test Duration")
+		flag.IntVar(&a.MaxSessions, "max_sessions", DEFAULT_MAX_SESSIONS, "Most Tests Running At The Same Time")
+		flag.BoolVar(&a.Cookies, "cookie", true, "Require A Return Routability Cookie To Start A Test")
+		flag.Float64Var(&a.hostSessionRate, "host_sessions", DEFAULT_HOST_SESSIONS, "Tests Per Second A Single Host May Start (0 Unlimited)")
+		flag.Float64Var(&a.asSessionRate, "as_sessions", DEFAULT_AS_SESSIONS, "Tests Per Second A Single AS May Start (0 Unlimited)")
+	}
+	return a
+}
+
+func parseIAList(list string) ([]addr.IA, error) {
+	var ias []addr.IA
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		ia, err := addr.IAFromString(s)
+		if err != nil {
+			return nil, fmt.Errorf("Bad ISD-AS %q: %v", s, err)
+		}
+		ias = append(ias, ia)
+	}
+	return ias, nil
+}
+
+func (a *Admission) Init() error {
+	var err error
+	if a.allow, err = parseIAList(a.allowList); err != nil {
+		return err
+	}
+	if a.deny, err = parseIAList(a.denyList); err != nil {
+		return err
+	}
+	/* Bursts of a second worth of replies, a few tests per host */
+	a.hostReplies = NewRateLimiter(a.hostReplyRate, a.hostReplyRate)
+	a.asReplies = NewRateLimiter(a.asReplyRate, a.asReplyRate)
+	a.hostSessions = NewRateLimiter(a.hostSessionRate, SESSION_BURST)
+	a.asSessions = NewRateLimiter(a.asSessionRate, SESSION_BURST*10)
+
+	a.secret = make([]byte, 32)
+	_, err = crand.Read(a.secret)
+	return err
+}
+
+func matchIA(list []addr.IA, ia addr.IA) bool {
+	for _, entry := range list {
+		if entry.I == ia.I && (entry.A == 0 || entry.A == ia.A) {
+			return true
+		}
+	}
+	return false
+}
+
+/* Whether the access lists let the AS of client in */
+func (a *Admission) Permitted(client *snet.Addr) bool {
+	if matchIA(a.deny, client.IA) {
+		return false
+	}
+	return len(a.allow) == 0 || matchIA(a.allow, client.IA)
+}
+
+func hostKey(client *snet.Addr) string {
+	return fmt.Sprintf("%s,[%v]", client.IA, client.Host)
+}
+
+/* Whether client may be sent a reply now, takes from its rate limits */
+func (a *Admission) AllowReply(client *snet.Addr, now time.Time) bool {
+	return a.Permitted(client) && a.hostReplies.Allow(hostKey(client), now) &&
+		a.asReplies.Allow(client.IA.String(), now)
+}
+
+func (a *Admission) cookieMAC(client *snet.Addr, issued int64) []byte {
+	mac := hmac.New(sha256.New, a.secret)
+	fmt.Fprintf(mac, "%s:%d|%d", hostKey(client), client.L4Port, issued)
+	return mac.Sum(nil)[:COOKIE_MAC_LEN]
+}
+
+/* Cookie for client as [time issued(s), MAC]. Only the real owner of the
+ * address gets to see it, so a test started with it cannot be aimed at a
+ * spoofed victim. The server keeps no state for it. */
+func (a *Admission) Cookie(client *snet.Addr, now time.Time) []byte {
+	buff := make([]byte, binary.MaxVarintLen64 + COOKIE_MAC_LEN)
+	n := binary.PutVarint(buff, now.Unix())
+	n += copy(buff[n:], a.cookieMAC(client, now.Unix()))
+	return buff[:n]
+}
+
+func (a *Admission) CheckCookie(client *snet.Addr, cookie []byte, now time.Time) bool {
+	issued, n := binary.Varint(cookie)
+	if n <= 0 || len(cookie[n:]) != COOKIE_MAC_LEN {
+		return false
+	}
+	age := now.Unix() - issued
+	if age < 0 || age > int64(COOKIE_LIFETIME/time.Second) {
+		return false
+	}
+	return hmac.Equal(cookie[n:], a.cookieMAC(client, issued))
+}
+
+/* Decides on a test of numPackets lasting duration while active others run.
+ * Returns 0 to admit it, otherwise the bwproto reject reason. */
+func (a *Admission) AdmitSession(client *snet.Addr, numPackets int64, duration time.Duration,
+	active int, now time.Time) uint8 {
+
+	if numPackets > a.MaxPackets || duration > a.MaxDuration {
+		return bwproto.RejectTooLarge
+	}
+	if active >= a.MaxSessions {
+		return bwproto.RejectBusy
+	}
+	if !a.hostSessions.Allow(hostKey(client), now) || !a.asSessions.Allow(client.IA.String(), now) {
+		return bwproto.RejectRate
+	}
+	return 0
+}
+
+/* Drops state of clients that have been quiet for a while */
+func (a *Admission) Prune(now time.Time) {
+	a.hostReplies.Prune(now)
+	a.asReplies.Prune(now)
+	a.hostSessions.Prune(now)
+	a.asSessions.Prune(now)
+}
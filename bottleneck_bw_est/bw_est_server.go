@@ -0,0 +1,376 @@
+// Dedicated server for esitmating bottleneck bandwidth
+// Serves the v1 (echo) and v2 (train) clients alike, the mode and protocol
+// version are agreed on when a test starts.
+// Run with: go run bw_est_server.go bw_est_api.go
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/netsec-ethz/scion-homeworks/lib/bwproto"
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/scionproto/scion/go/lib/sciond"
+)
+
+const (
+	/* Large enough for any probe, a truncated PMTU probe must not be acked */
+	RECEIVE_SIZE int = MAX_UDP_PAYLOAD
+	/* A session is answered this long after its last packet was due at the latest */
+	SESSION_TIMEOUT time.Duration = 4 * time.Second
+	/* Stragglers reordered behind the last probe are waited for this long */
+	LAST_GRACE time.Duration = 50 * time.Millisecond
+	/* How often expired sessions are looked for while no packets arrive */
+	SWEEP_INTERVAL time.Duration = 100 * time.Millisecond
+	/* How often rate limits of quiet clients are forgotten */
+	PRUNE_INTERVAL time.Duration = 10 * time.Second
+	/* Fastest link a probe may have crossed, in Mbps */
+	DEFAULT_MAX_LINK float64 = 10000
+)
+
+var (
+	MAX_LINK float64
+)
+
+/* State of one bandwidth test. Several clients can test at the same
+ * time, their probes are told apart by the session id. */
+type Session struct {
+	clientAddr *snet.Addr
+	header bwproto.Header /* Agreed version and session id */
+	mode uint8
+	num_packets int64
+	pktSize int64 /* Size of the first probe, all are the same */
+	deadline time.Time
+
+	/* Indexed by seq, grown as probes arrive up to the highest seq seen */
+	times []int64
+	sentTimes []int64
+	count int64
+	bytes int64
+	first, last int64 /* Arrival of the first and last packet (ns) */
+}
+
+/* Makes room for the probe seq, a test only takes memory for the probes
+ * that actually arrived up to that point */
+func (session *Session) grow(seq int64) {
+	if n := seq + 1 - int64(len(session.times)); n > 0 {
+		session.times = append(session.times, make([]int64, n)...)
+		session.sentTimes = append(session.sentTimes, make([]int64, n)...)
+	}
+}
+
+func check(e error) {
+	if e != nil {
+		log.Fatal(e)
+	}
+}
+
+func printUsage() {
+	fmt.Println("\nbw_est_server -s ServerSCIONAddress")
+	fmt.Println("\tListens for incoming connections and responds back to them right away with the time received")
+	fmt.Println("\tEcho tests (v1 client) get every probe back, train tests (v2 client) a summary at the end")
+	fmt.Println("\tAlso acknowledges path MTU probes of clients run with -pmtu, timestamps probes of -sbd")
+	fmt.Println("\tand acks every packet of congestion controlled transfers (cc_bw_est_client)")
+	fmt.Println("\tAll tests but path MTU probes are limited in size and rate per host and AS,")
+	fmt.Println("\t-allow and -deny restrict who is served")
+	fmt.Println("\tand clients have to echo a cookie before a test starts unless -cookie=false")
+	fmt.Println("\tPairs arriving faster than a -max_link Mbps link could deliver them are left out")
+	fmt.Println("\tThe SCION address is specified as ISD-AS,[IP Address]:Port")
+	fmt.Println("\tIf server listening port unspecified, a random available one will be used")
+	fmt.Println("\tExample SCION address 1-1,[127.0.0.1]:42002\n")
+}
+
+/* Sends the Result of a train session, the other modes just end */
+func finishSession(udpConn *snet.Conn, session *Session, buff []byte) {
+	lost := session.num_packets - session.count
+	switch session.mode {
+	case bwproto.ModeEcho:
+		fmt.Printf("Echo test with %s: echoed %d packets, lost %d\n", session.clientAddr, session.count, lost)
+		return
+	case bwproto.ModeTimestamp:
+		fmt.Printf("Timestamp test with %s: answered %d of %d probes\n",
+			session.clientAddr, session.count, session.num_packets)
+		return
+	case bwproto.ModeCC:
+		fmt.Printf("Transfer with %s: acked %d packets, %d bytes\n", session.clientAddr, session.count, session.bytes)
+		return
+	}
+
+	/* Only consecutive pairs that both arrived give a valid interval, and
+	 * only if they were not closer than the fastest link allows.
+	 * Gap (ns) = #Bytes*8 / Mbps * 1e3 */
+	min_gap := int64(float64(session.pktSize*8*1e3) / MAX_LINK)
+	recvd_int, sent_int, stats := FilterDispersion(session.times, session.sentTimes, min_gap)
+	/* Pairs behind the highest seq that arrived were lost as well */
+	if received := int64(len(session.times)); received > 0 {
+		stats.Lost += session.num_packets - received
+	} else {
+		stats.Lost += session.num_packets - 1
+	}
+	result := &bwproto.Result{
+		RecvdInt: recvd_int,
+		PairSentInt: sent_int,
+		Received: session.count,
+		Pairs: stats.Used,
+		Bytes: session.bytes,
+		RecvDuration: session.last - session.first,
+		Stats: stats,
+	}
+
+	fmt.Printf("Test with %s: received %d packets, lost %d (%.1f%%), %d usable pairs\n",
+		session.clientAddr, session.count, lost, float64(lost*100)/float64(session.num_packets), stats.Used)
+	for _, line := range DescribePairStats(stats) {
+		fmt.Println("\t" + line)
+	}
+
+	send(udpConn, session.clientAddr, buff, session.header, result)
+}
+
+/* Sends a reply, a failed send only loses the reply. Clients choose the
+ * address we answer to, so their errors must not stop the server. */
+func send(udpConn *snet.Conn, clientAddr *snet.Addr, buff []byte, h bwproto.Header,
+	msg bwproto.Message) bool {
+
+	if err := SendMsg(udpConn, clientAddr, buff, h, msg, 0); err != nil {
+		log.Println("Could not answer", clientAddr, "-", err)
+		return false
+	}
+	return true
+}
+
+/* Whether the server runs sessions of mode */
+func knownMode(mode uint8) bool {
+	return mode == bwproto.ModeEcho || mode == bwproto.ModeTrain ||
+		mode == bwproto.ModeTimestamp || mode == bwproto.ModeCC
+}
+
+/* Answers a request of reqLen bytes unless the answer would be larger, so
+ * requests from spoofed addresses gain an attacker nothing */
+func answer(udpConn *snet.Conn, clientAddr *snet.Addr, buff []byte, h bwproto.Header,
+	msg bwproto.Message, reqLen int) {
+
+	if reqLen >= bwproto.HeaderLen + msg.Len() {
+		send(udpConn, clientAddr, buff, h, msg)
+	}
+}
+
+func main() {
+	var (
+		err    error
+
+		serverAddr string
+		server *snet.Addr
+		udpConn *snet.Conn
+
+		clientAddr *snet.Addr
+		sessions map[uint64]*Session
+	)
+
+	// Fetch arguments from command line
+	flag.StringVar(&serverAddr, "s", "", "Server SCION Address")
+	flag.Float64Var(&MAX_LINK, "max_link", DEFAULT_MAX_LINK, "Fastest Link Rate In Mbps, Closer Arrivals Are Compressed")
+	admission := AdmissionFlags(true)
+	flag.Parse()
+	check(admission.Init())
+	if MAX_LINK <= 0 {
+		check(fmt.Errorf("Error, the fastest link rate needs to be above 0"))
+	}
+
+	// Create the SCION UDP socket
+	if len(serverAddr) > 0 {
+		server, err = snet.AddrFromString(serverAddr)
+		check(err)
+	} else {
+		printUsage()
+		check(fmt.Errorf("Error, server address needs to be specified with -s"))
+	}
+
+	dispatcherAddr := "/run/shm/dispatcher/default.sock"
+	snet.Init(server.IA, sciond.GetDefaultSCIONDPath(nil), dispatcherAddr)
+
+	udpConn, err = snet.ListenSCION("udp4", server)
+	check(err)
+
+	receiveBuff := make([]byte, RECEIVE_SIZE + 1)
+	sendBuff := make([]byte, 512)
+	sessions = make(map[uint64]*Session)
+	var m int
+	lastPrune := time.Now()
+
+	for {
+		/* Wake up regularly so sessions whose packets got lost still end */
+		udpConn.SetReadDeadline(time.Now().Add(SWEEP_INTERVAL))
+		m, clientAddr, err = udpConn.ReadFromSCION(receiveBuff)
+		time_received := time.Now()
+
+		if err == nil {
+			h, msg, err := bwproto.Decode(receiveBuff[:m])
+
+			/* Probes of running sessions need no further checks */
+			if probe, ok := msg.(*bwproto.Probe); ok {
+				session, ok := sessions[h.Session]
+				if !ok || !clientAddr.EqAddr(session.clientAddr) {
+					continue
+				}
+				seq := int64(probe.Seq)
+				if seq < session.num_packets {
+					session.grow(seq)
+				}
+				if seq < session.num_packets && session.times[seq] == 0 {
+					session.times[seq] = time_received.UnixNano()
+					session.sentTimes[seq] = probe.Sent
+					if session.count == 0 {
+						session.first = session.times[seq]
+						session.pktSize = int64(m)
+					}
+					session.last = session.times[seq]
+					session.count += 1
+					session.bytes += int64(m)
+
+					/* Echo [same seq, time sent, time received] */
+					if session.mode == bwproto.ModeEcho && admission.AllowReply(clientAddr, time_received) {
+						echo := &bwproto.Echo{Seq: probe.Seq, Sent: probe.Sent, Recvd: session.times[seq]}
+						answer(udpConn, clientAddr, sendBuff, session.header, echo, m)
+					}
+				}
+				if h.Flags&bwproto.FlagLast != 0 && time_received.Add(LAST_GRACE).Before(session.deadline) {
+					session.deadline = time_received.Add(LAST_GRACE)
+				}
+				if session.count >= session.num_packets || session.bytes >= admission.MaxBytes {
+					finishSession(udpConn, session, sendBuff)
+					delete(sessions, h.Session)
+				}
+				continue
+			}
+
+			/* Timestamps and transfer data are answered one by one, within the
+			 * limits their session was admitted with */
+			switch msg.(type) {
+			case *bwproto.Timestamp, *bwproto.CCData:
+				session, ok := sessions[h.Session]
+				if !ok || !clientAddr.EqAddr(session.clientAddr) {
+					continue
+				}
+				var reply bwproto.Message
+				if ts, ok := msg.(*bwproto.Timestamp); ok && session.mode == bwproto.ModeTimestamp {
+					/* Answer with the time received(ns) */
+					reply = &bwproto.TimestampReply{Seq: ts.Seq, Recvd: time_received.UnixNano()}
+				} else if data, ok := msg.(*bwproto.CCData); ok && session.mode == bwproto.ModeCC {
+					reply = &bwproto.CCAck{Seq: data.Seq}
+				} else {
+					continue
+				}
+				if session.count == 0 {
+					session.first = time_received.UnixNano()
+				}
+				session.last = time_received.UnixNano()
+				session.count += 1
+				session.bytes += int64(m)
+				if admission.AllowReply(clientAddr, time_received) {
+					answer(udpConn, clientAddr, sendBuff, session.header, reply, m)
+				}
+				if session.count >= session.num_packets || session.bytes >= admission.MaxBytes {
+					finishSession(udpConn, session, sendBuff)
+					delete(sessions, h.Session)
+				}
+				continue
+			}
+
+			/* Everything else is answered, which must not make us a reflector */
+			if (err != nil && err != bwproto.ErrVersion) || !admission.AllowReply(clientAddr, time_received) {
+				continue
+			}
+			reply := StatelessHeader(h.Session)
+			reply.Version = h.Version
+
+			switch msg := msg.(type) {
+			case nil:
+				/* Version we do not speak, tell which ones we do */
+				reject := &bwproto.Reject{Reason: bwproto.RejectVersion,
+					MinVersion: bwproto.MinVersion, MaxVersion: bwproto.MaxVersion}
+				answer(udpConn, clientAddr, sendBuff, StatelessHeader(h.Session), reject, m)
+
+			/* Path MTU probe, ack right away with the size received */
+			case *bwproto.PMTUProbe:
+				answer(udpConn, clientAddr, sendBuff, reply, &bwproto.PMTUAck{Recvd: uint32(m)}, m)
+
+			/* Start of a test. Duration is how long the client needs to send,
+			 * 0 for short tests. */
+			case *bwproto.Hello:
+				session, ok := sessions[h.Session]
+				if ok && !clientAddr.EqAddr(session.clientAddr) {
+					continue
+				}
+				/* A repeated Hello means our ack got lost, only ack again */
+				if !ok {
+					version, common := bwproto.Negotiate(msg.MinVersion, msg.MaxVersion)
+					var reason uint8
+					if !common {
+						reason = bwproto.RejectVersion
+					} else if !knownMode(msg.Mode) {
+						reason = bwproto.RejectMode
+					} else if msg.NumPackets == 0 || msg.Duration < 0 {
+						continue
+					}
+
+					/* Send a Cookie to a client that has yet to show it receives
+					 * packets at its address. Short Hellos are dropped so the
+					 * answer is never larger than what a spoofer sent. */
+					if reason == 0 && admission.Cookies &&
+						!admission.CheckCookie(clientAddr, msg.Cookie, time_received) {
+						if m < HELLO_MIN_LEN {
+							continue
+						}
+						cookie := &bwproto.Cookie{Cookie: admission.Cookie(clientAddr, time_received)}
+						send(udpConn, clientAddr, sendBuff, reply, cookie)
+						continue
+					}
+
+					num_packets := int64(msg.NumPackets)
+					if reason == 0 {
+						reason = admission.AdmitSession(clientAddr, num_packets, time.Duration(msg.Duration),
+							len(sessions), time_received)
+					}
+					if reason != 0 {
+						fmt.Println("Refused test of", clientAddr, "for", num_packets, "packets:",
+							bwproto.RejectReason(reason))
+						reject := &bwproto.Reject{Reason: reason,
+							MinVersion: bwproto.MinVersion, MaxVersion: bwproto.MaxVersion}
+						answer(udpConn, clientAddr, sendBuff, reply, reject, m)
+						continue
+					}
+
+					session = &Session{
+						clientAddr: clientAddr,
+						header: bwproto.Header{Version: version, Session: h.Session},
+						mode: msg.Mode,
+						num_packets: num_packets,
+						deadline: time_received.Add(time.Duration(msg.Duration) + SESSION_TIMEOUT),
+					}
+					sessions[h.Session] = session
+					fmt.Println("Beginning bandwidth test with", clientAddr, "for", num_packets,
+						"packets, version", version)
+				}
+
+				ack := &bwproto.HelloAck{Mode: session.mode}
+				send(udpConn, clientAddr, sendBuff, session.header, ack)
+			}
+		}
+
+		if time_received.Sub(lastPrune) > PRUNE_INTERVAL {
+			admission.Prune(time_received)
+			lastPrune = time_received
+		}
+
+		/* Answer sessions that ran out of time with what arrived so far */
+		for id, session := range sessions {
+			if time_received.After(session.deadline) {
+				finishSession(udpConn, session, sendBuff)
+				delete(sessions, id)
+			}
+		}
+	}
+}
@@ -0,0 +1,431 @@
+// Client for a congestion controlled bulk transfer to the v2 server
+// Run with: go run cc_bw_est_client.go bw_est_api.go
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"time"
+
+	"github.com/netsec-ethz/scion-homeworks/lib/bwproto"
+	"github.com/netsec-ethz/scion-homeworks/lib/history"
+	"github.com/netsec-ethz/scion-homeworks/lib/pacer"
+	"github.com/scionproto/scion/go/lib/sciond"
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/scionproto/scion/go/lib/spath/spathmeta"
+)
+
+const (
+	DEFAULT_PACKET_SIZE int = 0 /* Derived from the path MTU */
+	DEFAULT_DURATION time.Duration = 10 * time.Second
+	DEFAULT_INTERVAL time.Duration = 250 * time.Millisecond
+	DEFAULT_PAIR_NUM int = 20
+
+	/* CUBIC constants as in RFC 8312 */
+	CUBIC_C float64 = 0.4
+	CUBIC_BETA float64 = 0.7
+	INITIAL_CWND float64 = 10
+	MIN_CWND float64 = 2
+
+	/* Packets acked after a missing one before it counts as lost */
+	REORDER_SLACK int64 = 3
+	MIN_RTO time.Duration = 200 * time.Millisecond
+	MAX_RTO time.Duration = 2 * time.Second
+)
+
+var (
+	PACKET_SIZE int
+	DURATION time.Duration
+	INTERVAL time.Duration
+	PAIR_NUM int
+	PROBE_PMTU bool
+	TRACE_FILE string
+)
+
+/* State of the CUBIC window, in packets */
+type Cubic struct {
+	cwnd float64
+	ssthresh float64
+	wMax float64
+	k float64
+	epochStart time.Time
+
+	srtt time.Duration
+	rttvar time.Duration
+}
+
+/* Congestion window and RTT whenever an ack or loss changes them */
+type TracePoint struct {
+	at time.Duration /* Since the start of the transfer */
+	cwnd float64
+	rtt time.Duration /* Sample of this ack, 0 on losses */
+	srtt time.Duration
+	acked int64 /* Bytes acked so far */
+	lost int64
+}
+
+
+func check(e error) {
+	if e != nil {
+		log.Fatal(e)
+	}
+}
+
+func printUsage() {
+	fmt.Println("\ncc_bw_est_client -s SourceSCIONAddress -d DestinationSCIONAddress [-p PacketSize] [-t Duration] [-i Interval] [-n PairNum] [-pmtu] [-o TraceFile] [-db File]")
+	fmt.Println("\tSends a bulk transfer to the v2 bw_est_server, paced by CUBIC congestion control on the server's acks")
+	fmt.Println("\tReports the throughput, RTT and congestion window over time and compares them to a packet pair estimate")
+	fmt.Println("\tThe SCION address is specified as ISD-AS,[IP Address]:Port")
+	fmt.Println("\tIf source port unspecified, a random available one will be used")
+	fmt.Println("\tExample SCION address 1-1,[127.0.0.1]:42002")
+	fmt.Println("\tThe default packet size is the largest the path MTU allows, -pmtu probes for it instead.")
+	fmt.Println("\tLost packets are counted but not retransmitted, -n 0 skips the packet pair estimate.")
+	fmt.Println("\t-o writes every window update as CSV, results are appended to the -db history file.")
+}
+
+func NewCubic() *Cubic {
+	return &Cubic{cwnd: INITIAL_CWND, ssthresh: math.Inf(1)}
+}
+
+func (c *Cubic) RTO() time.Duration {
+	if c.srtt == 0 {
+		return time.Second
+	}
+	rto := c.srtt + 4*c.rttvar
+	if rto < MIN_RTO {
+		rto = MIN_RTO
+	}
+	if rto > MAX_RTO {
+		rto = MAX_RTO
+	}
+	return rto
+}
+
+func (c *Cubic) OnAck(now time.Time, rtt time.Duration) {
+	/* RTT estimation as in RFC 6298 */
+	if c.srtt == 0 {
+		c.srtt = rtt
+		c.rttvar = rtt / 2
+	} else {
+		diff := c.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		c.rttvar = (3*c.rttvar + diff) / 4
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+
+	if c.cwnd < c.ssthresh {
+		c.cwnd += 1
+		return
+	}
+
+	/* Congestion avoidance, the first ack after a loss starts the epoch */
+	if c.epochStart.IsZero() {
+		c.epochStart = now
+		if c.cwnd < c.wMax {
+			c.k = math.Cbrt((c.wMax - c.cwnd) / CUBIC_C)
+		} else {
+			c.k = 0
+			c.wMax = c.cwnd
+		}
+	}
+	t := now.Sub(c.epochStart).Seconds()
+	rttSec := c.srtt.Seconds()
+	target := CUBIC_C*math.Pow(t+rttSec-c.k, 3) + c.wMax
+
+	/* Window standard TCP would have by now, CUBIC never grows slower */
+	tcp := c.wMax*CUBIC_BETA + 3*(1-CUBIC_BETA)/(1+CUBIC_BETA)*t/rttSec
+	if target < tcp {
+		target = tcp
+	}
+	if target > c.cwnd {
+		c.cwnd += (target - c.cwnd) / c.cwnd
+	}
+}
+
+func (c *Cubic) OnLoss() {
+	c.epochStart = time.Time{}
+	/* Fast convergence, release bandwidth to newer flows */
+	if c.cwnd < c.wMax {
+		c.wMax = c.cwnd * (1 + CUBIC_BETA) / 2
+	} else {
+		c.wMax = c.cwnd
+	}
+	c.cwnd = math.Max(c.cwnd*CUBIC_BETA, MIN_CWND)
+	c.ssthresh = c.cwnd
+}
+
+func (c *Cubic) OnTimeout() {
+	c.epochStart = time.Time{}
+	c.wMax = c.cwnd
+	c.ssthresh = math.Max(c.cwnd*CUBIC_BETA, MIN_CWND)
+	c.cwnd = 1
+}
+
+/* Sends CCData packets of PACKET_SIZE for DURATION with at most cwnd of
+ * them unacked, the server answers each with a CCAck. The transfer stops
+ * early at the most packets the server admits for a session.
+ * Returns the trace and the time the transfer took. */
+func transfer(udpConn *snet.Conn, remote *snet.Addr) ([]TracePoint, time.Duration) {
+	var (
+		trace []TracePoint
+		nextSeq int64
+		recoveryPoint int64 = -1
+		ackedBytes int64
+		lost int64
+		zero time.Time
+	)
+	defer udpConn.SetReadDeadline(zero)
+
+	maxPackets := int64(MaxSessionPackets(PACKET_SIZE))
+	h, err := OpenSession(udpConn, remote, bwproto.ModeCC, int(maxPackets), DURATION)
+	check(err)
+
+	cc := NewCubic()
+	sendBuff := make([]byte, PACKET_SIZE)
+	ackBuff := make([]byte, 64)
+	outstanding := make(map[int64]time.Time)
+
+	start := time.Now()
+	end := start.Add(DURATION)
+	record := func(now time.Time, rtt time.Duration) {
+		trace = append(trace, TracePoint{now.Sub(start), cc.cwnd, rtt, cc.srtt, ackedBytes, lost})
+	}
+
+	/* Keep going past the end until the last packets are acked or lost */
+	for (time.Now().Before(end) && nextSeq < maxPackets) || len(outstanding) > 0 {
+		for time.Now().Before(end) && nextSeq < maxPackets && len(outstanding) < int(cc.cwnd) {
+			check(SendMsg(udpConn, remote, sendBuff, h, &bwproto.CCData{Seq: uint32(nextSeq)}, PACKET_SIZE))
+			outstanding[nextSeq] = time.Now()
+			nextSeq += 1
+		}
+
+		udpConn.SetReadDeadline(time.Now().Add(cc.RTO()))
+		_, msg, err := RecvMsg(udpConn, ackBuff, h.Session)
+		now := time.Now()
+		if err != nil {
+			/* Nothing came back for a whole RTO, the window is gone */
+			lost += int64(len(outstanding))
+			outstanding = make(map[int64]time.Time)
+			cc.OnTimeout()
+			recoveryPoint = nextSeq - 1
+			record(now, 0)
+			continue
+		}
+
+		ack, ok := msg.(*bwproto.CCAck)
+		if !ok {
+			continue
+		}
+		seq := int64(ack.Seq)
+		sent, ok := outstanding[seq]
+		if !ok {
+			/* Duplicate or already given up on */
+			continue
+		}
+		delete(outstanding, seq)
+		ackedBytes += int64(PACKET_SIZE)
+		rtt := now.Sub(sent)
+		cc.OnAck(now, rtt)
+
+		/* Packets far enough behind an acked one are lost, the window is
+		 * reduced at most once per window of data */
+		congested := false
+		for s := range outstanding {
+			if s+REORDER_SLACK < seq {
+				delete(outstanding, s)
+				lost += 1
+				if s > recoveryPoint {
+					congested = true
+				}
+			}
+		}
+		if congested {
+			cc.OnLoss()
+			recoveryPoint = nextSeq - 1
+		}
+		record(now, rtt)
+	}
+	return trace, time.Since(start)
+}
+
+/* Prints throughput, window and RTT per INTERVAL of the transfer */
+func printTimeline(trace []TracePoint) {
+	fmt.Printf("\n%8s %12s %10s %12s %12s %8s\n", "Time", "Throughput", "Cwnd", "SRTT", "Max RTT", "Lost")
+	var prev TracePoint
+	i := 0
+	for bucket := INTERVAL; i < len(trace); bucket += INTERVAL {
+		var maxRtt time.Duration
+		last := prev
+		for ; i < len(trace) && trace[i].at < bucket; i += 1 {
+			last = trace[i]
+			if last.rtt > maxRtt {
+				maxRtt = last.rtt
+			}
+		}
+		mbps := float64((last.acked-prev.acked)*8) / INTERVAL.Seconds() / 1e6
+		fmt.Printf("%8v %8.3fMbps %10.1f %12v %12v %8d\n", bucket, mbps, last.cwnd,
+			last.srtt, maxRtt, last.lost-prev.lost)
+		prev = last
+	}
+}
+
+func writeTrace(filename string, trace []TracePoint) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fmt.Fprintln(file, "time_ms,cwnd_packets,rtt_ms,srtt_ms,acked_bytes,lost_packets")
+	for _, p := range trace {
+		fmt.Fprintf(file, "%.3f,%.2f,%.3f,%.3f,%d,%d\n", float64(p.at)/1e6, p.cwnd,
+			float64(p.rtt)/1e6, float64(p.srtt)/1e6, p.acked, p.lost)
+	}
+	return nil
+}
+
+func main() {
+	var (
+		sourceAddress string
+		destinationAddress string
+
+		err    error
+		local  *snet.Addr
+		remote *snet.Addr
+		udpConn *snet.Conn
+	)
+
+	/* Fetch arguments from command line */
+	flag.StringVar(&sourceAddress, "s", "", "Source SCION Address")
+	flag.StringVar(&destinationAddress, "d", "", "Destination SCION Address")
+	flag.IntVar(&PACKET_SIZE, "p", DEFAULT_PACKET_SIZE, "Packet Size (0 uses the path MTU)")
+	flag.DurationVar(&DURATION, "t", DEFAULT_DURATION, "Duration Of The Transfer")
+	flag.DurationVar(&INTERVAL, "i", DEFAULT_INTERVAL, "Interval Of The Reported Timeline")
+	flag.IntVar(&PAIR_NUM, "n", DEFAULT_PAIR_NUM, "Packets Of The Packet Pair Estimate")
+	flag.BoolVar(&PROBE_PMTU, "pmtu", false, "Probe The Path MTU To Choose The Packet Size")
+	flag.StringVar(&TRACE_FILE, "o", "", "CSV File To Write The Window Trace To")
+	dbFile := HistoryFlag()
+	flag.Parse()
+
+	/* Create the SCION UDP socket */
+	if len(sourceAddress) > 0 {
+		local, err = snet.AddrFromString(sourceAddress)
+		check(err)
+	} else {
+		printUsage()
+		check(fmt.Errorf("Error, source address needs to be specified with -s"))
+	}
+	if len(destinationAddress) > 0 {
+		remote, err = snet.AddrFromString(destinationAddress)
+		check(err)
+	} else {
+		printUsage()
+		check(fmt.Errorf("Error, destination address needs to be specified with -d"))
+	}
+	if INTERVAL <= 0 || DURATION <= 0 {
+		check(fmt.Errorf("Error, duration and interval need to be above 0"))
+	}
+
+	dispatcherAddr := "/run/shm/dispatcher/default.sock"
+	snet.Init(local.IA, sciond.GetDefaultSCIONDPath(nil), dispatcherAddr)
+
+	/* Register local application */
+	udpConn, err = snet.ListenSCION("udp4", local)
+	check(err)
+
+	/* Get Path to Remote, the shortest one */
+	var pathEntry *sciond.PathReplyEntry
+	var options spathmeta.AppPathSet
+	options = snet.DefNetwork.PathResolver().Query(local.IA, remote.IA)
+	if len(options) == 0 {
+		check(fmt.Errorf("Cannot find a path from source to destination"))
+	}
+	for _, entry := range options {
+		if pathEntry == nil || len(entry.Entry.Path.Interfaces) < len(pathEntry.Path.Interfaces) {
+			pathEntry = entry.Entry
+		}
+	}
+
+	fmt.Println("\nPath:", pathEntry.Path.String())
+	remote = PathAddr(remote, pathEntry)
+
+	PACKET_SIZE, err = ChoosePacketSize(udpConn, local, remote, pathEntry, PACKET_SIZE, PROBE_PMTU)
+	check(err)
+	wireSize := WireSize(local, remote, pathEntry, PACKET_SIZE)
+	fmt.Printf("Packet size: %d bytes, %d on the wire (path MTU %d)\n", PACKET_SIZE, wireSize, pathEntry.Path.Mtu)
+
+	/* Back-to-back packets for the packet pair estimate */
+	var pairBW float64
+	if PAIR_NUM >= 2 {
+		res, err := RunSession(udpConn, remote, PACKET_SIZE, PAIR_NUM, 0, pacer.New(0, 1))
+		if err != nil {
+			fmt.Println("Packet pair estimate failed:", err)
+		} else {
+			pairBW = res.PairBW()
+		}
+	}
+
+	trace, elapsed := transfer(udpConn, remote)
+	if len(trace) == 0 {
+		check(fmt.Errorf("Error, no packet of the transfer was acked"))
+	}
+	printTimeline(trace)
+	if len(TRACE_FILE) > 0 {
+		check(writeTrace(TRACE_FILE, trace))
+		fmt.Println("Window trace written to", TRACE_FILE)
+	}
+
+	last := trace[len(trace)-1]
+	var minRtt, maxRtt, sumRtt time.Duration
+	var samples int64
+	var maxCwnd float64
+	for _, p := range trace {
+		if p.cwnd > maxCwnd {
+			maxCwnd = p.cwnd
+		}
+		if p.rtt == 0 {
+			continue
+		}
+		if samples == 0 || p.rtt < minRtt {
+			minRtt = p.rtt
+		}
+		if p.rtt > maxRtt {
+			maxRtt = p.rtt
+		}
+		sumRtt += p.rtt
+		samples += 1
+	}
+	sent := last.acked/int64(PACKET_SIZE) + last.lost
+	throughput := float64(last.acked*8) / elapsed.Seconds() / 1e6
+
+	fmt.Printf("\nSource: %s\nDestination: %s\n", sourceAddress, destinationAddress);
+	fmt.Printf("Throughput: %.3fMbps goodput, %.3fMbps on the wire over %v\n", throughput,
+		throughput*float64(wireSize)/float64(PACKET_SIZE), elapsed)
+	fmt.Printf("Acked %d bytes, lost %d of %d packets (%.2f%%)\n", last.acked, last.lost, sent,
+		float64(last.lost*100)/math.Max(float64(sent), 1))
+	if samples > 0 {
+		fmt.Printf("RTT: min %v, avg %v, max %v\n", minRtt, sumRtt/time.Duration(samples), maxRtt)
+	}
+	fmt.Printf("Congestion window: max %.1f, final %.1f packets\n", maxCwnd, last.cwnd)
+	if pairBW > 0 {
+		fmt.Printf("Packet pair estimate: %.3fMbps, transfer reached %.1f%% of it\n",
+			pairBW, throughput*100/pairBW)
+	}
+
+	values := map[string]float64{
+		history.MetricThroughput: throughput,
+		history.MetricLoss: float64(last.lost*100) / math.Max(float64(sent), 1),
+	}
+	if samples > 0 {
+		values[history.MetricRTT] = float64(sumRtt/time.Duration(samples)) / 1e6
+	}
+	if pairBW > 0 {
+		values[history.MetricBandwidth] = pairBW
+	}
+	KeepResult(*dbFile, "cc_bw_est_client", local, remote, pathEntry, values)
+}
@@ -1,16 +1,18 @@
 // Dedicated client for estimating bottleneck bandwidth
+// Run with: go run v1_bw_est_client.go bw_est_api.go
 
 package main
 
 import (
 	"flag"
-	"encoding/binary"
 	"fmt"
 	"log"
-	"math/rand"
 	"sort"
 	"time"
 
+	"github.com/netsec-ethz/scion-homeworks/lib/bwproto"
+	"github.com/netsec-ethz/scion-homeworks/lib/history"
+	"github.com/netsec-ethz/scion-homeworks/lib/pacer"
 	"github.com/scionproto/scion/go/lib/sciond"
 	"github.com/scionproto/scion/go/lib/snet"
 	"github.com/scionproto/scion/go/lib/spath"
@@ -18,8 +20,9 @@ import (
 )
 
 const (
-	PACKET_SIZE int = 4000
+	DEFAULT_PACKET_SIZE int = 4000
 	PACKET_NUM int = 10
+	DEFAULT_PACKET_GAP time.Duration = time.Microsecond
 )
 
 type Checkpoint struct {
@@ -27,10 +30,19 @@ type Checkpoint struct {
 }
 
 var (
-	// unique id: (Time sent, time received)
-	recvMap map[uint64]*Checkpoint
+	// sequence #: (Time sent, time received)
+	recvMap map[uint32]*Checkpoint
 	udpConnection *snet.Conn
+	/* Echo session with the server */
+	header bwproto.Header
 	multiplier int = 1
+	/* Largest payload the MTU of the path metadata allows, this client does not probe the PMTU */
+	PACKET_SIZE int
+	/* PACKET_SIZE plus the headers on the links of the path */
+	WIRE_SIZE int
+	packetGap time.Duration
+	packetBurst int
+	sendTiming pacer.Stats
 )
 
 func check(e error) {
@@ -40,7 +52,7 @@ func check(e error) {
 }
 
 func printUsage() {
-	fmt.Println("\nbw_est_client -s SourceSCIONAddress -d DestinationSCIONAddress")
+	fmt.Println("\nbw_est_client -s SourceSCIONAddress -d DestinationSCIONAddress [-g PacketGap] [-b BurstSize] [-db File]")
 	fmt.Println("\tProvides bottleneck bandwidth estimation from source to dedicated destination using simplified packet pair algorithm")
 	fmt.Println("\tThe SCION address is specified as ISD-AS,[IP Address]:Port")
 	fmt.Println("\tIf source port unspecified, a random available one will be used")
@@ -75,47 +87,47 @@ func getAverageBottleneckBW() (float64, float64) {
 	return bw_sent, bw_recvd
 }
 
-func sendPackets() {
+func sendPackets(remote *snet.Addr) {
 
 	var err error
-	sendPacketBuffer := make([]byte, PACKET_SIZE + 1)
-	for i := 0; i < PACKET_SIZE; i+=1 {
-		sendPacketBuffer[i] = 'a'
-	}
-	sendPacketBuffer[PACKET_SIZE] = 0
+	sendPacketBuffer := make([]byte, PACKET_SIZE)
+
+	/* The server echoes probes of this session only */
+	header, err = OpenSession(udpConnection, remote, bwproto.ModeEcho, PACKET_NUM*multiplier, 0)
+	check(err)
 
-	seed := rand.NewSource(time.Now().UnixNano())
+	pace := pacer.New(packetGap, packetBurst)
 	iters := 0
 	for iters < (PACKET_NUM*multiplier) {
+		seq := uint32(iters)
 		iters += 1
 
-		id := rand.New(seed).Uint64()
-		_ = binary.PutUvarint(sendPacketBuffer, id)
-
-		recvMap[id] = &Checkpoint{time.Now().UnixNano(), 0}
-		_, err = udpConnection.Write(sendPacketBuffer)
+		recvMap[seq] = &Checkpoint{pace.Wait().UnixNano(), 0}
+		probe := &bwproto.Probe{Seq: seq, Sent: recvMap[seq].sent}
+		err = SendMsg(udpConnection, remote, sendPacketBuffer, header, probe, PACKET_SIZE)
 		check(err)
-		time.Sleep(time.Microsecond)
 	}
+	sendTiming = pace.Stats()
 }
 
 // Receives replies from packets and puts them in receivemap
 func recvPackets() int {
 
-	var err error
 	receivePacketBuffer := make([]byte, PACKET_SIZE + 1)
 
 	udpConnection.SetReadDeadline(time.Now().Add(5*time.Second))
 	num := 0
 	for num < PACKET_NUM {
-		_, _, err = udpConnection.ReadFrom(receivePacketBuffer)
+		_, msg, err := RecvMsg(udpConnection, receivePacketBuffer, header.Session)
 		if (err != nil) {
 			break
 		}
-		ret_id, n := binary.Uvarint(receivePacketBuffer)
-		if val, ok := recvMap[ret_id]; ok {
-			time_recvd, _ := binary.Varint(receivePacketBuffer[n:])
-			val.recvd = time_recvd
+		echo, ok := msg.(*bwproto.Echo)
+		if !ok {
+			continue
+		}
+		if val, ok := recvMap[echo.Seq]; ok && val.recvd == 0 {
+			val.recvd = echo.Recvd
 			num += 1
 		}
 	}
@@ -136,6 +148,9 @@ func main() {
 	// Fetch arguments from command line
 	flag.StringVar(&sourceAddress, "s", "", "Source SCION Address")
 	flag.StringVar(&destinationAddress, "d", "", "Destination SCION Address")
+	flag.DurationVar(&packetGap, "g", DEFAULT_PACKET_GAP, "Average Gap Between Packets")
+	flag.IntVar(&packetBurst, "b", 1, "Packets Sent Back-To-Back Per Burst")
+	dbFile := HistoryFlag()
 	flag.Parse()
 
 	// Create the SCION UDP socket
@@ -178,12 +193,19 @@ func main() {
 	remote.NextHopHost = pathEntry.HostInfo.Host()
 	remote.NextHopPort = pathEntry.HostInfo.Port
 
-	udpConnection, err = snet.DialSCION("udp4", local, remote)
+	PACKET_SIZE = MaxPayloadSize(local, remote, pathEntry)
+	if PACKET_SIZE == 0 {
+		PACKET_SIZE = DEFAULT_PACKET_SIZE
+	}
+	WIRE_SIZE = WireSize(local, remote, pathEntry, PACKET_SIZE)
+	fmt.Printf("Packet size: %d bytes, %d on the wire (path MTU %d)\n", PACKET_SIZE, WIRE_SIZE, pathEntry.Path.Mtu)
+
+	udpConnection, err = snet.ListenSCION("udp4", local)
 	check(err)
 
-	recvMap = make(map[uint64]*Checkpoint)
+	recvMap = make(map[uint32]*Checkpoint)
 
-	sendPackets()
+	sendPackets(remote)
 	num := recvPackets()
 
 	fmt.Println("# packets:", num)
@@ -197,6 +219,15 @@ func main() {
 	fmt.Printf("\nSource: %s\nDestination: %s\n", sourceAddress, destinationAddress);
 	fmt.Println("Rate sent:")
 	fmt.Printf("\tBW - %.3fMbps\n", bw_sent)
+	fmt.Printf("\tTiming - %s\n", sendTiming)
 	fmt.Println("Bottleneck Bandwidth estimate:")
-	fmt.Printf("\tBW - %.3fMbps\n", bw_recvd)
+	fmt.Printf("\tBW - %.3fMbps payload goodput\n", bw_recvd)
+	bw_link := bw_recvd*float64(WIRE_SIZE)/float64(PACKET_SIZE)
+	fmt.Printf("\tLink capacity - %.3fMbps counting all headers\n", bw_link)
+
+	KeepResult(*dbFile, "v1_bw_est_client", local, remote, pathEntry, map[string]float64{
+		history.MetricBandwidth: bw_recvd,
+		history.MetricLink: bw_link,
+		history.MetricLoss: float64((PACKET_NUM*multiplier - num)*100) / float64(PACKET_NUM*multiplier),
+	})
 }
@@ -1,15 +1,19 @@
 // Dedicated client for estimating bottleneck bandwidth
+// Run with: go run v2_bw_est_client.go bw_est_api.go
 
 package main
 
 import (
 	"flag"
-	"encoding/binary"
 	"fmt"
 	"log"
-	"math/rand"
+	"os"
+	"sort"
+	"sync"
 	"time"
 
+	"github.com/netsec-ethz/scion-homeworks/lib/history"
+	"github.com/netsec-ethz/scion-homeworks/lib/pacer"
 	"github.com/scionproto/scion/go/lib/sciond"
 	"github.com/scionproto/scion/go/lib/snet"
 	"github.com/scionproto/scion/go/lib/spath"
@@ -17,16 +21,45 @@ import (
 )
 
 const (
-	DEFAULT_PACKET_SIZE int = 8000
+	DEFAULT_PACKET_SIZE int = 0 /* Derived from the path MTU */
 	DEFAULT_PACKET_NUM int = 10
-	NUM_TRIES int = 3
+	DEFAULT_PACKET_GAP time.Duration = time.Millisecond
+	DEFAULT_PACKET_BURST int = 1
+	DEFAULT_MP_DURATION time.Duration = 3 * time.Second
+	/* Throughput drop when used together that counts as a shared bottleneck */
+	SHARED_DROP float64 = 0.2
+	/* A sweep step tracks the sent rate if at least this much of it arrives */
+	KNEE_RATIO float64 = 0.95
+	/* Steps past the knee before the sweep stops loading the path */
+	KNEE_STEPS int = 2
 )
 
 var (
 	PACKET_SIZE int
 	PACKET_NUM int
+	PACKET_GAP time.Duration
+	PACKET_BURST int
+	PROBE_PMTU bool
+
+	MULTIPATH int
+	MP_DURATION time.Duration
+
+	SWEEP bool
+	SWEEP_START float64
+	SWEEP_STEP float64
+	SWEEP_MAX float64
+	SWEEP_FILE string
 )
 
+/* One rate of a sweep, rates in Mbps */
+type SweepStep struct {
+	requested float64
+	sent float64
+	recvd float64
+	loss float64
+	pairBW float64
+}
+
 
 func check(e error) {
 	if e != nil {
@@ -35,12 +68,247 @@ func check(e error) {
 }
 
 func printUsage() {
-	fmt.Println("\nbw_est_client -s SourceSCIONAddress -d DestinationSCIONAddress [-p PacketSize] [-n PacketNum]")
+	fmt.Println("\nbw_est_client -s SourceSCIONAddress -d DestinationSCIONAddress [-p PacketSize] [-n PacketNum] [-g PacketGap] [-b BurstSize] [-pmtu] [-db File]")
 	fmt.Println("\tProvides bottleneck bandwidth estimation from source to dedicated destination using simplified packet pair algorithm")
 	fmt.Println("\tThe SCION address is specified as ISD-AS,[IP Address]:Port")
 	fmt.Println("\tIf source port unspecified, a random available one will be used")
 	fmt.Println("\tExample SCION address 1-1,[127.0.0.1]:42002")
-	fmt.Println("\tIf packet size (in bytes) and packet num are unspecified, defaults are used.\n")
+	fmt.Println("\tIf packet size (in bytes) and packet num are unspecified, defaults are used.")
+	fmt.Println("\tThe default packet size is the largest the path MTU allows, -pmtu probes for it instead.")
+	fmt.Println("\tResults are appended to the history file given with -db, see history/history.go.")
+	fmt.Println("\nbw_est_client -s SourceSCIONAddress -d DestinationSCIONAddress -mp NumPaths [-t Duration] [-g PacketGap]")
+	fmt.Println("\tStripes a transfer over the NumPaths most disjoint paths, one packet every PacketGap on each,")
+	fmt.Println("\tand reports per path and aggregate throughput and which paths share a bottleneck.")
+	fmt.Println("\nbw_est_client -s SourceSCIONAddress -d DestinationSCIONAddress -sweep [-sweep_start Mbps]")
+	fmt.Println("\t[-sweep_step Mbps] [-sweep_max Mbps] [-t StepDuration] [-o File.csv]")
+	fmt.Println("\tRaises the sending rate step by step and reports where the received rate stops")
+	fmt.Println("\tfollowing it. The curve can be written to a CSV file.\n")
+}
+
+/* Sends at SWEEP_START, SWEEP_START+SWEEP_STEP, ... Mbps for MP_DURATION each
+ * until SWEEP_MAX, until KNEE_STEPS steps after the received rate stopped
+ * tracking the sent rate or until a step fails. Steps are shortened to stay
+ * within the default server limits. Returns all steps and the index of the
+ * knee, -1 if the path kept up with every rate. */
+func rateSweep(udpConn *snet.Conn, remote *snet.Addr) ([]*SweepStep, int) {
+	var steps []*SweepStep
+	knee := -1
+	for rate := SWEEP_START; rate <= SWEEP_MAX; rate += SWEEP_STEP {
+		/* Gap (ns) = #Bytes*8 / Mbps * 1e3 */
+		gap := time.Duration(float64(PACKET_SIZE*8*1e3) / rate)
+		numPackets := int(MP_DURATION / gap)
+		/* Fast steps are shortened to what the server lets a test send */
+		if maxPackets := MaxSessionPackets(PACKET_SIZE); numPackets > maxPackets {
+			numPackets = maxPackets
+		}
+		if numPackets < 2 {
+			numPackets = 2
+		}
+		duration := time.Duration(numPackets) * gap
+
+		res, err := RunSession(udpConn, remote, PACKET_SIZE, numPackets, duration, pacer.New(gap, 1))
+		if err != nil {
+			/* A step without a result says nothing about the path */
+			fmt.Printf("%10.3f Mbps: failed, %v\n", rate, err)
+			break
+		}
+		step := &SweepStep{requested: rate}
+		step.sent = res.SentBW()
+		step.recvd = res.Throughput()
+		step.loss = float64(res.Lost()*100) / float64(numPackets)
+		step.pairBW = res.PairBW()
+		fmt.Printf("%10.3f Mbps: sent %10.3f Mbps, received %10.3f Mbps, loss %5.1f%%\n",
+			rate, step.sent, step.recvd, step.loss)
+		steps = append(steps, step)
+
+		if knee < 0 && step.recvd < step.sent*KNEE_RATIO {
+			knee = len(steps) - 1
+		}
+		if knee >= 0 && len(steps)-1-knee >= KNEE_STEPS {
+			break
+		}
+	}
+	return steps, knee
+}
+
+func writeSweep(filename string, steps []*SweepStep) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fmt.Fprintln(file, "requested_mbps,sent_mbps,received_mbps,loss_pct,pair_estimate_mbps")
+	for _, step := range steps {
+		fmt.Fprintf(file, "%.3f,%.3f,%.3f,%.2f,%.3f\n",
+			step.requested, step.sent, step.recvd, step.loss, step.pairBW)
+	}
+	return nil
+}
+
+/* Picks n paths sharing as few interfaces as possible, shorter paths first */
+func selectDisjointPaths(options spathmeta.AppPathSet, n int) []*sciond.PathReplyEntry {
+	var candidates []*sciond.PathReplyEntry
+	for _, entry := range options {
+		candidates = append(candidates, entry.Entry)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return len(candidates[i].Path.Interfaces) < len(candidates[j].Path.Interfaces)
+	})
+
+	var chosen []*sciond.PathReplyEntry
+	used := make(map[string]bool)
+	for len(chosen) < n && len(candidates) > 0 {
+		best, bestShared := 0, -1
+		for i, entry := range candidates {
+			shared := 0
+			for _, intf := range PathInterfaces(entry) {
+				if used[intf] {
+					shared += 1
+				}
+			}
+			if bestShared < 0 || shared < bestShared {
+				best, bestShared = i, shared
+			}
+		}
+		for _, intf := range PathInterfaces(candidates[best]) {
+			used[intf] = true
+		}
+		chosen = append(chosen, candidates[best])
+		candidates = append(candidates[:best], candidates[best+1:]...)
+	}
+	return chosen
+}
+
+/* Sends on all paths at once for MP_DURATION, each at the configured rate
+ * over its own socket. Returns the throughput (Mbps) the server saw per path. */
+func stripeTransfer(local *snet.Addr, remote *snet.Addr, paths []*sciond.PathReplyEntry,
+	pktSizes []int) ([]float64, []error) {
+
+	bws := make([]float64, len(paths))
+	errs := make([]error, len(paths))
+	numPackets := int(MP_DURATION / PACKET_GAP)
+
+	var wg sync.WaitGroup
+	for i := range paths {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dst := PathAddr(remote, paths[i])
+
+			udpConn, err := snet.ListenSCION("udp4", local)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer udpConn.Close()
+
+			res, err := RunSession(udpConn, dst, pktSizes[i], numPackets, MP_DURATION,
+				pacer.New(PACKET_GAP, PACKET_BURST))
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			bws[i] = res.Throughput()
+		}(i)
+	}
+	wg.Wait()
+	return bws, errs
+}
+
+/* Measures every path alone, then all together. A path that gets
+ * noticeably slower when used together competes with another one, the
+ * slowed down paths are then tested pairwise to find out with which. */
+func runMultipath(local *snet.Addr, remote *snet.Addr, options spathmeta.AppPathSet) {
+	if PACKET_GAP <= 0 {
+		check(fmt.Errorf("Error, multipath transfers need a packet gap (-g) above 0"))
+	}
+	/* Every stream needs its own socket */
+	local = local.Copy()
+	local.L4Port = 0
+
+	paths := selectDisjointPaths(options, MULTIPATH)
+	if len(paths) < MULTIPATH {
+		fmt.Printf("Only %d paths available\n", len(paths))
+	}
+
+	pktSizes := make([]int, len(paths))
+	for i, entry := range paths {
+		pktSizes[i] = PACKET_SIZE
+		if pktSizes[i] == 0 {
+			pktSizes[i] = MaxPayloadSize(local, remote, entry)
+		}
+		if pktSizes[i] == 0 {
+			pktSizes[i] = FALLBACK_PACKET_SIZE
+		}
+		fmt.Printf("[%d] %s (%d byte packets)\n", i, entry.Path, pktSizes[i])
+	}
+
+	solo := make([]float64, len(paths))
+	for i := range paths {
+		bws, errs := stripeTransfer(local, remote, paths[i:i+1], pktSizes[i:i+1])
+		if errs[0] != nil {
+			fmt.Printf("[%d] failed alone: %v\n", i, errs[0])
+		}
+		solo[i] = bws[0]
+	}
+
+	together, errs := stripeTransfer(local, remote, paths, pktSizes)
+	var aggregate, soloSum float64
+	drop := make([]float64, len(paths))
+	fmt.Printf("\n%-4s %12s %15s %7s\n", "Path", "Alone(Mbps)", "Together(Mbps)", "Drop")
+	for i := range paths {
+		if errs[i] != nil {
+			fmt.Printf("[%d] failed together: %v\n", i, errs[i])
+		}
+		if solo[i] > 0 {
+			drop[i] = 1 - together[i]/solo[i]
+		}
+		aggregate += together[i]
+		soloSum += solo[i]
+		fmt.Printf("[%-2d] %12.3f %15.3f %6.1f%%\n", i, solo[i], together[i], drop[i]*100)
+	}
+	fmt.Printf("\nAggregate throughput: %.3fMbps (paths alone add up to %.3fMbps)\n", aggregate, soloSum)
+
+	/* Only paths that lost throughput together can share a bottleneck */
+	var suspects []int
+	for i := range paths {
+		if drop[i] > SHARED_DROP {
+			suspects = append(suspects, i)
+		}
+	}
+	if len(suspects) < 2 {
+		fmt.Println("No paths share a bottleneck.")
+		return
+	}
+
+	fmt.Println("\nPaths sharing a bottleneck:")
+	found := false
+	for a := 0; a < len(suspects); a += 1 {
+		for b := a + 1; b < len(suspects); b += 1 {
+			i, j := suspects[a], suspects[b]
+			bws, _ := stripeTransfer(local, remote,
+				[]*sciond.PathReplyEntry{paths[i], paths[j]}, []int{pktSizes[i], pktSizes[j]})
+			if bws[0] > solo[i]*(1-SHARED_DROP) || bws[1] > solo[j]*(1-SHARED_DROP) {
+				continue
+			}
+			found = true
+			var common []string
+			ifs := make(map[string]bool)
+			for _, intf := range PathInterfaces(paths[i]) {
+				ifs[intf] = true
+			}
+			for _, intf := range PathInterfaces(paths[j]) {
+				if ifs[intf] {
+					common = append(common, intf)
+				}
+			}
+			fmt.Printf("\t[%d] and [%d]: %.1f%% and %.1f%% slower together, common interfaces %v\n",
+				i, j, (1-bws[0]/solo[i])*100, (1-bws[1]/solo[j])*100, common)
+		}
+	}
+	if !found {
+		fmt.Println("\tNone pairwise, the drop needs more than two paths at once.")
+	}
 }
 
 func main() {
@@ -52,16 +320,24 @@ func main() {
 		local  *snet.Addr
 		remote *snet.Addr
 		udpConn *snet.Conn
-
-		uid uint64
-		times []int64
 	)
 
 	/* Fetch arguments from command line */
 	flag.StringVar(&sourceAddress, "s", "", "Source SCION Address")
 	flag.StringVar(&destinationAddress, "d", "", "Destination SCION Address")
-	flag.IntVar(&PACKET_SIZE, "p", DEFAULT_PACKET_SIZE, "Packet Size")
+	flag.IntVar(&PACKET_SIZE, "p", DEFAULT_PACKET_SIZE, "Packet Size (0 uses the path MTU)")
 	flag.IntVar(&PACKET_NUM, "n", DEFAULT_PACKET_NUM, "Packet Num")
+	flag.DurationVar(&PACKET_GAP, "g", DEFAULT_PACKET_GAP, "Average Gap Between Packets")
+	flag.IntVar(&PACKET_BURST, "b", DEFAULT_PACKET_BURST, "Packets Sent Back-To-Back Per Burst")
+	flag.BoolVar(&PROBE_PMTU, "pmtu", false, "Probe The Path MTU To Choose The Packet Size")
+	flag.IntVar(&MULTIPATH, "mp", 0, "Stripe A Transfer Over This Many Paths")
+	flag.DurationVar(&MP_DURATION, "t", DEFAULT_MP_DURATION, "Duration Of Multipath Transfers And Sweep Steps")
+	flag.BoolVar(&SWEEP, "sweep", false, "Sweep The Sending Rate To Find The Saturation Knee")
+	flag.Float64Var(&SWEEP_START, "sweep_start", 1, "First Rate Of The Sweep In Mbps")
+	flag.Float64Var(&SWEEP_STEP, "sweep_step", 1, "Rate Increment Of The Sweep In Mbps")
+	flag.Float64Var(&SWEEP_MAX, "sweep_max", 100, "Highest Rate Of The Sweep In Mbps")
+	flag.StringVar(&SWEEP_FILE, "o", "", "CSV File To Write The Sweep Curve To")
+	dbFile := HistoryFlag()
 	flag.Parse()
 
 	/* Create the SCION UDP socket */
@@ -95,6 +371,11 @@ func main() {
 		check(fmt.Errorf("Cannot find a path from source to destination"))
 	}
 
+	if MULTIPATH > 0 {
+		runMultipath(local, remote, options)
+		return
+	}
+
 	var biggest string
 	for k, entry := range options {
 		if k.String() > biggest {
@@ -108,94 +389,86 @@ func main() {
 	remote.NextHopHost = pathEntry.HostInfo.Host()
 	remote.NextHopPort = pathEntry.HostInfo.Port
 
-	times = make([]int64, PACKET_NUM)
-	sendBuff := make([]byte, PACKET_SIZE + 1)
-
-	/* Send initialization with timeout NUM_TRIES times */
-	seed := rand.NewSource(time.Now().UnixNano())
-	/* No read deadline */
-	var zero time.Time
-	i := 0
-	for i < NUM_TRIES {
-		n := binary.PutVarint(sendBuff, 1)
-		uid = rand.New(seed).Uint64()
-		m := binary.PutUvarint(sendBuff[n:], uid)
-		k := binary.PutVarint(sendBuff[n+m:], int64(PACKET_NUM))
-		sendBuff[n+m+k] = 0
-
-		/* Send [1, unique_id, #packets] */
-		_, err = udpConn.WriteToSCION(sendBuff[:n+m+k], remote)
-		check(err)
+	PACKET_SIZE, err = ChoosePacketSize(udpConn, local, remote, pathEntry, PACKET_SIZE, PROBE_PMTU)
+	check(err)
+	fmt.Printf("Packet size: %d bytes (path MTU %d)\n", PACKET_SIZE, pathEntry.Path.Mtu)
 
-		/* Read [1, same_id] */
-		udpConn.SetReadDeadline(time.Now().Add(2*time.Second))
-		_, err = udpConn.Read(sendBuff)
-		if err != nil {
-			i += 1
-			continue
+	if SWEEP {
+		if SWEEP_START <= 0 || SWEEP_STEP <= 0 || SWEEP_START > SWEEP_MAX {
+			check(fmt.Errorf("Error, sweep start and step need to be above 0 and start at most the maximum"))
 		}
-
-		udpConn.SetReadDeadline(zero)
-
-		num, n := binary.Varint(sendBuff)
-		id, _ := binary.Uvarint(sendBuff[n:])
-		if (num == 1) && (uid == id) {
-			break
+		steps, knee := rateSweep(udpConn, remote)
+		if len(steps) == 0 {
+			check(fmt.Errorf("Error, no step of the sweep succeeded"))
 		}
-		i += 1
-	}
-
-	if i == NUM_TRIES {
-		check(fmt.Errorf("Error, exceeded maximum number of initialization attempts"))
-	}
-
-	/* Initialize data packet */
-	for i := 0; i < PACKET_SIZE; i += 1 {
-		sendBuff[i] = 'a'
-	}
-	sendBuff[PACKET_SIZE] = 0
-
-	i = 0
-	for i < PACKET_NUM {
-		times[i] = time.Now().UnixNano()
-		_, err = udpConn.WriteToSCION(sendBuff, remote)
-		check(err)
-		i += 1
-		time.Sleep(time.Millisecond)
+		if len(SWEEP_FILE) > 0 {
+			check(writeSweep(SWEEP_FILE, steps))
+			fmt.Println("Sweep curve written to", SWEEP_FILE)
+		}
+		var best float64
+		for _, step := range steps {
+			if step.recvd > best {
+				best = step.recvd
+			}
+		}
+		fmt.Printf("\nSource: %s\nDestination: %s\n", sourceAddress, destinationAddress);
+		if knee < 0 {
+			fmt.Printf("No saturation up to %.3fMbps\n", steps[len(steps)-1].requested)
+		} else if knee == 0 {
+			fmt.Printf("Saturated already at %.3fMbps\n", steps[0].requested)
+		} else {
+			fmt.Printf("Saturation knee between %.3fMbps and %.3fMbps\n",
+				steps[knee-1].requested, steps[knee].requested)
+		}
+		fmt.Printf("Highest received rate: %.3fMbps\n", best)
+		return
 	}
 
-
-	/* Read [unique_id, interval(ns)] */
-	_, err = udpConn.Read(sendBuff)
+	/* Send Probes [sequence #, time sent(ns)] padded to PACKET_SIZE and read
+	 * the Result. time.Sleep is far coarser than the gaps measured, so use a pacer. */
+	res, err := RunSession(udpConn, remote, PACKET_SIZE, PACKET_NUM, 0, pacer.New(PACKET_GAP, PACKET_BURST))
 	check(err)
-	id, n := binary.Uvarint(sendBuff)
-	if (uid != id) {
-		check(fmt.Errorf("Error, did not receive the correct id back.\nSent: %d\nReceived: %d\n", uid, id))
-	}
 
-	recvd_int, _ := binary.Varint(sendBuff[n:])
-
-	/* Calculate send and received bw */
-	var sum int64 = 0
-	for i := 1; i < PACKET_NUM; i+=1 {
-		sum += (times[i] - times[i-1])
-	}
-	sent_int := sum / int64(PACKET_NUM - 1)
-
-	/* Calculate BW (Mbps) = (#Bytes*8 / #nanoseconds) / 1e6 */
-	bw_sent := float64(PACKET_SIZE*8*1e3) / float64(sent_int)
-	var bw_recvd float64
-	if recvd_int != 0 {
-		bw_recvd = float64(PACKET_SIZE*8*1e3) / float64(recvd_int)
-	} else {
+	/* Calculate BW (Mbps) = (#Bytes*8 / #nanoseconds) / 1e6. The link
+	 * carries the SCION, underlay and Ethernet headers of the path as well. */
+	res.wireSize = WireSize(local, remote, pathEntry, PACKET_SIZE)
+	bw_recvd := res.PairBW()
+	bw_link := res.PairCapacity()
+	if res.recvd_int == 0 {
 		fmt.Println("\nNot enough packets successfully received.")
-		bw_recvd = 0
 	}
 
 	/* Display Results */
 	fmt.Printf("\nSource: %s\nDestination: %s\n", sourceAddress, destinationAddress);
 	fmt.Println("Rate sent:")
-	fmt.Printf("\tBW - %.3fMbps\n", bw_sent)
+	fmt.Printf("\tBW - %.3fMbps\n", res.SentBW())
+	if PACKET_GAP > 0 {
+		fmt.Printf("\tRequested BW - %.3fMbps\n", float64(PACKET_SIZE*8*1e3) / float64(PACKET_GAP))
+	}
+	fmt.Printf("\tTiming - %s\n", res.timing)
+	if res.pair_sent_int != 0 {
+		/* Same pairs the estimate below is computed from */
+		fmt.Printf("\tBW over received pairs - %.3fMbps\n", float64(PACKET_SIZE*8*1e3) / float64(res.pair_sent_int))
+	}
 	fmt.Println("Bottleneck Bandwidth estimate:")
-	fmt.Printf("\tBW - %.3fMbps\n", bw_recvd)
+	fmt.Printf("\tBW - %.3fMbps payload goodput (from %d packet pairs)\n", bw_recvd, res.pairs)
+	if res.filter != nil {
+		for _, line := range DescribePairStats(res.filter) {
+			fmt.Println("\t\t" + line)
+		}
+	} else {
+		fmt.Println("\t\tThe server did not tell which pairs it left out")
+	}
+	fmt.Printf("\tLink capacity - %.3fMbps (%d of %d bytes on the wire are headers)\n",
+		bw_link, res.wireSize - PACKET_SIZE, res.wireSize)
+	lost := res.Lost()
+	fmt.Println("Loss:")
+	fmt.Printf("\t%d of %d packets (%.1f%%)\n", lost, PACKET_NUM, float64(lost*100)/float64(PACKET_NUM))
+
+	values := map[string]float64{history.MetricLoss: float64(lost*100)/float64(PACKET_NUM)}
+	if res.recvd_int != 0 {
+		values[history.MetricBandwidth] = bw_recvd
+		values[history.MetricLink] = bw_link
+	}
+	KeepResult(*dbFile, "v2_bw_est_client", local, remote, pathEntry, values)
 }
@@ -0,0 +1,204 @@
+// Shows how the measured latency and bandwidth of paths developed over time
+// Reads the history written by the latency and bandwidth clients.
+// Run with: go run history.go
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/netsec-ethz/scion-homeworks/lib/history"
+)
+
+const (
+	DEFAULT_DAYS int = 30
+	DEFAULT_WINDOW int = 7
+	DEFAULT_THRESHOLD float64 = 20
+)
+
+var (
+	DB_FILE string
+	METRIC string
+	DAYS int
+	WINDOW int
+	THRESHOLD float64
+	LIST bool
+)
+
+/* All records of one source, destination and path */
+type PathSeries struct {
+	key string
+	recs []*history.Record
+}
+
+func check(e error) {
+	if e != nil {
+		log.Fatal(e)
+	}
+}
+
+func printUsage() {
+	fmt.Println("\nhistory [-s SourceSCIONAddress] [-d DestinationSCIONAddress] [-p PathFingerprint] [-k Kind] [-m Metric] [-days Days]")
+	fmt.Println("\tShows the daily percentiles, the trend and the regressions of every measured path")
+	fmt.Println("\tThe addresses are given without port, e.g. 1-1,[127.0.0.1]")
+	fmt.Println("\tPath fingerprints are printed by -list, a prefix is enough")
+	fmt.Println("\tA day is a regression if its median is -threshold percent worse than the median")
+	fmt.Println("\tof the -window days before it")
+	fmt.Println("\nhistory -list")
+	fmt.Println("\tLists the measured paths")
+	fmt.Println()
+}
+
+/* Groups records by source, destination and path, most recently measured first */
+func groupSeries(recs []*history.Record) []*PathSeries {
+	byKey := make(map[string]*PathSeries)
+	var series []*PathSeries
+	for _, rec := range recs {
+		s, ok := byKey[rec.Key()]
+		if !ok {
+			s = &PathSeries{key: rec.Key()}
+			byKey[rec.Key()] = s
+			series = append(series, s)
+		}
+		s.recs = append(s.recs, rec)
+	}
+	sort.SliceStable(series, func(i, j int) bool {
+		return series[i].last().Time.After(series[j].last().Time)
+	})
+	return series
+}
+
+func (s *PathSeries) last() *history.Record {
+	return s.recs[len(s.recs)-1]
+}
+
+/* Metrics recorded for the series, sorted by name */
+func (s *PathSeries) metrics() []string {
+	seen := make(map[string]bool)
+	var metrics []string
+	for _, rec := range s.recs {
+		for metric := range rec.Values {
+			if !seen[metric] {
+				seen[metric] = true
+				metrics = append(metrics, metric)
+			}
+		}
+	}
+	sort.Strings(metrics)
+	return metrics
+}
+
+func listSeries(series []*PathSeries) {
+	fmt.Printf("%-14s %-24s %-24s %6s  %-16s %s\n", "Path", "Source", "Destination", "Runs", "Last", "Hops")
+	for _, s := range series {
+		rec := s.last()
+		hops := strings.Join(rec.Hops, " ")
+		if hops == "" {
+			hops = "(chosen by sciond)"
+		}
+		fmt.Printf("%-14s %-24s %-24s %6d  %-16s %s\n", rec.Path, rec.Src, rec.Dst, len(s.recs),
+			rec.Time.Local().Format("2006-01-02 15:04"), hops)
+	}
+}
+
+func showMetric(s *PathSeries, metric string) {
+	points := history.Series(s.recs, metric)
+	if len(points) == 0 {
+		return
+	}
+	higher := history.HigherIsBetter(metric)
+	fmt.Printf("\n  %s (%d values)\n", metric, len(points))
+
+	if trend, ok := history.FitTrend(points); ok {
+		direction := "stable"
+		/* Less than 0.5% a day is noise */
+		if trend.Relative > 0.005 || trend.Relative < -0.005 {
+			if (trend.PerDay > 0) == higher {
+				direction = "improving"
+			} else {
+				direction = "degrading"
+			}
+		}
+		fmt.Printf("\tTrend - %+.3f per day (%+.2f%% of the mean %.3f), %s\n",
+			trend.PerDay, trend.Relative*100, trend.Mean, direction)
+	}
+
+	days := history.Daily(points)
+	fmt.Printf("\t%-10s %5s %10s %10s %10s %10s %10s\n", "Day", "N", "Min", "P10", "P50", "P90", "Max")
+	for _, day := range days {
+		fmt.Printf("\t%-10s %5d %10.3f %10.3f %10.3f %10.3f %10.3f\n", day.Date.Format("2006-01-02"),
+			day.N, day.Min, day.P10, day.P50, day.P90, day.Max)
+	}
+
+	regs := history.FindRegressions(days, WINDOW, THRESHOLD/100, higher)
+	for _, reg := range regs {
+		fmt.Printf("\tRegression on %s - median %.3f vs %.3f before (%+.1f%%)\n",
+			reg.Day.Date.Format("2006-01-02"), reg.Day.P50, reg.Baseline, reg.Change*100)
+	}
+}
+
+func main() {
+	var query history.Query
+
+	flag.StringVar(&DB_FILE, "db", history.DefaultFile(), "History File")
+	flag.StringVar(&query.Src, "s", "", "Source SCION Address Without Port")
+	flag.StringVar(&query.Dst, "d", "", "Destination SCION Address Without Port")
+	flag.StringVar(&query.Path, "p", "", "Path Fingerprint Or Prefix")
+	flag.StringVar(&query.Kind, "k", "", "Kind Of Measurement (latency or bandwidth)")
+	flag.StringVar(&METRIC, "m", "", "Only Show This Metric, e.g. rtt_ms or bw_mbps")
+	flag.IntVar(&DAYS, "days", DEFAULT_DAYS, "Days Of History To Show, 0 For All")
+	flag.IntVar(&WINDOW, "window", DEFAULT_WINDOW, "Days A Day Is Compared To")
+	flag.Float64Var(&THRESHOLD, "threshold", DEFAULT_THRESHOLD, "Percent Worse Than Before That Is A Regression")
+	flag.BoolVar(&LIST, "list", false, "List The Measured Paths")
+	flag.Usage = printUsage
+	flag.Parse()
+
+	if WINDOW < 1 || THRESHOLD <= 0 || DAYS < 0 {
+		printUsage()
+		check(fmt.Errorf("Error, -window and -threshold need to be above 0 and -days at least 0"))
+	}
+	if DAYS > 0 {
+		query.Since = time.Now().AddDate(0, 0, -DAYS)
+	}
+
+	recs, skipped, err := history.Load(DB_FILE, &query)
+	check(err)
+	if skipped > 0 {
+		fmt.Printf("Skipped %d unreadable records in %s\n", skipped, DB_FILE)
+	}
+	if len(recs) == 0 {
+		fmt.Println("No measurements in", DB_FILE)
+		return
+	}
+
+	series := groupSeries(recs)
+	if LIST {
+		listSeries(series)
+		return
+	}
+
+	for _, s := range series {
+		var metrics []string
+		for _, metric := range s.metrics() {
+			if METRIC == "" || METRIC == metric {
+				metrics = append(metrics, metric)
+			}
+		}
+		if len(metrics) == 0 {
+			continue
+		}
+		rec := s.last()
+		fmt.Printf("\n%s -> %s, path %s\n", rec.Src, rec.Dst, rec.Path)
+		if len(rec.Hops) > 0 {
+			fmt.Println("  Hops:", strings.Join(rec.Hops, " "))
+		}
+		for _, metric := range metrics {
+			showMetric(s, metric)
+		}
+	}
+}
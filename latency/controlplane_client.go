@@ -9,6 +9,7 @@ import (
 	"math/rand"
 	"time"
 
+	"github.com/netsec-ethz/scion-homeworks/lib/history"
 	"github.com/scionproto/scion/go/lib/addr"
 	"github.com/scionproto/scion/go/lib/common"
 	"github.com/scionproto/scion/go/lib/hpkt"
@@ -79,17 +80,101 @@ func check(e error) {
 }
 
 func printUsage() {
-	fmt.Println("\nrandom_speedclient -s SourceSCIONAddress -d DestinationSCIONAddress")
+	fmt.Println("\nrandom_speedclient -s SourceSCIONAddress -d DestinationSCIONAddress [-all] [-db File]")
 	fmt.Println("\tProvides speed estimates (RTT and latency) from source to desination")
+	fmt.Println("\tOver one path, or with -all over every path to the destination")
 	fmt.Println("\tThe SCION address is specified as ISD-AS,[IP Address]:Port")
 	fmt.Println("\tIf source port unspecified, a random available one will be used.")
+	fmt.Println("\tResults are appended to the history file given with -db, see history/history.go")
 	fmt.Println("\tExample SCION address 1-1,[127.0.0.1]:42002\n")
 }
 
+/* Averages the RTT (ns) of NUM_ITERS SCMP echos over one path */
+func measurePath(scmpConnection *reliable.Conn, local *snet.Addr, remote *snet.Addr,
+	pathEntry *sciond.PathReplyEntry) (float64, error) {
+
+	remote.Path = spath.New(pathEntry.Path.FwdPath)
+	remote.Path.InitOffsets()
+	remote.NextHopHost = pathEntry.HostInfo.Host()
+	remote.NextHopPort = pathEntry.HostInfo.Port
+	remoteAppAddr := &reliable.AppAddr{Addr: remote.NextHopHost, Port: remote.NextHopPort}
+	if remote.NextHopHost == nil {
+		remoteAppAddr = &reliable.AppAddr{Addr: remote.Host, Port: overlay.EndhostPort}
+	}
+
+	// Do 5 iterations so we can use average
+	var total int64 = 0
+	iters := 0
+	num_tries := 0
+	buff := make(common.RawBytes, pathEntry.Path.Mtu)
+	for iters < NUM_ITERS && num_tries < MAX_NUM_TRIES {
+		num_tries += 1
+
+		// Construct SCMP Packet
+		id, pkt := createScmpEchoReqPkt(local, remote)
+		pktLen, err := hpkt.WriteScnPkt(pkt, buff)
+		check(err)
+
+
+		time_sent := time.Now()
+		_, err = scmpConnection.WriteTo(buff[:pktLen], remoteAppAddr)
+		check(err)
+
+		n, err := scmpConnection.Read(buff)
+		time_received := time.Now()
+
+		recvpkt := &spkt.ScnPkt{}
+		err = hpkt.ParseScnPkt(recvpkt, buff[:n])
+		check(err)
+		_, info, err := validatePkt(recvpkt, id)
+		check(err)
+
+		if info.Id == id {
+			diff := (time_received.UnixNano() - time_sent.UnixNano())
+			total += diff
+			iters += 1
+			// fmt.Printf("%d: %.3fms %.3fms\n", iters, float64(diff)/1e6, float64(diff)/2e6)
+		}
+	}
+
+	if iters != NUM_ITERS {
+		return 0, fmt.Errorf("Error, exceeded maximum number of attempts")
+	}
+	return float64(total) / float64(iters), nil
+}
+
+/* Appends the RTT (ns) of a path to the history file, if one is given */
+func keepResult(dbFile string, local *snet.Addr, remote *snet.Addr, pathEntry *sciond.PathReplyEntry,
+	difference float64) {
+
+	if len(dbFile) == 0 {
+		return
+	}
+	/* Same path the measurement took, as ISD-AS#IfID */
+	var hops []string
+	for _, intf := range pathEntry.Path.Interfaces {
+		hops = append(hops, fmt.Sprintf("%s#%d", intf.ISD_AS(), intf.IfID))
+	}
+	rec := &history.Record{
+		Kind: history.KindLatency,
+		Program: "controlplane_client",
+		Src: history.Endpoint(local.IA.String(), local.Host.String()),
+		Dst: history.Endpoint(remote.IA.String(), remote.Host.String()),
+		Hops: hops,
+		Values: map[string]float64{
+			history.MetricRTT: difference/1e6,
+			history.MetricLatency: difference/2e6,
+		},
+	}
+	history.Keep(dbFile, rec)
+}
+
 func main() {
 	var (
 		sourceAddress string
 		destinationAddress string
+		dbFile string
+		allPaths bool
 
 		err    error
 		local  *snet.Addr
@@ -101,6 +186,8 @@ func main() {
 	// Fetch arguments from command line
 	flag.StringVar(&sourceAddress, "s", "", "Source SCION Address")
 	flag.StringVar(&destinationAddress, "d", "", "Destination SCION Address")
+	flag.BoolVar(&allPaths, "all", false, "Measure Every Path Instead Of One")
+	flag.StringVar(&dbFile, "db", history.DefaultFile(), "History File To Append Results To, Empty To Not Keep Them")
 	flag.Parse()
 
 	// Create the SCION UDP socket
@@ -127,7 +214,7 @@ func main() {
 	check(err)
 
 	// Get Path to Remote
-	var pathEntry *sciond.PathReplyEntry
+	var paths []*sciond.PathReplyEntry
 	var options spathmeta.AppPathSet
 	options = snet.DefNetwork.PathResolver().Query(local.IA, remote.IA)
 	if len(options) == 0 {
@@ -135,67 +222,36 @@ func main() {
 	}
 
 	for _, entry := range options {
-		pathEntry = entry.Entry /* Choose the first random one. */
-		break
-	}
-
-	fmt.Println("Path:", pathEntry.Path.String())
-	remote.Path = spath.New(pathEntry.Path.FwdPath)
-	remote.Path.InitOffsets()
-	remote.NextHopHost = pathEntry.HostInfo.Host()
-	remote.NextHopPort = pathEntry.HostInfo.Port
-	remoteAppAddr := &reliable.AppAddr{Addr: remote.NextHopHost, Port: remote.NextHopPort}
-	if remote.NextHopHost == nil {
-		remoteAppAddr = &reliable.AppAddr{Addr: remote.Host, Port: overlay.EndhostPort}
+		paths = append(paths, entry.Entry)
+		if !allPaths {
+			break /* Choose the first random one. */
+		}
 	}
 
 	Seed = rand.NewSource(time.Now().UnixNano())
 
-	// Do 5 iterations so we can use average
-	var total int64 = 0
-	iters := 0
-	num_tries := 0
-	buff := make(common.RawBytes, pathEntry.Path.Mtu)
-	for iters < NUM_ITERS && num_tries < MAX_NUM_TRIES {
-		num_tries += 1
-
-		// Construct SCMP Packet
-		id, pkt := createScmpEchoReqPkt(local, remote)
-		pktLen, err := hpkt.WriteScnPkt(pkt, buff)
-		check(err)
-
-
-		time_sent := time.Now()
-		_, err = scmpConnection.WriteTo(buff[:pktLen], remoteAppAddr)
-		check(err)
-
-		n, err := scmpConnection.Read(buff)
-		time_received := time.Now()
+	fmt.Printf("\nSource: %s\nDestination: %s\n", sourceAddress, destinationAddress);
+	failed := 0
+	for _, pathEntry := range paths {
+		fmt.Println("Path:", pathEntry.Path.String())
+		difference, err := measurePath(scmpConnection, local, remote.Copy(), pathEntry)
+		if err != nil && !allPaths {
+			check(err)
+		} else if err != nil {
+			/* One broken path does not end the measurement of the others */
+			fmt.Println("\tFailed -", err)
+			failed += 1
+			continue
+		}
 
-		recvpkt := &spkt.ScnPkt{}
-		err = hpkt.ParseScnPkt(recvpkt, buff[:n])
-		check(err)
-		_, info, err := validatePkt(recvpkt, id)
-		check(err)
+		fmt.Println("Time estimates:")
+		// Print in ms, so divide by 1e6 from nano
+		fmt.Printf("\tRTT - %.3fms\n", difference/1e6)
+		fmt.Printf("\tLatency - %.3fms\n", difference/2e6)
 
-		if info.Id == id {
-			diff := (time_received.UnixNano() - time_sent.UnixNano())
-			total += diff
-			iters += 1
-			// fmt.Printf("%d: %.3fms %.3fms\n", iters, float64(diff)/1e6, float64(diff)/2e6)
-		}
+		keepResult(dbFile, local, remote, pathEntry, difference)
 	}
-
-	if iters != NUM_ITERS {
-		check(fmt.Errorf("Error, exceeded maximum number of attempts"))
+	if failed == len(paths) {
+		check(fmt.Errorf("Error, no path could be measured"))
 	}
-
-	var difference float64 = float64(total) / float64(iters)
-
-	fmt.Printf("\nSource: %s\nDestination: %s\n", sourceAddress, destinationAddress);
-	fmt.Println("Time estimates:")
-	// Print in ms, so divide by 1e6 from nano
-	fmt.Printf("\tRTT - %.3fms\n", difference/1e6)
-	fmt.Printf("\tLatency - %.3fms\n", difference/2e6)
 }
-
@@ -10,6 +10,7 @@ import (
 	"math/rand"
 	"time"
 
+	"github.com/netsec-ethz/scion-homeworks/lib/history"
 	"github.com/scionproto/scion/go/lib/snet"
 	"github.com/scionproto/scion/go/lib/sciond"
 )
@@ -26,10 +27,11 @@ func check(e error) {
 }
 
 func printUsage() {
-	fmt.Println("\ndataplane_client -s SourceSCIONAddress -d DestinationSCIONAddress")
+	fmt.Println("\ndataplane_client -s SourceSCIONAddress -d DestinationSCIONAddress [-db File]")
 	fmt.Println("\tProvides speed estimates (RTT and latency) from source to dedicated response desination")
 	fmt.Println("\tThe SCION address is specified as ISD-AS,[IP Address]:Port")
 	fmt.Println("\tIf source port unspecified, a random available one will be used")
+	fmt.Println("\tResults are appended to the history file given with -db, see history/history.go")
 	fmt.Println("\tExample SCION address 1-1,[127.0.0.1]:42002\n")
 }
 
@@ -37,6 +39,7 @@ func main() {
 	var (
 		sourceAddress string
 		destinationAddress string
+		dbFile string
 
 		err    error
 		local  *snet.Addr
@@ -48,6 +51,7 @@ func main() {
 	// Fetch arguments from command line
 	flag.StringVar(&sourceAddress, "s", "", "Source SCION Address")
 	flag.StringVar(&destinationAddress, "d", "", "Destination SCION Address")
+	flag.StringVar(&dbFile, "db", history.DefaultFile(), "History File To Append Results To, Empty To Not Keep Them")
 	flag.Parse()
 
 	// Create the SCION UDP socket
@@ -115,4 +119,16 @@ func main() {
 	// Print in ms, so divide by 1e6 from nano
 	fmt.Printf("\tRTT - %.3fms\n", difference/1e6)
 	fmt.Printf("\tLatency - %.3fms\n", difference/2e6)
+
+	/* The path is whichever one DialSCION got from sciond */
+	history.Keep(dbFile, &history.Record{
+		Kind: history.KindLatency,
+		Program: "dataplane_client",
+		Src: history.Endpoint(local.IA.String(), local.Host.String()),
+		Dst: history.Endpoint(remote.IA.String(), remote.Host.String()),
+		Values: map[string]float64{
+			history.MetricRTT: difference/1e6,
+			history.MetricLatency: difference/2e6,
+		},
+	})
 }
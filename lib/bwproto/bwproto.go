@@ -0,0 +1,573 @@
+// Package bwproto is the wire format spoken between the bandwidth
+// estimation clients and server.
+//
+// Every message starts with a fixed header
+//
+//	 0      2         3      4       5          6             8            16
+//	| "BW" | version | type | flags | reserved | payload len | session id |
+//
+// followed by the payload of its type, all integers big endian. Anything
+// after the payload is padding, which probes use to reach their packet size.
+//
+// A client opens a session with a Hello carrying the range of versions it
+// speaks, sent with the lowest of them. The server answers with a HelloAck
+// in the highest version both speak, or rejects the session with its own
+// range. All later messages of the session use the agreed version.
+package bwproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// HeaderLen is the length of the header in front of every payload.
+	HeaderLen = 16
+
+	// MinVersion and MaxVersion are the versions this package speaks.
+	MinVersion uint8 = 1
+	MaxVersion uint8 = 1
+
+	// MaxCookieLen is the longest cookie a Hello or Cookie can carry.
+	MaxCookieLen = 255
+)
+
+var magic = [2]byte{'B', 'W'}
+
+var (
+	// ErrNotProto is returned for packets that are not in this format.
+	ErrNotProto = errors.New("bwproto: not a bandwidth protocol message")
+	// ErrVersion is returned for messages in a version not spoken here.
+	ErrVersion = errors.New("bwproto: unsupported version")
+	// ErrType is returned for unknown message types.
+	ErrType = errors.New("bwproto: unknown message type")
+	// ErrShort is returned when a message does not fit its buffer.
+	ErrShort = errors.New("bwproto: message truncated")
+	// ErrCookieLen is returned by Encode for cookies above MaxCookieLen.
+	ErrCookieLen = errors.New("bwproto: cookie too long")
+)
+
+// MsgType tells which payload follows the header.
+type MsgType uint8
+
+const (
+	TypeHello MsgType = iota + 1
+	TypeHelloAck
+	TypeCookie
+	TypeReject
+	TypeProbe
+	TypeEcho
+	TypeResult
+	TypePMTUProbe
+	TypePMTUAck
+	TypeTimestamp
+	TypeTimestampReply
+	TypeCCData
+	TypeCCAck
+)
+
+// Header flags.
+const (
+	// FlagLast marks the last probe of a session, so the server does not
+	// have to wait for packets that were lost.
+	FlagLast uint8 = 1 << iota
+)
+
+// Modes of a measurement session.
+const (
+	// ModeEcho echoes every probe with its arrival time (the v1 behaviour).
+	ModeEcho uint8 = iota + 1
+	// ModeTrain sums up all arrivals in one Result (the v2 behaviour).
+	ModeTrain
+	// ModeTimestamp answers every Timestamp with its arrival time.
+	ModeTimestamp
+	// ModeCC acks every CCData of a congestion controlled transfer.
+	ModeCC
+)
+
+// Reasons of a Reject.
+const (
+	RejectVersion uint8 = iota + 1
+	RejectTooLarge
+	RejectBusy
+	RejectRate
+	RejectMode
+)
+
+// Header is the common part of all messages.
+type Header struct {
+	Version uint8
+	Flags   uint8
+	Session uint64
+}
+
+// Message is the payload of one message type.
+type Message interface {
+	Type() MsgType
+	// Len is the length of the encoded payload.
+	Len() int
+	put(b []byte)
+	parse(b []byte) error
+}
+
+// Encode writes h and m to b and returns the length of the message, which
+// is at least size. Bytes between the payload and size are left as they
+// are, so padding is written only once per buffer.
+func Encode(b []byte, h Header, m Message, size int) (int, error) {
+	if len(cookieOf(m)) > MaxCookieLen {
+		return 0, ErrCookieLen
+	}
+	n := HeaderLen + m.Len()
+	if size < n {
+		size = n
+	}
+	if len(b) < size {
+		return 0, ErrShort
+	}
+	b[0], b[1] = magic[0], magic[1]
+	b[2] = h.Version
+	b[3] = byte(m.Type())
+	b[4] = h.Flags
+	b[5] = 0
+	binary.BigEndian.PutUint16(b[6:], uint16(m.Len()))
+	binary.BigEndian.PutUint64(b[8:], h.Session)
+	m.put(b[HeaderLen:n])
+	return size, nil
+}
+
+// Decode parses the message at the start of b. For versions outside
+// [MinVersion, MaxVersion] the header is returned with ErrVersion, so the
+// sender can be told which versions are spoken.
+func Decode(b []byte) (Header, Message, error) {
+	var h Header
+	if len(b) < HeaderLen || b[0] != magic[0] || b[1] != magic[1] {
+		return h, nil, ErrNotProto
+	}
+	h.Version = b[2]
+	h.Flags = b[4]
+	h.Session = binary.BigEndian.Uint64(b[8:])
+	if h.Version < MinVersion || h.Version > MaxVersion {
+		return h, nil, ErrVersion
+	}
+	m := newMessage(MsgType(b[3]))
+	if m == nil {
+		return h, nil, ErrType
+	}
+	n := HeaderLen + int(binary.BigEndian.Uint16(b[6:]))
+	if n > len(b) {
+		return h, nil, ErrShort
+	}
+	if err := m.parse(b[HeaderLen:n]); err != nil {
+		return h, nil, err
+	}
+	return h, m, nil
+}
+
+// cookieOf returns the cookie of the messages that carry one, the length
+// byte in front of it cannot count past MaxCookieLen.
+func cookieOf(m Message) []byte {
+	switch m := m.(type) {
+	case *Hello:
+		return m.Cookie
+	case *Cookie:
+		return m.Cookie
+	}
+	return nil
+}
+
+func newMessage(t MsgType) Message {
+	switch t {
+	case TypeHello:
+		return &Hello{}
+	case TypeHelloAck:
+		return &HelloAck{}
+	case TypeCookie:
+		return &Cookie{}
+	case TypeReject:
+		return &Reject{}
+	case TypeProbe:
+		return &Probe{}
+	case TypeEcho:
+		return &Echo{}
+	case TypeResult:
+		return &Result{}
+	case TypePMTUProbe:
+		return &PMTUProbe{}
+	case TypePMTUAck:
+		return &PMTUAck{}
+	case TypeTimestamp:
+		return &Timestamp{}
+	case TypeTimestampReply:
+		return &TimestampReply{}
+	case TypeCCData:
+		return &CCData{}
+	case TypeCCAck:
+		return &CCAck{}
+	}
+	return nil
+}
+
+// Negotiate returns the highest version in both [min, max] and the range
+// spoken here, false if there is none.
+func Negotiate(min, max uint8) (uint8, bool) {
+	if max > MaxVersion {
+		max = MaxVersion
+	}
+	if min < MinVersion {
+		min = MinVersion
+	}
+	return max, min <= max
+}
+
+// RejectReason describes why a session was rejected.
+func RejectReason(reason uint8) string {
+	switch reason {
+	case RejectVersion:
+		return "no protocol version in common"
+	case RejectTooLarge:
+		return "test exceeds the server's packet or duration limit"
+	case RejectBusy:
+		return "server runs too many tests"
+	case RejectRate:
+		return "too many tests started from this host or AS"
+	case RejectMode:
+		return "mode not supported"
+	}
+	return fmt.Sprintf("unknown reason %d", reason)
+}
+
+// Hello asks for a session of NumPackets probes sent over Duration
+// nanoseconds (0 for short tests). Cookie is empty until the server asked
+// for one.
+type Hello struct {
+	MinVersion, MaxVersion uint8
+	Mode                   uint8
+	NumPackets             uint32
+	Duration               int64
+	Cookie                 []byte
+}
+
+func (m *Hello) Type() MsgType { return TypeHello }
+func (m *Hello) Len() int      { return 16 + len(m.Cookie) }
+
+func (m *Hello) put(b []byte) {
+	b[0], b[1], b[2] = m.MinVersion, m.MaxVersion, m.Mode
+	binary.BigEndian.PutUint32(b[3:], m.NumPackets)
+	binary.BigEndian.PutUint64(b[7:], uint64(m.Duration))
+	b[15] = byte(len(m.Cookie))
+	copy(b[16:], m.Cookie)
+}
+
+func (m *Hello) parse(b []byte) error {
+	if len(b) < 16 || len(b) < 16+int(b[15]) {
+		return ErrShort
+	}
+	m.MinVersion, m.MaxVersion, m.Mode = b[0], b[1], b[2]
+	m.NumPackets = binary.BigEndian.Uint32(b[3:])
+	m.Duration = int64(binary.BigEndian.Uint64(b[7:]))
+	m.Cookie = append([]byte(nil), b[16:16+int(b[15])]...)
+	return nil
+}
+
+// HelloAck accepts a session. The header carries the agreed version.
+type HelloAck struct {
+	Mode uint8
+}
+
+func (m *HelloAck) Type() MsgType { return TypeHelloAck }
+func (m *HelloAck) Len() int      { return 1 }
+func (m *HelloAck) put(b []byte)  { b[0] = m.Mode }
+
+func (m *HelloAck) parse(b []byte) error {
+	if len(b) < 1 {
+		return ErrShort
+	}
+	m.Mode = b[0]
+	return nil
+}
+
+// Cookie is sent instead of a HelloAck to clients that have yet to prove
+// they receive packets at their address. The Hello is repeated with it.
+type Cookie struct {
+	Cookie []byte
+}
+
+func (m *Cookie) Type() MsgType { return TypeCookie }
+func (m *Cookie) Len() int      { return 1 + len(m.Cookie) }
+
+func (m *Cookie) put(b []byte) {
+	b[0] = byte(len(m.Cookie))
+	copy(b[1:], m.Cookie)
+}
+
+func (m *Cookie) parse(b []byte) error {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return ErrShort
+	}
+	m.Cookie = append([]byte(nil), b[1:1+int(b[0])]...)
+	return nil
+}
+
+// Reject refuses a session, with the versions the server speaks.
+type Reject struct {
+	Reason                 uint8
+	MinVersion, MaxVersion uint8
+}
+
+func (m *Reject) Type() MsgType { return TypeReject }
+func (m *Reject) Len() int      { return 3 }
+func (m *Reject) put(b []byte)  { b[0], b[1], b[2] = m.Reason, m.MinVersion, m.MaxVersion }
+
+func (m *Reject) parse(b []byte) error {
+	if len(b) < 3 {
+		return ErrShort
+	}
+	m.Reason, m.MinVersion, m.MaxVersion = b[0], b[1], b[2]
+	return nil
+}
+
+// Probe is a measurement packet, Sent is its send time in ns.
+type Probe struct {
+	Seq  uint32
+	Sent int64
+}
+
+func (m *Probe) Type() MsgType { return TypeProbe }
+func (m *Probe) Len() int      { return 12 }
+
+func (m *Probe) put(b []byte) {
+	binary.BigEndian.PutUint32(b, m.Seq)
+	binary.BigEndian.PutUint64(b[4:], uint64(m.Sent))
+}
+
+func (m *Probe) parse(b []byte) error {
+	if len(b) < 12 {
+		return ErrShort
+	}
+	m.Seq = binary.BigEndian.Uint32(b)
+	m.Sent = int64(binary.BigEndian.Uint64(b[4:]))
+	return nil
+}
+
+// Echo answers a Probe of an echo session with its arrival time in ns.
+type Echo struct {
+	Seq   uint32
+	Sent  int64
+	Recvd int64
+}
+
+func (m *Echo) Type() MsgType { return TypeEcho }
+func (m *Echo) Len() int      { return 20 }
+
+func (m *Echo) put(b []byte) {
+	binary.BigEndian.PutUint32(b, m.Seq)
+	binary.BigEndian.PutUint64(b[4:], uint64(m.Sent))
+	binary.BigEndian.PutUint64(b[12:], uint64(m.Recvd))
+}
+
+func (m *Echo) parse(b []byte) error {
+	if len(b) < 20 {
+		return ErrShort
+	}
+	m.Seq = binary.BigEndian.Uint32(b)
+	m.Sent = int64(binary.BigEndian.Uint64(b[4:]))
+	m.Recvd = int64(binary.BigEndian.Uint64(b[12:]))
+	return nil
+}
+
+// Result sums up the arrivals of a train session. Intervals and durations
+// are in ns. Stats follow the fixed fields if the server sends them,
+// clients that do not know them read past.
+type Result struct {
+	RecvdInt     int64 // Average dispersion of received pairs
+	PairSentInt  int64 // Average send gap of the same pairs
+	Received     int64
+	Pairs        int64
+	Bytes        int64
+	RecvDuration int64 // First to last arrival
+	Stats        *PairStats
+}
+
+func (m *Result) Type() MsgType { return TypeResult }
+
+func (m *Result) Len() int {
+	if m.Stats == nil {
+		return 48
+	}
+	return 48 + pairStatsLen
+}
+
+func (m *Result) fields() []*int64 {
+	return []*int64{&m.RecvdInt, &m.PairSentInt, &m.Received, &m.Pairs, &m.Bytes, &m.RecvDuration}
+}
+
+func (m *Result) put(b []byte) {
+	for i, f := range m.fields() {
+		binary.BigEndian.PutUint64(b[8*i:], uint64(*f))
+	}
+	if m.Stats != nil {
+		m.Stats.put(b[48:])
+	}
+}
+
+func (m *Result) parse(b []byte) error {
+	if len(b) < 48 || len(b) > 48 && len(b) < 48+pairStatsLen {
+		return ErrShort
+	}
+	for i, f := range m.fields() {
+		*f = int64(binary.BigEndian.Uint64(b[8*i:]))
+	}
+	m.Stats = nil
+	if len(b) >= 48+pairStatsLen {
+		m.Stats = &PairStats{}
+		m.Stats.parse(b[48:])
+	}
+	return nil
+}
+
+// PairStats explains which packet pairs a Result is computed from and which
+// were left out. Counts are of pairs of consecutive sequence numbers.
+type PairStats struct {
+	Used       int64 // Samples the Result averages
+	Lost       int64 // One of the two packets did not arrive
+	Reordered  int64 // The second packet arrived first
+	Compressed int64 // Arrived closer together than MinGap
+	Clustered  int64 // Single pairs replaced by samples between clusters
+	Clusters   int64 // Runs of compressed arrivals
+	MaxCluster int64 // Packets in the longest run
+	MinGap     int64 // Smallest dispersion the fastest link allows (ns)
+	Coalesced  bool  // Arrivals were batched by the receiver
+}
+
+const pairStatsLen = 65
+
+func (m *PairStats) fields() []*int64 {
+	return []*int64{&m.Used, &m.Lost, &m.Reordered, &m.Compressed, &m.Clustered,
+		&m.Clusters, &m.MaxCluster, &m.MinGap}
+}
+
+func (m *PairStats) put(b []byte) {
+	for i, f := range m.fields() {
+		binary.BigEndian.PutUint64(b[8*i:], uint64(*f))
+	}
+	b[64] = 0
+	if m.Coalesced {
+		b[64] = 1
+	}
+}
+
+func (m *PairStats) parse(b []byte) {
+	for i, f := range m.fields() {
+		*f = int64(binary.BigEndian.Uint64(b[8*i:]))
+	}
+	m.Coalesced = b[64] != 0
+}
+
+// PMTUProbe is padded to Size bytes, the server acks the size it received.
+type PMTUProbe struct {
+	Size uint32
+}
+
+func (m *PMTUProbe) Type() MsgType { return TypePMTUProbe }
+func (m *PMTUProbe) Len() int      { return 4 }
+func (m *PMTUProbe) put(b []byte)  { binary.BigEndian.PutUint32(b, m.Size) }
+
+func (m *PMTUProbe) parse(b []byte) error {
+	if len(b) < 4 {
+		return ErrShort
+	}
+	m.Size = binary.BigEndian.Uint32(b)
+	return nil
+}
+
+// PMTUAck tells how many bytes of a PMTUProbe arrived.
+type PMTUAck struct {
+	Recvd uint32
+}
+
+func (m *PMTUAck) Type() MsgType { return TypePMTUAck }
+func (m *PMTUAck) Len() int      { return 4 }
+func (m *PMTUAck) put(b []byte)  { binary.BigEndian.PutUint32(b, m.Recvd) }
+
+func (m *PMTUAck) parse(b []byte) error {
+	if len(b) < 4 {
+		return ErrShort
+	}
+	m.Recvd = binary.BigEndian.Uint32(b)
+	return nil
+}
+
+// Timestamp asks for the arrival time of the packet, within a ModeTimestamp session.
+type Timestamp struct {
+	Seq uint32
+}
+
+func (m *Timestamp) Type() MsgType { return TypeTimestamp }
+func (m *Timestamp) Len() int      { return 4 }
+func (m *Timestamp) put(b []byte)  { binary.BigEndian.PutUint32(b, m.Seq) }
+
+func (m *Timestamp) parse(b []byte) error {
+	if len(b) < 4 {
+		return ErrShort
+	}
+	m.Seq = binary.BigEndian.Uint32(b)
+	return nil
+}
+
+// TimestampReply answers a Timestamp with its arrival time in ns.
+type TimestampReply struct {
+	Seq   uint32
+	Recvd int64
+}
+
+func (m *TimestampReply) Type() MsgType { return TypeTimestampReply }
+func (m *TimestampReply) Len() int      { return 12 }
+
+func (m *TimestampReply) put(b []byte) {
+	binary.BigEndian.PutUint32(b, m.Seq)
+	binary.BigEndian.PutUint64(b[4:], uint64(m.Recvd))
+}
+
+func (m *TimestampReply) parse(b []byte) error {
+	if len(b) < 12 {
+		return ErrShort
+	}
+	m.Seq = binary.BigEndian.Uint32(b)
+	m.Recvd = int64(binary.BigEndian.Uint64(b[4:]))
+	return nil
+}
+
+// CCData is a packet of a congestion controlled transfer (ModeCC), each is acked.
+type CCData struct {
+	Seq uint32
+}
+
+func (m *CCData) Type() MsgType { return TypeCCData }
+func (m *CCData) Len() int      { return 4 }
+func (m *CCData) put(b []byte)  { binary.BigEndian.PutUint32(b, m.Seq) }
+
+func (m *CCData) parse(b []byte) error {
+	if len(b) < 4 {
+		return ErrShort
+	}
+	m.Seq = binary.BigEndian.Uint32(b)
+	return nil
+}
+
+// CCAck acknowledges one CCData.
+type CCAck struct {
+	Seq uint32
+}
+
+func (m *CCAck) Type() MsgType { return TypeCCAck }
+func (m *CCAck) Len() int      { return 4 }
+func (m *CCAck) put(b []byte)  { binary.BigEndian.PutUint32(b, m.Seq) }
+
+func (m *CCAck) parse(b []byte) error {
+	if len(b) < 4 {
+		return ErrShort
+	}
+	m.Seq = binary.BigEndian.Uint32(b)
+	return nil
+}
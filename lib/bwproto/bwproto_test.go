@@ -0,0 +1,131 @@
+package bwproto
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+var messages = []Message{
+	&Hello{MinVersion: 1, MaxVersion: 1, Mode: ModeTrain, NumPackets: 1000, Duration: 3e9,
+		Cookie: []byte("cookie")},
+	&Hello{MinVersion: 1, MaxVersion: 1, Mode: ModeEcho, NumPackets: 10},
+	&HelloAck{Mode: ModeEcho},
+	&Cookie{Cookie: bytes.Repeat([]byte{7}, MaxCookieLen)},
+	&Reject{Reason: RejectBusy, MinVersion: 1, MaxVersion: 1},
+	&Probe{Seq: 42, Sent: -1},
+	&Echo{Seq: 1 << 31, Sent: 1234567890, Recvd: 1234567999},
+	&Result{RecvdInt: 1, PairSentInt: 2, Received: 3, Pairs: 4, Bytes: 5, RecvDuration: 6},
+	&Result{RecvdInt: 1, PairSentInt: 2, Received: 3, Pairs: 4, Bytes: 5, RecvDuration: 6,
+		Stats: &PairStats{Used: 1, Lost: 2, Reordered: 3, Compressed: 4, Clustered: 5, Clusters: 6,
+			MaxCluster: 7, MinGap: 8, Coalesced: true}},
+	&PMTUProbe{Size: 1472},
+	&PMTUAck{Recvd: 1400},
+	&Timestamp{Seq: 9},
+	&TimestampReply{Seq: 9, Recvd: 1 << 62},
+	&CCData{Seq: 3},
+	&CCAck{Seq: 3},
+}
+
+func TestRoundTrip(t *testing.T) {
+	h := Header{Version: MaxVersion, Flags: FlagLast, Session: 0x0102030405060708}
+	for _, m := range messages {
+		for _, size := range []int{0, 1500} {
+			b := make([]byte, 1500)
+			n, err := Encode(b, h, m, size)
+			if err != nil {
+				t.Fatalf("%T: Encode: %v", m, err)
+			}
+			if want := HeaderLen + m.Len(); n != want && n != size {
+				t.Errorf("%T: Encode returned %d, want %d or %d", m, n, want, size)
+			}
+			gotH, got, err := Decode(b[:n])
+			if err != nil {
+				t.Fatalf("%T: Decode: %v", m, err)
+			}
+			if gotH != h {
+				t.Errorf("%T: header %+v, want %+v", m, gotH, h)
+			}
+			if !reflect.DeepEqual(got, m) {
+				t.Errorf("%T: decoded %+v, want %+v", m, got, m)
+			}
+		}
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	h := Header{Version: MaxVersion}
+	for _, m := range messages {
+		b := make([]byte, HeaderLen+m.Len())
+		n, err := Encode(b, h, m, 0)
+		if err != nil {
+			t.Fatalf("%T: Encode: %v", m, err)
+		}
+		for i := 0; i < n; i++ {
+			if _, _, err := Decode(b[:i]); err == nil {
+				t.Errorf("%T: Decode of %d of %d bytes succeeded", m, i, n)
+			}
+		}
+		// A payload length that undercounts the payload must not be read past
+		if m.Len() > 0 {
+			b[7]--
+			if _, _, err := Decode(b[:n]); err != ErrShort {
+				t.Errorf("%T: Decode with short payload length: %v, want %v", m, err, ErrShort)
+			}
+		}
+	}
+}
+
+func TestEncodeShortBuffer(t *testing.T) {
+	m := &Probe{Seq: 1}
+	if _, err := Encode(make([]byte, HeaderLen+m.Len()-1), Header{Version: 1}, m, 0); err != ErrShort {
+		t.Errorf("Encode into short buffer: %v, want %v", err, ErrShort)
+	}
+	if _, err := Encode(make([]byte, 100), Header{Version: 1}, m, 101); err != ErrShort {
+		t.Errorf("Encode padded past the buffer: %v, want %v", err, ErrShort)
+	}
+}
+
+func TestCookieLen(t *testing.T) {
+	long := make([]byte, MaxCookieLen+1)
+	b := make([]byte, 1500)
+	for _, m := range []Message{&Hello{Cookie: long}, &Cookie{Cookie: long}} {
+		if _, err := Encode(b, Header{Version: 1}, m, 0); err != ErrCookieLen {
+			t.Errorf("%T with %d byte cookie: %v, want %v", m, len(long), err, ErrCookieLen)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	b := make([]byte, 64)
+	if _, err := Encode(b, Header{Version: 1}, &Probe{}, 0); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		edit func(b []byte)
+		want error
+	}{
+		{"magic", func(b []byte) { b[0] = 'X' }, ErrNotProto},
+		{"old version", func(b []byte) { b[2] = MinVersion - 1 }, ErrVersion},
+		{"new version", func(b []byte) { b[2] = MaxVersion + 1 }, ErrVersion},
+		{"type", func(b []byte) { b[3] = 0 }, ErrType},
+		{"payload length", func(b []byte) { b[6] = 0xff }, ErrShort},
+	}
+	for _, test := range tests {
+		c := append([]byte(nil), b...)
+		test.edit(c)
+		if _, _, err := Decode(c); err != test.want {
+			t.Errorf("%s: %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	if v, ok := Negotiate(1, 5); !ok || v != MaxVersion {
+		t.Errorf("Negotiate(1, 5) = %d, %v", v, ok)
+	}
+	if _, ok := Negotiate(MaxVersion+1, MaxVersion+2); ok {
+		t.Errorf("Negotiate above MaxVersion succeeded")
+	}
+}
@@ -0,0 +1,183 @@
+// Package history keeps the results of latency and bandwidth measurements
+// so they can be compared over time.
+//
+// Results are appended to a single file, one JSON record per line. Appends
+// are a single write to a file opened with O_APPEND, so several clients can
+// write to the same file at once. Records are keyed by source, destination
+// and a fingerprint of the path that was measured.
+package history
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Kinds of measurements.
+const (
+	KindLatency   = "latency"
+	KindBandwidth = "bandwidth"
+)
+
+// Metric names, the unit is part of the name.
+const (
+	MetricRTT        = "rtt_ms"
+	MetricLatency    = "latency_ms"
+	MetricBandwidth  = "bw_mbps"
+	MetricLink       = "link_mbps"
+	MetricThroughput = "throughput_mbps"
+	MetricLoss       = "loss_pct"
+)
+
+// DefaultPath is the fingerprint of measurements that did not pick a path
+// themselves but used whichever one the SCION daemon handed out.
+const DefaultPath = "default"
+
+// EnvFile overrides the location of the history file.
+const EnvFile = "SCION_HISTORY"
+
+// Record is the outcome of one measurement.
+type Record struct {
+	Time    time.Time          `json:"time"`
+	Kind    string             `json:"kind"`
+	Program string             `json:"program"`
+	Src     string             `json:"src"`
+	Dst     string             `json:"dst"`
+	Path    string             `json:"path"`
+	Hops    []string           `json:"hops,omitempty"`
+	Values  map[string]float64 `json:"values"`
+}
+
+// Key identifies the series a record belongs to.
+func (r *Record) Key() string {
+	return r.Src + " " + r.Dst + " " + r.Path
+}
+
+// DefaultFile is where results are kept unless told otherwise,
+// $SCION_HISTORY or ~/.scion-homeworks/history.jsonl.
+func DefaultFile() string {
+	if file := os.Getenv(EnvFile); file != "" {
+		return file
+	}
+	home := os.Getenv("HOME")
+	if home == "" {
+		home = "."
+	}
+	return filepath.Join(home, ".scion-homeworks", "history.jsonl")
+}
+
+// Endpoint formats a SCION host without its port, which is mostly random
+// on the client side and would split a series in many.
+func Endpoint(ia, host string) string {
+	return fmt.Sprintf("%s,[%s]", ia, host)
+}
+
+// Fingerprint names a path by the interfaces it traverses (ISD-AS#IfID).
+// Paths over the same ASes but different links get different fingerprints.
+func Fingerprint(hops []string) string {
+	if len(hops) == 0 {
+		return DefaultPath
+	}
+	sum := sha256.Sum256([]byte(strings.Join(hops, " ")))
+	return hex.EncodeToString(sum[:6])
+}
+
+// Append adds a record to the history file, creating it if needed. A zero
+// Time is set to now.
+func Append(file string, rec *Record) error {
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	/* One write per record keeps concurrent appends from interleaving */
+	_, err = f.Write(append(line, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Keep appends the result of a measurement to file, unless file is empty.
+// An empty Path is set to the fingerprint of Hops. A result that cannot be
+// kept only gets a warning on stderr, it was printed already.
+func Keep(file string, rec *Record) {
+	if file == "" {
+		return
+	}
+	if rec.Path == "" {
+		rec.Path = Fingerprint(rec.Hops)
+	}
+	if err := Append(file, rec); err != nil {
+		fmt.Fprintln(os.Stderr, "Could not keep the result:", err)
+	}
+}
+
+// Query selects records. Empty fields match everything, Path matches
+// fingerprint prefixes.
+type Query struct {
+	Kind  string
+	Src   string
+	Dst   string
+	Path  string
+	Since time.Time
+	Until time.Time
+}
+
+// Match tells whether a record is selected by the query.
+func (q *Query) Match(r *Record) bool {
+	return (q.Kind == "" || r.Kind == q.Kind) &&
+		(q.Src == "" || r.Src == q.Src) &&
+		(q.Dst == "" || r.Dst == q.Dst) &&
+		(q.Path == "" || strings.HasPrefix(r.Path, q.Path)) &&
+		(q.Since.IsZero() || !r.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || r.Time.Before(q.Until))
+}
+
+// Load reads the records matching q in the order they were written. Lines
+// that do not parse, e.g. one cut short by a crash, are skipped and
+// counted. A missing file holds no records.
+func Load(file string, q *Query) ([]*Record, int, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	var recs []*Record
+	skipped := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		rec := &Record{}
+		if err := json.Unmarshal(line, rec); err != nil {
+			skipped++
+			continue
+		}
+		if q == nil || q.Match(rec) {
+			recs = append(recs, rec)
+		}
+	}
+	return recs, skipped, scanner.Err()
+}
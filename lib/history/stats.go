@@ -0,0 +1,165 @@
+package history
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Point is one value of a metric.
+type Point struct {
+	Time  time.Time
+	Value float64
+}
+
+// Series extracts one metric from records, skipping those without it.
+func Series(recs []*Record, metric string) []Point {
+	var points []Point
+	for _, rec := range recs {
+		if v, ok := rec.Values[metric]; ok && !math.IsNaN(v) && !math.IsInf(v, 0) {
+			points = append(points, Point{rec.Time, v})
+		}
+	}
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+	return points
+}
+
+// HigherIsBetter tells in which direction a metric regresses.
+func HigherIsBetter(metric string) bool {
+	switch metric {
+	case MetricBandwidth, MetricLink, MetricThroughput:
+		return true
+	}
+	return false
+}
+
+// Percentile of sorted values with linear interpolation, p in [0, 100].
+func Percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	pos := p / 100 * float64(len(sorted)-1)
+	lo := int(math.Floor(pos))
+	if lo >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	frac := pos - float64(lo)
+	return sorted[lo] + frac*(sorted[lo+1]-sorted[lo])
+}
+
+// Day summarizes the values of one calendar day.
+type Day struct {
+	Date     time.Time /* Midnight, local time */
+	N        int
+	Min, Max float64
+	P10      float64
+	P50      float64
+	P90      float64
+}
+
+// Daily groups points by local calendar day, oldest first.
+func Daily(points []Point) []*Day {
+	var days []*Day
+	var values []float64
+	flush := func() {
+		if len(values) == 0 {
+			return
+		}
+		sort.Float64s(values)
+		day := days[len(days)-1]
+		day.N = len(values)
+		day.Min = values[0]
+		day.Max = values[len(values)-1]
+		day.P10 = Percentile(values, 10)
+		day.P50 = Percentile(values, 50)
+		day.P90 = Percentile(values, 90)
+		values = nil
+	}
+
+	for _, p := range points {
+		y, m, d := p.Time.Local().Date()
+		date := time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+		if len(days) == 0 || !days[len(days)-1].Date.Equal(date) {
+			flush()
+			days = append(days, &Day{Date: date})
+		}
+		values = append(values, p.Value)
+	}
+	flush()
+	return days
+}
+
+// Trend is a least squares fit of the values over time.
+type Trend struct {
+	PerDay   float64 /* Change of the value per day */
+	Relative float64 /* PerDay relative to the mean */
+	Mean     float64
+	N        int
+}
+
+// FitTrend fits a line through the points. It needs at least two points at
+// different times, otherwise ok is false.
+func FitTrend(points []Point) (trend Trend, ok bool) {
+	n := float64(len(points))
+	if len(points) < 2 {
+		return trend, false
+	}
+	/* Days since the first point, to keep the sums small */
+	start := points[0].Time
+	var sx, sy, sxx, sxy float64
+	for _, p := range points {
+		x := p.Time.Sub(start).Hours() / 24
+		sx += x
+		sy += p.Value
+		sxx += x * x
+		sxy += x * p.Value
+	}
+	denom := n*sxx - sx*sx
+	if denom <= 0 {
+		return trend, false
+	}
+	trend.PerDay = (n*sxy - sx*sy) / denom
+	trend.Mean = sy / n
+	trend.N = len(points)
+	if trend.Mean != 0 {
+		trend.Relative = trend.PerDay / trend.Mean
+	}
+	return trend, true
+}
+
+// Regression is a day whose median is worse than the days before it.
+type Regression struct {
+	Day      *Day
+	Baseline float64 /* Median of the daily medians before */
+	Change   float64 /* Relative to the baseline, negative is a drop */
+}
+
+// FindRegressions compares the median of every day to the median of the
+// window days before it that had values. Days at least threshold (e.g.
+// 0.2 for 20%) worse than their baseline are regressions.
+func FindRegressions(days []*Day, window int, threshold float64, higherIsBetter bool) []*Regression {
+	var regs []*Regression
+	for i, day := range days {
+		if i == 0 {
+			continue
+		}
+		first := i - window
+		if first < 0 {
+			first = 0
+		}
+		var medians []float64
+		for _, prev := range days[first:i] {
+			medians = append(medians, prev.P50)
+		}
+		sort.Float64s(medians)
+		baseline := Percentile(medians, 50)
+		if baseline == 0 {
+			continue
+		}
+		change := (day.P50 - baseline) / math.Abs(baseline)
+		if (higherIsBetter && change <= -threshold) || (!higherIsBetter && change >= threshold) {
+			regs = append(regs, &Regression{day, baseline, change})
+		}
+	}
+	return regs
+}
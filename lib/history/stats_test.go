@@ -0,0 +1,167 @@
+package history
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestPercentile(t *testing.T) {
+	tests := []struct {
+		sorted []float64
+		p      float64
+		want   float64
+	}{
+		{[]float64{5}, 0, 5},
+		{[]float64{5}, 50, 5},
+		{[]float64{5}, 100, 5},
+		{[]float64{1, 2, 3, 4, 5}, 0, 1},
+		{[]float64{1, 2, 3, 4, 5}, 50, 3},
+		{[]float64{1, 2, 3, 4, 5}, 100, 5},
+		{[]float64{1, 2, 3, 4, 5}, 10, 1.4},
+		{[]float64{1, 2, 3, 4}, 50, 2.5},
+		{[]float64{10, 20}, 25, 12.5},
+		{[]float64{10, 20}, 90, 19},
+	}
+	for _, test := range tests {
+		if got := Percentile(test.sorted, test.p); !near(got, test.want) {
+			t.Errorf("Percentile(%v, %g) = %g, want %g", test.sorted, test.p, got, test.want)
+		}
+	}
+	if got := Percentile(nil, 50); !math.IsNaN(got) {
+		t.Errorf("Percentile of no values = %g, want NaN", got)
+	}
+}
+
+func at(day, hour int) time.Time {
+	return time.Date(2024, time.March, day, hour, 0, 0, 0, time.Local)
+}
+
+func TestDaily(t *testing.T) {
+	tests := []struct {
+		name   string
+		points []Point
+		want   []Day
+	}{
+		{"empty", nil, nil},
+		{"one", []Point{{at(1, 12), 7}},
+			[]Day{{Date: at(1, 0), N: 1, Min: 7, Max: 7, P10: 7, P50: 7, P90: 7}}},
+		{"unsorted within a day", []Point{{at(1, 1), 3}, {at(1, 2), 1}, {at(1, 23), 2}},
+			[]Day{{Date: at(1, 0), N: 3, Min: 1, Max: 3, P10: 1.2, P50: 2, P90: 2.8}}},
+		{"gap between days", []Point{{at(1, 10), 1}, {at(1, 11), 3}, {at(4, 0), 10}},
+			[]Day{
+				{Date: at(1, 0), N: 2, Min: 1, Max: 3, P10: 1.2, P50: 2, P90: 2.8},
+				{Date: at(4, 0), N: 1, Min: 10, Max: 10, P10: 10, P50: 10, P90: 10},
+			}},
+	}
+	for _, test := range tests {
+		days := Daily(test.points)
+		if len(days) != len(test.want) {
+			t.Errorf("%s: %d days, want %d", test.name, len(days), len(test.want))
+			continue
+		}
+		for i, got := range days {
+			want := test.want[i]
+			if !got.Date.Equal(want.Date) || got.N != want.N || !near(got.Min, want.Min) ||
+				!near(got.Max, want.Max) || !near(got.P10, want.P10) || !near(got.P50, want.P50) ||
+				!near(got.P90, want.P90) {
+				t.Errorf("%s: day %d is %+v, want %+v", test.name, i, *got, want)
+			}
+		}
+	}
+}
+
+func TestFitTrend(t *testing.T) {
+	tests := []struct {
+		name   string
+		points []Point
+		ok     bool
+		perDay float64
+		mean   float64
+	}{
+		{"none", nil, false, 0, 0},
+		{"one", []Point{{at(1, 0), 5}}, false, 0, 0},
+		{"same time", []Point{{at(1, 0), 5}, {at(1, 0), 7}}, false, 0, 0},
+		{"flat", []Point{{at(1, 0), 5}, {at(2, 0), 5}, {at(3, 0), 5}}, true, 0, 5},
+		{"rising", []Point{{at(1, 0), 10}, {at(2, 0), 12}, {at(3, 0), 14}}, true, 2, 12},
+		{"falling by half days", []Point{{at(1, 0), 10}, {at(1, 12), 9}, {at(2, 0), 8}}, true, -2, 9},
+		{"noisy", []Point{{at(1, 0), 1}, {at(2, 0), 3}, {at(3, 0), 2}, {at(4, 0), 4}}, true, 0.8, 2.5},
+	}
+	for _, test := range tests {
+		trend, ok := FitTrend(test.points)
+		if ok != test.ok {
+			t.Errorf("%s: ok is %v, want %v", test.name, ok, test.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if !near(trend.PerDay, test.perDay) || !near(trend.Mean, test.mean) || trend.N != len(test.points) {
+			t.Errorf("%s: %+v, want %g per day around %g", test.name, trend, test.perDay, test.mean)
+		}
+		if !near(trend.Relative, test.perDay/test.mean) {
+			t.Errorf("%s: relative %g, want %g", test.name, trend.Relative, test.perDay/test.mean)
+		}
+	}
+}
+
+func days(medians ...float64) []*Day {
+	var days []*Day
+	for i, m := range medians {
+		days = append(days, &Day{Date: at(i+1, 0), N: 1, P50: m})
+	}
+	return days
+}
+
+func TestFindRegressions(t *testing.T) {
+	tests := []struct {
+		name           string
+		days           []*Day
+		window         int
+		threshold      float64
+		higherIsBetter bool
+		want           []int /* Indices of the regressed days */
+	}{
+		{"none", nil, 3, 0.2, false, nil},
+		{"steady", days(10, 10, 11, 10), 3, 0.2, false, nil},
+		{"latency up", days(10, 10, 10, 13), 3, 0.2, false, []int{3}},
+		{"latency down is fine", days(10, 10, 10, 5), 3, 0.2, false, nil},
+		{"bandwidth down", days(100, 100, 70, 100), 3, 0.2, true, []int{2}},
+		{"bandwidth up is fine", days(100, 100, 150), 3, 0.2, true, nil},
+		{"at the threshold", days(10, 12), 1, 0.2, false, []int{1}},
+		{"below the threshold", days(10, 11.9), 1, 0.2, false, nil},
+		{"window forgets", days(10, 20, 20, 20), 2, 0.2, false, []int{1, 2}},
+		{"median resists outliers", days(10, 100, 10, 10, 13), 3, 0.2, false, []int{1, 4}},
+		{"zero baseline", days(0, 5), 1, 0.2, false, nil},
+	}
+	for _, test := range tests {
+		regs := FindRegressions(test.days, test.window, test.threshold, test.higherIsBetter)
+		var got []int
+		for _, reg := range regs {
+			for i, day := range test.days {
+				if reg.Day == day {
+					got = append(got, i)
+				}
+			}
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%s: regressions on days %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: regressions on days %v, want %v", test.name, got, test.want)
+				break
+			}
+		}
+	}
+
+	regs := FindRegressions(days(10, 20, 14), 2, 0.2, false)
+	if len(regs) != 1 || !near(regs[0].Baseline, 10) || !near(regs[0].Change, 1) {
+		t.Errorf("regressions of 10, 20, 14: %+v, want day 1 at +100%% over 10", regs)
+	}
+}
@@ -0,0 +1,337 @@
+// Package keys loads and generates the keys of the homework tools.
+//
+// Private keys are read from PEM (PKCS#8, PKCS#1 RSA and SEC1 EC keys) or
+// the same encodings in DER, public keys from PEM or DER in PKIX or PKCS#1,
+// or from a certificate. Ed25519 keys may also be given raw, as the 32 byte
+// seed or public key. Symmetric keys are read from hex, base64, PEM or raw
+// bytes, hex wins over base64 unless a "hex:" or "base64:" prefix tells the
+// encoding. Generated keys are written as PKCS#8 and PKIX PEM and symmetric
+// keys as hex, the formats openssl and most libraries read.
+package keys
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Types lists the key types Generate knows, "sym" is a symmetric key.
+var Types = []string{"ecdsa-p256", "ecdsa-p384", "ed25519", "rsa-2048", "rsa-3072", "rsa-4096", "sym"}
+
+// LoadPrivateKey reads the private key in the file at path.
+func LoadPrivateKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return key, nil
+}
+
+// ParsePrivateKey parses a private key in any of the supported encodings.
+func ParsePrivateKey(data []byte) (crypto.Signer, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type == "OPENSSH PRIVATE KEY" {
+			return nil, errors.New("OpenSSH keys are not supported, convert them to PKCS#8")
+		}
+		data = block.Bytes
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(data); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, fmt.Errorf("unsupported private key %T", key)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(data); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(data); err == nil {
+		return key, nil
+	}
+	if len(data) == ed25519.SeedSize || len(data) == ed25519.PrivateKeySize {
+		return ed25519.NewKeyFromSeed(data[:ed25519.SeedSize]), nil
+	}
+	return nil, errors.New("no PKCS#8, PKCS#1, SEC1 or raw Ed25519 private key")
+}
+
+// LoadPublicKey reads the public key in the file at path. A private key
+// file gives its public key.
+func LoadPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParsePublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return key, nil
+}
+
+// ParsePublicKey parses a public key in any of the supported encodings.
+func ParsePublicKey(data []byte) (crypto.PublicKey, error) {
+	raw := data
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type == "CERTIFICATE" {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			return cert.PublicKey, nil
+		}
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			key, err := ParsePrivateKey(data)
+			if err != nil {
+				return nil, err
+			}
+			return key.Public(), nil
+		}
+		raw = block.Bytes
+	}
+	if key, err := x509.ParsePKIXPublicKey(raw); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PublicKey(raw); err == nil {
+		return key, nil
+	}
+	if key, err := ParsePrivateKey(data); err == nil && len(data) != ed25519.SeedSize {
+		return key.Public(), nil
+	}
+	if len(raw) == ed25519.PublicKeySize {
+		return ed25519.PublicKey(raw), nil
+	}
+	return nil, errors.New("no PKIX, PKCS#1 or raw Ed25519 public key")
+}
+
+// LoadSymmetricKey reads a symmetric key. The file holds the key in hex or
+// base64, in a PEM block or as raw bytes. Text that is valid hex is read as
+// hex, even if it is valid base64 as well, e.g. "deadbeef". Prefix the key
+// with "hex:" or "base64:" to choose the encoding.
+func LoadSymmetricKey(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParseSymmetricKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return key, nil
+}
+
+// ParseSymmetricKey parses a symmetric key as LoadSymmetricKey reads it.
+func ParseSymmetricKey(data []byte) ([]byte, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		return block.Bytes, nil
+	}
+	text := strings.TrimSpace(string(data))
+	switch {
+	case strings.HasPrefix(text, "hex:"):
+		return decodeSymmetric(hex.DecodeString(strings.TrimPrefix(text, "hex:")))
+	case strings.HasPrefix(text, "base64:"):
+		return decodeSymmetric(base64.StdEncoding.DecodeString(strings.TrimPrefix(text, "base64:")))
+	}
+	if key, err := hex.DecodeString(text); err == nil && len(key) > 0 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) > 0 {
+		return key, nil
+	}
+	if len(data) == 0 {
+		return nil, errors.New("empty key")
+	}
+	return data, nil
+}
+
+func decodeSymmetric(key []byte, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		return nil, errors.New("empty key")
+	}
+	return key, nil
+}
+
+// Generate creates a private key of one of the Types but "sym".
+func Generate(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case "rsa-2048":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "rsa-3072":
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case "rsa-4096":
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case "ecdsa-p256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ecdsa-p384":
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("unknown key type %q, known are %s", keyType, strings.Join(Types, ", "))
+}
+
+// GenerateSymmetric creates a random symmetric key of size bytes.
+func GenerateSymmetric(size int) ([]byte, error) {
+	key := make([]byte, size)
+	_, err := rand.Read(key)
+	return key, err
+}
+
+// WritePrivateKey writes key as PKCS#8 PEM, readable by the owner only.
+func WritePrivateKey(path string, key crypto.Signer) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writePEM(path, "PRIVATE KEY", der, 0600)
+}
+
+// WritePublicKey writes key as PKIX PEM.
+func WritePublicKey(path string, key crypto.PublicKey) error {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return err
+	}
+	return writePEM(path, "PUBLIC KEY", der, 0644)
+}
+
+// WriteSymmetricKey writes key in hex, readable by the owner only.
+func WriteSymmetricKey(path string, key []byte) error {
+	return writeNew(path, []byte(hex.EncodeToString(key)+"\n"), 0600)
+}
+
+func writePEM(path string, blockType string, der []byte, perm os.FileMode) error {
+	return writeNew(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), perm)
+}
+
+/* Keys are never overwritten, a lost key cannot be recovered */
+func writeNew(path string, data []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Fingerprint is the SHA-256 of the PKIX encoding of key, as the tools
+// print it to compare keys.
+func Fingerprint(key crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return "SHA256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// TypeOf names the type of a public key as in Types, e.g. "ecdsa-p256".
+func TypeOf(key crypto.PublicKey) string {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("rsa-%d", key.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ecdsa-" + strings.ToLower(strings.Replace(key.Curve.Params().Name, "-", "", 1))
+	case ed25519.PublicKey:
+		return "ed25519"
+	}
+	return fmt.Sprintf("%T", key)
+}
+
+// PublicPath is where the public key of the private key at path goes by
+// default, key.pem becomes key.pub.pem.
+func PublicPath(path string) string {
+	return strings.TrimSuffix(path, ".pem") + ".pub.pem"
+}
+
+// Keygen is the keygen subcommand of the tools, command names it and args
+// are its arguments. It writes a private key and its public key, or a
+// symmetric key, and prints the fingerprint of the public key.
+func Keygen(command string, args []string, defaultType string, defaultKey string) error {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	keyType := flags.String("type", defaultType, "Key type, one of "+strings.Join(Types, ", "))
+	keyPath := flags.String("key", defaultKey, "File of the private or symmetric key")
+	pubPath := flags.String("pub", "", "File of the public key, the key file with .pub.pem by default")
+	size := flags.Int("size", 16, "Bytes of a symmetric key")
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %v", flags.Args())
+	}
+
+	if *keyType == "sym" {
+		if *size < 16 {
+			return fmt.Errorf("a symmetric key needs at least 16 bytes, not %d", *size)
+		}
+		key, err := GenerateSymmetric(*size)
+		if err != nil {
+			return err
+		}
+		if err = WriteSymmetricKey(*keyPath, key); err != nil {
+			return err
+		}
+		fmt.Printf("%d-byte symmetric key written to %s\n", *size, *keyPath)
+		return nil
+	}
+
+	if len(*pubPath) == 0 {
+		*pubPath = PublicPath(*keyPath)
+	}
+	// Neither file is written if either exists, a private key without its
+	// public key would only be in the way of the next run
+	for _, path := range []string{*keyPath, *pubPath} {
+		if _, err := os.Lstat(path); err == nil {
+			return fmt.Errorf("%s exists already", path)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	key, err := Generate(*keyType)
+	if err != nil {
+		return err
+	}
+	if err = WritePrivateKey(*keyPath, key); err != nil {
+		return err
+	}
+	if err = WritePublicKey(*pubPath, key.Public()); err != nil {
+		return err
+	}
+	fingerprint, err := Fingerprint(key.Public())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s key written to %s, public key to %s\n", *keyType, *keyPath, *pubPath)
+	fmt.Println("Fingerprint:", fingerprint)
+	return nil
+}
+
+// IsKeygen tells whether the command line runs the keygen subcommand.
+func IsKeygen(args []string) bool {
+	return len(args) > 1 && args[1] == "keygen"
+}
@@ -0,0 +1,252 @@
+package keys
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type equaler interface {
+	Equal(x crypto.PublicKey) bool
+}
+
+func pemOf(blockType string, der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+}
+
+/* Test keys with every encoding they can be written in */
+type encodedKey struct {
+	name    string
+	key     crypto.Signer
+	private map[string][]byte
+	public  map[string][]byte
+}
+
+func testKeys(t *testing.T) []*encodedKey {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []*encodedKey
+	for _, k := range []struct {
+		name string
+		key  crypto.Signer
+	}{{"rsa", rsaKey}, {"ecdsa", ecKey}, {"ed25519", edKey}} {
+		pkcs8, err := x509.MarshalPKCS8PrivateKey(k.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkix, err := x509.MarshalPKIXPublicKey(k.key.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, &encodedKey{name: k.name, key: k.key,
+			private: map[string][]byte{"PKCS#8 PEM": pemOf("PRIVATE KEY", pkcs8), "PKCS#8 DER": pkcs8},
+			public:  map[string][]byte{"PKIX PEM": pemOf("PUBLIC KEY", pkix), "PKIX DER": pkix}})
+	}
+
+	pkcs1 := x509.MarshalPKCS1PrivateKey(rsaKey)
+	keys[0].private["PKCS#1 PEM"] = pemOf("RSA PRIVATE KEY", pkcs1)
+	keys[0].private["PKCS#1 DER"] = pkcs1
+	pkcs1Pub := x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey)
+	keys[0].public["PKCS#1 PEM"] = pemOf("RSA PUBLIC KEY", pkcs1Pub)
+	keys[0].public["PKCS#1 DER"] = pkcs1Pub
+
+	sec1, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys[1].private["SEC1 PEM"] = pemOf("EC PRIVATE KEY", sec1)
+	keys[1].private["SEC1 DER"] = sec1
+
+	keys[2].private["raw seed"] = edKey.Seed()
+	keys[2].private["raw private key"] = []byte(edKey)
+	keys[2].public["raw"] = []byte(edKey.Public().(ed25519.PublicKey))
+
+	for _, k := range keys {
+		template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: k.name},
+			NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+		cert, err := x509.CreateCertificate(rand.Reader, template, template, k.key.Public(), k.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k.public["certificate"] = pemOf("CERTIFICATE", cert)
+	}
+	return keys
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	for _, k := range testKeys(t) {
+		for encoding, data := range k.private {
+			key, err := ParsePrivateKey(data)
+			if err != nil {
+				t.Errorf("%s %s: %v", k.name, encoding, err)
+				continue
+			}
+			if !key.Public().(equaler).Equal(k.key.Public()) {
+				t.Errorf("%s %s: parsed another key", k.name, encoding)
+			}
+		}
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	for _, k := range testKeys(t) {
+		for encoding, data := range k.public {
+			key, err := ParsePublicKey(data)
+			if err != nil {
+				t.Errorf("%s %s: %v", k.name, encoding, err)
+				continue
+			}
+			if !key.(equaler).Equal(k.key.Public()) {
+				t.Errorf("%s %s: parsed another key", k.name, encoding)
+			}
+		}
+	}
+}
+
+func TestPublicKeyOfPrivateKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, k := range testKeys(t) {
+		for encoding, data := range k.private {
+			if encoding == "raw seed" {
+				/* 32 bytes are read as a raw public key */
+				continue
+			}
+			path := filepath.Join(dir, k.name+" "+encoding)
+			if err := ioutil.WriteFile(path, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+			key, err := LoadPublicKey(path)
+			if err != nil {
+				t.Errorf("%s %s: %v", k.name, encoding, err)
+				continue
+			}
+			if !key.(equaler).Equal(k.key.Public()) {
+				t.Errorf("%s %s: public key differs from the private key", k.name, encoding)
+			}
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte("not a key"), pemOf("PRIVATE KEY", []byte("garbage"))} {
+		if _, err := ParsePrivateKey(data); err == nil {
+			t.Errorf("ParsePrivateKey(%q) succeeded", data)
+		}
+		if _, err := ParsePublicKey(data); err == nil {
+			t.Errorf("ParsePublicKey(%q) succeeded", data)
+		}
+	}
+}
+
+func TestParseSymmetricKey(t *testing.T) {
+	key := []byte{0x00, 0x01, 0x7f, 0x80, 0xfe, 0xff, 0x0a, 0x20, 0x0d, 0x09, 0xde, 0xad, 0xbe, 0xef, 0x42, 0x99}
+	tests := []struct {
+		name string
+		data []byte
+		want []byte
+	}{
+		{"hex", []byte(hex.EncodeToString(key) + "\n"), key},
+		{"upper case hex", []byte("00017F80FEFF0A200D09DEADBEEF4299"), key},
+		{"base64", []byte(base64.StdEncoding.EncodeToString(key) + "\n"), key},
+		{"PEM", pemOf("AES KEY", key), key},
+		{"raw", key, key},
+		{"hex before base64", []byte("deadbeef"), []byte{0xde, 0xad, 0xbe, 0xef}},
+		{"hex prefix", []byte("hex:deadbeef\n"), []byte{0xde, 0xad, 0xbe, 0xef}},
+		{"base64 prefix", []byte("base64:deadbeef\n"), []byte{0x75, 0xe6, 0x9d, 0x6d, 0xe7, 0x9f}},
+	}
+	for _, test := range tests {
+		got, err := ParseSymmetricKey(test.data)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("%s: %x, want %x", test.name, got, test.want)
+		}
+	}
+
+	for _, data := range []string{"", "hex:", "hex:xyz", "base64:!!", "base64:"} {
+		if key, err := ParseSymmetricKey([]byte(data)); err == nil {
+			t.Errorf("ParseSymmetricKey(%q) = %x, want an error", data, key)
+		}
+	}
+}
+
+func TestKeygen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, keyType := range []string{"ecdsa-p256", "ed25519"} {
+		path := filepath.Join(dir, keyType+".pem")
+		if err := Keygen("keygen", []string{"-type", keyType, "-key", path}, "", ""); err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+		priv, err := LoadPrivateKey(path)
+		if err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+		pub, err := LoadPublicKey(PublicPath(path))
+		if err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+		if !pub.(equaler).Equal(priv.Public()) || TypeOf(pub) != keyType {
+			t.Errorf("%s: public key %s does not match", keyType, TypeOf(pub))
+		}
+		if err := Keygen("keygen", []string{"-type", keyType, "-key", path}, "", ""); err == nil {
+			t.Errorf("%s: existing key overwritten", keyType)
+		}
+	}
+
+	path := filepath.Join(dir, "pub exists.pem")
+	if err := ioutil.WriteFile(PublicPath(path), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Keygen("keygen", []string{"-type", "ed25519", "-key", path}, "", ""); err == nil {
+		t.Errorf("existing public key overwritten")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("private key written without its public key: %v", err)
+	}
+
+	path = filepath.Join(dir, "sym.key")
+	if err := Keygen("keygen", []string{"-type", "sym", "-key", path, "-size", "32"}, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if key, err := LoadSymmetricKey(path); err != nil || len(key) != 32 {
+		t.Errorf("symmetric key of %d bytes, %v", len(key), err)
+	}
+}
@@ -0,0 +1,187 @@
+// Package mac has the message authentication codes the server benchmarks
+// that the standard library lacks, SipHash-2-4 and Poly1305. Both run in
+// constant time for messages of the same length.
+package mac
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// SipHash24 is SipHash-2-4 with a 64-bit output, the key is k0 and k1 in
+// little endian. See https://131002.net/siphash/siphash.pdf.
+func SipHash24(k0, k1 uint64, message []byte) uint64 {
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13)
+		v1 ^= v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16)
+		v3 ^= v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21)
+		v3 ^= v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17)
+		v1 ^= v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+
+	length := len(message)
+	for len(message) >= 8 {
+		m := binary.LittleEndian.Uint64(message)
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+		message = message[8:]
+	}
+
+	/* Last block: remaining bytes and the length in the top byte */
+	var last [8]byte
+	copy(last[:], message)
+	last[7] = byte(length)
+	m := binary.LittleEndian.Uint64(last[:])
+	v3 ^= m
+	round()
+	round()
+	v0 ^= m
+
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+	return v0 ^ v1 ^ v2 ^ v3
+}
+
+// Poly1305 writes the tag of message under key to out. Poly1305 is a
+// one-time authenticator (RFC 8439), a key must only ever tag one message.
+// The implementation follows poly1305-donna with 26-bit limbs.
+func Poly1305(out *[16]byte, message []byte, key *[32]byte) {
+	const mask = 0x3ffffff
+	le := binary.LittleEndian
+
+	/* Clamped r */
+	r0 := le.Uint32(key[0:]) & 0x3ffffff
+	r1 := (le.Uint32(key[3:]) >> 2) & 0x3ffff03
+	r2 := (le.Uint32(key[6:]) >> 4) & 0x3ffc0ff
+	r3 := (le.Uint32(key[9:]) >> 6) & 0x3f03fff
+	r4 := (le.Uint32(key[12:]) >> 8) & 0x00fffff
+	s1, s2, s3, s4 := r1*5, r2*5, r3*5, r4*5
+
+	var h0, h1, h2, h3, h4 uint32
+	var block [16]byte
+	for len(message) > 0 {
+		var b []byte
+		hibit := uint32(1 << 24)
+		if len(message) >= 16 {
+			b = message[:16]
+			message = message[16:]
+		} else {
+			/* Short last block is padded with a single 1 */
+			block = [16]byte{}
+			copy(block[:], message)
+			block[len(message)] = 1
+			b = block[:]
+			hibit = 0
+			message = nil
+		}
+
+		h0 += le.Uint32(b[0:]) & mask
+		h1 += (le.Uint32(b[3:]) >> 2) & mask
+		h2 += (le.Uint32(b[6:]) >> 4) & mask
+		h3 += (le.Uint32(b[9:]) >> 6) & mask
+		h4 += (le.Uint32(b[12:]) >> 8) | hibit
+
+		/* h *= r mod 2^130 - 5 */
+		d0 := uint64(h0)*uint64(r0) + uint64(h1)*uint64(s4) + uint64(h2)*uint64(s3) +
+			uint64(h3)*uint64(s2) + uint64(h4)*uint64(s1)
+		d1 := uint64(h0)*uint64(r1) + uint64(h1)*uint64(r0) + uint64(h2)*uint64(s4) +
+			uint64(h3)*uint64(s3) + uint64(h4)*uint64(s2)
+		d2 := uint64(h0)*uint64(r2) + uint64(h1)*uint64(r1) + uint64(h2)*uint64(r0) +
+			uint64(h3)*uint64(s4) + uint64(h4)*uint64(s3)
+		d3 := uint64(h0)*uint64(r3) + uint64(h1)*uint64(r2) + uint64(h2)*uint64(r1) +
+			uint64(h3)*uint64(r0) + uint64(h4)*uint64(s4)
+		d4 := uint64(h0)*uint64(r4) + uint64(h1)*uint64(r3) + uint64(h2)*uint64(r2) +
+			uint64(h3)*uint64(r1) + uint64(h4)*uint64(r0)
+
+		c := d0 >> 26
+		h0 = uint32(d0) & mask
+		d1 += c
+		c = d1 >> 26
+		h1 = uint32(d1) & mask
+		d2 += c
+		c = d2 >> 26
+		h2 = uint32(d2) & mask
+		d3 += c
+		c = d3 >> 26
+		h3 = uint32(d3) & mask
+		d4 += c
+		c = d4 >> 26
+		h4 = uint32(d4) & mask
+		h0 += uint32(c) * 5
+		h1 += h0 >> 26
+		h0 &= mask
+	}
+
+	/* Fully carry h */
+	c := h1 >> 26
+	h1 &= mask
+	h2 += c
+	c = h2 >> 26
+	h2 &= mask
+	h3 += c
+	c = h3 >> 26
+	h3 &= mask
+	h4 += c
+	c = h4 >> 26
+	h4 &= mask
+	h0 += c * 5
+	c = h0 >> 26
+	h0 &= mask
+	h1 += c
+
+	/* g = h - p, take it if h >= p, in constant time */
+	g0 := h0 + 5
+	c = g0 >> 26
+	g0 &= mask
+	g1 := h1 + c
+	c = g1 >> 26
+	g1 &= mask
+	g2 := h2 + c
+	c = g2 >> 26
+	g2 &= mask
+	g3 := h3 + c
+	c = g3 >> 26
+	g3 &= mask
+	g4 := h4 + c - (1 << 26)
+
+	sel := (g4 >> 31) - 1
+	h0 = (h0 &^ sel) | (g0 & sel)
+	h1 = (h1 &^ sel) | (g1 & sel)
+	h2 = (h2 &^ sel) | (g2 & sel)
+	h3 = (h3 &^ sel) | (g3 & sel)
+	h4 = (h4 &^ sel) | (g4 & sel)
+
+	/* h mod 2^128, plus s */
+	h0 = h0 | (h1 << 26)
+	h1 = (h1 >> 6) | (h2 << 20)
+	h2 = (h2 >> 12) | (h3 << 14)
+	h3 = (h3 >> 18) | (h4 << 8)
+
+	f := uint64(h0) + uint64(le.Uint32(key[16:]))
+	le.PutUint32(out[0:], uint32(f))
+	f = uint64(h1) + uint64(le.Uint32(key[20:])) + (f >> 32)
+	le.PutUint32(out[4:], uint32(f))
+	f = uint64(h2) + uint64(le.Uint32(key[24:])) + (f >> 32)
+	le.PutUint32(out[8:], uint32(f))
+	f = uint64(h3) + uint64(le.Uint32(key[28:])) + (f >> 32)
+	le.PutUint32(out[12:], uint32(f))
+}
@@ -0,0 +1,71 @@
+package mac
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func fromHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Vectors of the SipHash paper, key 00 01 .. 0f and message 00 01 .. n-1
+func TestSipHash24(t *testing.T) {
+	tests := []struct {
+		n    int
+		want uint64
+	}{
+		{0, 0x726fdb47dd0e0e31},
+		{1, 0x74f839c593dc67fd},
+		{7, 0xab0200f58b01d137},
+		{8, 0x93f5f5799a932462},
+		{15, 0xa129ca6149be45e5},
+		{16, 0x3f2acc7f57c29bdb},
+		{63, 0x958a324ceb064572},
+	}
+	message := make([]byte, 64)
+	for i := range message {
+		message[i] = byte(i)
+	}
+	const k0, k1 = 0x0706050403020100, 0x0f0e0d0c0b0a0908
+	for _, test := range tests {
+		if got := SipHash24(k0, k1, message[:test.n]); got != test.want {
+			t.Errorf("SipHash24 of %d bytes = %#016x, want %#016x", test.n, got, test.want)
+		}
+	}
+}
+
+// Vectors of RFC 8439, section 2.5.2 and appendix A.3
+func TestPoly1305(t *testing.T) {
+	zero := strings.Repeat("00", 16)
+	ones := strings.Repeat("ff", 16)
+	tests := []struct {
+		name     string
+		key, msg string
+		want     string
+	}{
+		{"2.5.2", "85d6be7857556d337f4452fe42d506a80103808afb0db2fd4abff6af4149f51b",
+			hex.EncodeToString([]byte("Cryptographic Forum Research Group")),
+			"a8061dc1305136c6c22b8baf0c0127a9"},
+		{"A.3 #1", zero + zero, strings.Repeat(zero, 4), zero},
+		{"A.3 #5", "02" + zero[2:] + zero, ones, "03" + zero[2:]},
+		{"A.3 #6", "02" + zero[2:] + ones, "02" + zero[2:], "03" + zero[2:]},
+		{"A.3 #7", "01" + zero[2:] + zero, ones + "f0" + ones[2:] + "11" + zero[2:], "05" + zero[2:]},
+		{"A.3 #9", "02" + zero[2:] + zero, "fd" + ones[2:], "fa" + ones[2:]},
+	}
+	for _, test := range tests {
+		var key [32]byte
+		copy(key[:], fromHex(t, test.key))
+		var tag [16]byte
+		Poly1305(&tag, fromHex(t, test.msg), &key)
+		if want := fromHex(t, test.want); !bytes.Equal(tag[:], want) {
+			t.Errorf("%s: tag %x, want %x", test.name, tag, want)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// Package pacer releases packets at a fixed average rate with a precision
+// well below the granularity of time.Sleep.
+//
+// Packets are paced by a token bucket holding at most one burst. Long waits
+// are slept, the last part of every wait is spent spinning on the clock, so
+// the release times are accurate to a few microseconds. Optionally packets are released in
+// back-to-back bursts (packet trains) while keeping the same average rate.
+package pacer
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// DefaultSpin is the part of a wait that is spent busy-waiting instead of
+// sleeping. Sleeps on Linux regularly overshoot by 50-100us.
+const DefaultSpin = 250 * time.Microsecond
+
+// Pacer hands out send slots. It is not safe for concurrent use, every
+// sending goroutine should have its own Pacer.
+type Pacer struct {
+	// Spin is how much of a wait is spent spinning, see DefaultSpin.
+	Spin time.Duration
+
+	interval time.Duration
+	burst    int
+
+	/* Scheduled start of the next burst and position within the current one */
+	next    time.Time
+	inBurst int
+
+	stats Stats
+}
+
+// New creates a pacer releasing one packet per interval on average. Packets
+// go out in back-to-back bursts of burst packets, i.e. one burst every
+// burst*interval. An interval <= 0 disables pacing.
+func New(interval time.Duration, burst int) *Pacer {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Pacer{
+		Spin:     DefaultSpin,
+		interval: interval,
+		burst:    burst,
+		stats:    Stats{Requested: interval, Burst: burst},
+	}
+}
+
+// NewRate creates a pacer releasing pps packets per second on average.
+func NewRate(pps float64, burst int) *Pacer {
+	if pps <= 0 {
+		return New(0, burst)
+	}
+	return New(time.Duration(float64(time.Second)/pps), burst)
+}
+
+// Wait blocks until the next packet may be sent and returns the release
+// time, which callers should use as the send timestamp.
+func (p *Pacer) Wait() time.Time {
+	now := time.Now()
+	if p.interval <= 0 {
+		p.stats.record(now, 0)
+		return now
+	}
+
+	var late time.Duration
+	if p.inBurst == 0 {
+		if p.next.IsZero() {
+			p.next = now
+		}
+		/* A sender that fell behind by more than a burst period (e.g.
+		 * descheduled) must not catch up by blasting packets back-to-back. */
+		period := time.Duration(p.burst) * p.interval
+		if now.Sub(p.next) > period {
+			p.next = now
+		}
+		if now.Before(p.next) {
+			now = SleepUntil(p.next, p.Spin)
+			late = now.Sub(p.next)
+		}
+		/* Scheduling from p.next rather than now keeps overshoots of
+		 * single waits from adding up. */
+		p.next = p.next.Add(period)
+	}
+
+	p.inBurst += 1
+	if p.inBurst >= p.burst {
+		p.inBurst = 0
+	}
+	p.stats.record(now, late)
+	return now
+}
+
+// Stats returns the requested and achieved send timing so far.
+func (p *Pacer) Stats() Stats {
+	return p.stats
+}
+
+// SleepUntil blocks until deadline, sleeping for all but the last spin of
+// the wait and busy-waiting for the rest. Returns the time it woke up at.
+// It is for senders with irregular gaps, e.g. Poisson probes.
+func SleepUntil(deadline time.Time, spin time.Duration) time.Time {
+	if d := time.Until(deadline) - spin; d > 0 {
+		time.Sleep(d)
+	}
+	now := time.Now()
+	for now.Before(deadline) {
+		now = time.Now()
+	}
+	return now
+}
+
+// Stats summarizes the release times handed out by a Pacer.
+type Stats struct {
+	Requested time.Duration /* Requested average gap between packets */
+	Burst     int
+	Packets   int
+
+	First, Last time.Time
+	MinGap      time.Duration
+	MaxGap      time.Duration
+	MaxLate     time.Duration /* Worst overshoot of a scheduled release */
+
+	sumGap, sumGapSq float64
+}
+
+func (s *Stats) record(now time.Time, late time.Duration) {
+	if s.Packets == 0 {
+		s.First = now
+	} else {
+		gap := now.Sub(s.Last)
+		if s.Packets == 1 || gap < s.MinGap {
+			s.MinGap = gap
+		}
+		if gap > s.MaxGap {
+			s.MaxGap = gap
+		}
+		s.sumGap += float64(gap)
+		s.sumGapSq += float64(gap) * float64(gap)
+	}
+	if late > s.MaxLate {
+		s.MaxLate = late
+	}
+	s.Last = now
+	s.Packets += 1
+}
+
+// Achieved returns the average gap between consecutive releases.
+func (s Stats) Achieved() time.Duration {
+	if s.Packets < 2 {
+		return 0
+	}
+	return s.Last.Sub(s.First) / time.Duration(s.Packets-1)
+}
+
+// Jitter returns the standard deviation of the gaps between releases.
+func (s Stats) Jitter() time.Duration {
+	if s.Packets < 2 {
+		return 0
+	}
+	n := float64(s.Packets - 1)
+	mean := s.sumGap / n
+	return time.Duration(math.Sqrt(math.Max(s.sumGapSq/n-mean*mean, 0)))
+}
+
+// Error returns how far the achieved average gap is off the requested one,
+// as a fraction of the requested gap.
+func (s Stats) Error() float64 {
+	if s.Requested <= 0 || s.Packets < 2 {
+		return 0
+	}
+	return float64(s.Achieved()-s.Requested) / float64(s.Requested)
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("requested gap %v (burst %d), achieved %v (%+.1f%%), min %v, max %v, jitter %v, late up to %v",
+		s.Requested, s.Burst, s.Achieved(), s.Error()*100, s.MinGap, s.MaxGap, s.Jitter(), s.MaxLate)
+}
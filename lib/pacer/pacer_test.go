@@ -0,0 +1,133 @@
+package pacer
+
+import (
+	"testing"
+	"time"
+)
+
+// Timing depends on the machine. A descheduled sender only ever falls
+// behind, so the bounds are tight towards faster than requested and leave
+// room for a loaded machine towards slower.
+
+func TestRate(t *testing.T) {
+	const interval = 200 * time.Microsecond
+	const packets = 2000
+	p := New(interval, 1)
+	var prev time.Time
+	late := 0
+	for i := 0; i < packets; i++ {
+		now := p.Wait()
+		if i > 0 && now.Sub(prev) < interval/2 {
+			late++
+		}
+		prev = now
+	}
+	s := p.Stats()
+	if e := s.Error(); e < -0.01 || e > 0.2 {
+		t.Errorf("achieved %v for %v, %+.1f%% off", s.Achieved(), interval, e*100)
+	}
+	/* A release is never early, only catching up after a late one shortens a gap */
+	if late > packets/20 {
+		t.Errorf("%d of %d gaps below half the interval", late, packets)
+	}
+	if s.MinGap > interval {
+		t.Errorf("min gap %v above the interval %v", s.MinGap, interval)
+	}
+}
+
+func TestNewRate(t *testing.T) {
+	if s := NewRate(1000, 1).Stats(); s.Requested != time.Millisecond {
+		t.Errorf("1000 pps requested %v, want 1ms", s.Requested)
+	}
+	if s := NewRate(0, 1).Stats(); s.Requested != 0 {
+		t.Errorf("0 pps requested %v, want no pacing", s.Requested)
+	}
+}
+
+func TestBurst(t *testing.T) {
+	const interval = time.Millisecond
+	const burst = 5
+	p := New(interval, burst)
+	var times []time.Time
+	for i := 0; i < 20*burst; i++ {
+		times = append(times, p.Wait())
+	}
+	period := burst * interval
+	spread, short := 0, 0
+	for i := 1; i < len(times); i++ {
+		gap := times[i].Sub(times[i-1])
+		if i%burst != 0 && gap > interval/2 {
+			spread++
+		}
+		/* A late burst is followed by a shorter gap to the next one */
+		if i%burst == 0 && gap < period/2 {
+			short++
+		}
+	}
+	if spread > len(times)/20 {
+		t.Errorf("%d of %d gaps within bursts above half the interval %v", spread, len(times)/burst*(burst-1), interval)
+	}
+	if short > len(times)/burst/5 {
+		t.Errorf("%d of %d gaps between bursts below half the period %v", short, len(times)/burst-1, period)
+	}
+	/* Bursts start once per period, the packets within them go back-to-back */
+	last := len(times) - burst
+	if avg := times[last].Sub(times[0]) / time.Duration(last/burst); avg < period*99/100 || avg > period*6/5 {
+		t.Errorf("bursts every %v, want %v", avg, period)
+	}
+}
+
+func TestNoCatchUp(t *testing.T) {
+	const interval = time.Millisecond
+	p := New(interval, 1)
+	p.Wait()
+	time.Sleep(10 * interval)
+	prev := p.Wait()
+	next := p.Wait()
+	if gap := next.Sub(prev); gap < interval/2 {
+		t.Errorf("gap %v after a pause, the pacer caught up", gap)
+	}
+}
+
+func TestStats(t *testing.T) {
+	p := New(0, 3)
+	if s := p.Stats(); s.Packets != 0 || s.Achieved() != 0 || s.Jitter() != 0 || s.Error() != 0 {
+		t.Errorf("stats without packets: %+v", s)
+	}
+	var first, last time.Time
+	for i := 0; i < 10; i++ {
+		last = p.Wait()
+		if i == 0 {
+			first = last
+		}
+	}
+	s := p.Stats()
+	if s.Packets != 10 || s.Burst != 3 || s.Requested != 0 {
+		t.Errorf("stats %+v, want 10 packets, burst 3 and no requested gap", s)
+	}
+	if !s.First.Equal(first) || !s.Last.Equal(last) {
+		t.Errorf("first %v and last %v, want %v and %v", s.First, s.Last, first, last)
+	}
+	if s.MinGap > s.MaxGap || s.MaxLate != 0 || s.Error() != 0 {
+		t.Errorf("unpaced stats %+v", s)
+	}
+	if s.Achieved() != last.Sub(first)/9 {
+		t.Errorf("achieved %v, want %v", s.Achieved(), last.Sub(first)/9)
+	}
+
+	/* Known gaps: 1, 3, 1, 3 ms */
+	var r Stats
+	start := time.Now()
+	for _, at := range []time.Duration{0, 1, 4, 5, 8} {
+		r.record(start.Add(at*time.Millisecond), at*time.Microsecond)
+	}
+	if r.MinGap != time.Millisecond || r.MaxGap != 3*time.Millisecond || r.Achieved() != 2*time.Millisecond {
+		t.Errorf("gaps min %v, max %v, average %v", r.MinGap, r.MaxGap, r.Achieved())
+	}
+	if r.Jitter() != time.Millisecond {
+		t.Errorf("jitter %v, want 1ms", r.Jitter())
+	}
+	if r.MaxLate != 8*time.Microsecond {
+		t.Errorf("max late %v, want 8us", r.MaxLate)
+	}
+}
@@ -0,0 +1,250 @@
+// MAC and signature algorithms benchmarked by the server
+// Build together with the server: go run server.go mac_sig_api.go algorithms.go
+package main
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/netsec-ethz/scion-homeworks/lib/mac"
+)
+
+func init() {
+	RegisterAlgorithm(&Algorithm{Name: "hmac-sha256", Kind: KindMAC, KeyBits: 256,
+		Iterations: numMacCompute, Cost: time.Microsecond, Setup: setupHMAC})
+	RegisterAlgorithm(&Algorithm{Name: "poly1305", Kind: KindMAC, KeyBits: 256,
+		Iterations: numMacCompute, Cost: time.Microsecond, Setup: setupPoly1305})
+	RegisterAlgorithm(&Algorithm{Name: "aes-gmac", Kind: KindMAC, KeyBits: 128,
+		Iterations: numMacCompute, Cost: time.Microsecond, Setup: setupGMAC})
+	RegisterAlgorithm(&Algorithm{Name: "siphash-2-4", Kind: KindMAC, KeyBits: 128,
+		Iterations: numMacCompute, Cost: time.Microsecond, Setup: setupSipHash})
+
+	RegisterAlgorithm(&Algorithm{Name: "ed25519", Kind: KindSig, KeyBits: 256,
+		Iterations: numSigCompute, Cost: 150 * time.Microsecond, Setup: setupEd25519})
+	RegisterAlgorithm(&Algorithm{Name: "ecdsa-p256", Kind: KindSig, KeyBits: 256,
+		Iterations: numSigCompute, Cost: 100 * time.Microsecond, Setup: func() (Operation, error) {
+			return setupECDSA(elliptic.P256(), crypto.SHA256)
+		}})
+	RegisterAlgorithm(&Algorithm{Name: "ecdsa-p384", Kind: KindSig, KeyBits: 384,
+		Iterations: numSigCompute, Cost: time.Millisecond, Setup: func() (Operation, error) {
+			return setupECDSA(elliptic.P384(), crypto.SHA384)
+		}})
+	/* Signing cost grows with the cube of the key size, keep requests short */
+	RegisterAlgorithm(&Algorithm{Name: "rsa-pss-3072", Kind: KindSig, KeyBits: 3072,
+		Iterations: numSigCompute / 4, Cost: 4 * time.Millisecond, Setup: func() (Operation, error) {
+			return setupRSA(3072, false)
+		}})
+	RegisterAlgorithm(&Algorithm{Name: "rsa-pss-4096", Kind: KindSig, KeyBits: 4096,
+		Iterations: numSigCompute / 10, Cost: 9 * time.Millisecond, Setup: func() (Operation, error) {
+			return setupRSA(4096, false)
+		}})
+}
+
+var errMACMismatch = errors.New("MAC does not match")
+
+/* An Operation made of its two functions */
+type operation struct {
+	compute func(message []byte) ([]byte, error)
+	verify  func(message, tag []byte) error
+}
+
+func (op *operation) Compute(message []byte) ([]byte, error) {
+	return op.compute(message)
+}
+
+func (op *operation) Verify(message, tag []byte) error {
+	return op.verify(message, tag)
+}
+
+/*
+ * A MAC is verified by computing it again, the tags are compared in
+ * constant time so the comparison does not leak how many bytes matched
+ */
+func macOperation(compute func(message []byte) ([]byte, error)) Operation {
+	return &operation{compute: compute, verify: func(message, tag []byte) error {
+		expected, err := compute(message)
+		if err != nil {
+			return err
+		}
+		if subtle.ConstantTimeCompare(expected, tag) != 1 {
+			return errMACMismatch
+		}
+		return nil
+	}}
+}
+
+func randomKey(n int) ([]byte, error) {
+	key := make([]byte, n)
+	_, err := rand.Read(key)
+	return key, err
+}
+
+/* hash.Hash keeps state, so every call gets its own */
+func setupHMAC() (Operation, error) {
+	key, err := randomKey(32)
+	if err != nil {
+		return nil, err
+	}
+	return macOperation(func(message []byte) ([]byte, error) {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(message)
+		return mac.Sum(nil), nil
+	}), nil
+}
+
+/*
+ * Poly1305 is a one-time authenticator, the key must never be reused. The
+ * benchmark reuses it anyway since that does not change the cost.
+ */
+func setupPoly1305() (Operation, error) {
+	raw, err := randomKey(32)
+	if err != nil {
+		return nil, err
+	}
+	var key [32]byte
+	copy(key[:], raw)
+	return macOperation(func(message []byte) ([]byte, error) {
+		var tag [16]byte
+		mac.Poly1305(&tag, message, &key)
+		return tag[:], nil
+	}), nil
+}
+
+/*
+ * GMAC is GCM without plaintext, the message is only authenticated. The
+ * nonce is sent along with the tag, GCM checks the tag in constant time.
+ */
+func setupGMAC() (Operation, error) {
+	key, err := randomKey(16)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	/* Nonces must not repeat under a key, count them up */
+	var counter uint64
+	return &operation{
+		compute: func(message []byte) ([]byte, error) {
+			nonce := make([]byte, gcm.NonceSize())
+			binary.BigEndian.PutUint64(nonce[gcm.NonceSize()-8:], atomic.AddUint64(&counter, 1))
+			return gcm.Seal(nonce, nonce, nil, message), nil
+		},
+		verify: func(message, tag []byte) error {
+			if len(tag) < gcm.NonceSize() {
+				return errMACMismatch
+			}
+			_, err := gcm.Open(nil, tag[:gcm.NonceSize()], tag[gcm.NonceSize():], message)
+			return err
+		},
+	}, nil
+}
+
+func setupSipHash() (Operation, error) {
+	key, err := randomKey(16)
+	if err != nil {
+		return nil, err
+	}
+	k0 := binary.LittleEndian.Uint64(key[0:])
+	k1 := binary.LittleEndian.Uint64(key[8:])
+	return macOperation(func(message []byte) ([]byte, error) {
+		tag := make([]byte, 8)
+		binary.LittleEndian.PutUint64(tag, mac.SipHash24(k0, k1, message))
+		return tag, nil
+	}), nil
+}
+
+func setupEd25519() (Operation, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &operation{
+		compute: func(message []byte) ([]byte, error) {
+			return ed25519.Sign(priv, message), nil
+		},
+		verify: func(message, sig []byte) error {
+			if !ed25519.Verify(pub, message, sig) {
+				return errors.New("ed25519: invalid signature")
+			}
+			return nil
+		},
+	}, nil
+}
+
+func setupECDSA(curve elliptic.Curve, h crypto.Hash) (Operation, error) {
+	priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &operation{
+		compute: func(message []byte) ([]byte, error) {
+			return ecdsa.SignASN1(rand.Reader, priv, hashMessage(h, message))
+		},
+		verify: func(message, sig []byte) error {
+			if !ecdsa.VerifyASN1(&priv.PublicKey, hashMessage(h, message), sig) {
+				return errors.New("ecdsa: invalid signature")
+			}
+			return nil
+		},
+	}, nil
+}
+
+func setupRSA(bits int, pkcs1v15 bool) (Operation, error) {
+	priv, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return nil, err
+	}
+	return rsaOperation(priv, pkcs1v15), nil
+}
+
+/* RSA signatures over SHA-256, PSS or PKCS #1 v1.5 padded */
+func rsaOperation(priv *rsa.PrivateKey, pkcs1v15 bool) Operation {
+	opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto}
+	return &operation{
+		compute: func(message []byte) ([]byte, error) {
+			digest := hashMessage(crypto.SHA256, message)
+			if pkcs1v15 {
+				return rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, digest)
+			}
+			return rsa.SignPSS(rand.Reader, priv, crypto.SHA256, digest, opts)
+		},
+		verify: func(message, sig []byte) error {
+			digest := hashMessage(crypto.SHA256, message)
+			if pkcs1v15 {
+				return rsa.VerifyPKCS1v15(&priv.PublicKey, crypto.SHA256, digest, sig)
+			}
+			return rsa.VerifyPSS(&priv.PublicKey, crypto.SHA256, digest, sig, opts)
+		},
+	}
+}
+
+func hashMessage(h crypto.Hash, message []byte) []byte {
+	switch h {
+	case crypto.SHA384:
+		sum := sha512.Sum384(message)
+		return sum[:]
+	default:
+		sum := sha256.Sum256(message)
+		return sum[:]
+	}
+}
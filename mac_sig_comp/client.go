@@ -1,4 +1,5 @@
 // A simple client application
+// Run with: go run client.go mac_sig_api.go known_servers.go path_policy.go
 package main
 
 import (
@@ -7,15 +8,17 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
-	"math"
 	"math/rand"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/inconshreveable/log15"
 	"github.com/kormat/fmt15"
 
+	"github.com/netsec-ethz/scion-homeworks/lib/keys"
+
 	"github.com/scionproto/scion/go/lib/sciond"
 	"github.com/scionproto/scion/go/lib/snet"
 	"github.com/scionproto/scion/go/lib/spath"
@@ -28,6 +31,9 @@ type AppMessage struct {
 	MacTime time.Duration
 	NumSigCompute uint32
 	SigTime time.Duration
+	// Zero if the server does not time the verification
+	MacVerifyTime time.Duration
+	SigVerifyTime time.Duration
 }
 
 func printUsage() {
@@ -36,6 +42,171 @@ func printUsage() {
 	fmt.Println("Example SCION address 1-1011,[192.33.93.166]:42002")
 	fmt.Println("-i specifies if the client is used in interactive mode, " +
 		"when true the user is prompted for a path choice")
+	fmt.Println("-pathAlgo selects the path with the best weighted mean of the scores of path policies, " +
+		"e.g. shortest=2,mtu=1, by default all policies count once. Available are:")
+	for _, name := range PathPolicyNames() {
+		policy, _ := LookupPathPolicy(name)
+		fmt.Printf("  %-10s %s\n", name, policy.Description)
+	}
+	fmt.Println("-algs asks the server to benchmark a comma separated list of algorithms, " +
+		"e.g. hmac-sha256,ed25519,ecdsa-p256, or \"all\" for every algorithm it offers. " +
+		"By default the server benchmarks AES-CMAC and RSA-2048")
+	fmt.Println("-sweep Min:Max benchmarks messages from Min to Max bytes instead of one message, " +
+		"e.g. 16:1M, each -sweep_factor times larger. The server generates them from -seed")
+	fmt.Println("-workers N runs every algorithm on 1, 2, 4, ... up to N cores of the server " +
+		"and shows how the operations per second scale")
+	fmt.Println("The request is sent again after -retransmit without a result, with growing intervals, " +
+		"the client gives up after -timeout")
+	fmt.Println("Replies must be signed by the server. Its key is pinned in -known_servers " +
+		"(~/" + defaultKnownServers + ") the first time, or checked against -server_key SHA256:..., " +
+		"the fingerprint the server prints, or against the public key in the -pub file. " +
+		"-allow_unsigned accepts the unsigned replies of old servers")
+}
+
+// Prints the timing of every operation the server benchmarked
+func printResults(measurements []*Measurement) {
+	fmt.Printf("Tested using a %v-byte input\n", msgLen)
+	fmt.Printf("%-18s %-10s %6s %12s %12s %12s %10s\n", "Algorithm", "Operation", "Key",
+		"us/op", "min us/op", "max us/op", "Runs")
+	fmt.Println(strings.Repeat("-", 86))
+	for _, m := range measurements {
+		if len(m.Error) > 0 {
+			fmt.Printf("%-18s %-10s %6s %12s %12s %12s %10s  %s\n", m.Algorithm,
+				OperationName(m.Kind, m.Operation), "-", "-", "-", "-", "-", m.Error)
+			continue
+		}
+		fmt.Printf("%-18s %-10s %6d %12.2f %12.2f %12.2f %10d\n", m.Algorithm,
+			OperationName(m.Kind, m.Operation), m.KeyBits, float64(m.PerOp().Nanoseconds())/1000,
+			float64(m.Min.Nanoseconds())/1000, float64(m.Max.Nanoseconds())/1000, m.Iterations)
+	}
+}
+
+/*
+ * Splits measurements into groups with the same key, keeping the order in
+ * which the keys first appear
+ */
+func groupMeasurements(measurements []*Measurement, key func(*Measurement) string) [][]*Measurement {
+	var groups [][]*Measurement
+	index := make(map[string]int)
+	for _, m := range measurements {
+		i, ok := index[key(m)]
+		if !ok {
+			i = len(groups)
+			index[key(m)] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], m)
+	}
+	return groups
+}
+
+// Prints a cost curve per algorithm, operation and number of workers of a sweep
+func printSweep(measurements []*Measurement) {
+	curves := groupMeasurements(measurements, func(m *Measurement) string {
+		return fmt.Sprintf("%s/%d/%d", m.Algorithm, m.Operation, m.Workers)
+	})
+
+	for _, curve := range curves {
+		first := curve[0]
+		workers := ""
+		if first.Workers > 1 {
+			workers = fmt.Sprintf(", %d workers", first.Workers)
+		}
+		fmt.Printf("\n%s %s, %d-bit key%s\n", first.Algorithm, OperationName(first.Kind, first.Operation),
+			first.KeyBits, workers)
+		if len(first.Error) > 0 {
+			fmt.Println("  Failed:", first.Error)
+			continue
+		}
+		var slowest time.Duration
+		for _, m := range curve {
+			if m.PerOp() > slowest {
+				slowest = m.PerOp()
+			}
+		}
+		fmt.Printf("  %8s %12s %10s %10s %8s\n", "Size", "us/op", "x smallest", "MB/s", "Runs")
+		dominated := -1
+		for _, m := range curve {
+			if len(m.Error) > 0 {
+				fmt.Printf("  %8s  %s\n", formatSize(m.MessageSize), m.Error)
+				continue
+			}
+			perOp := m.PerOp()
+			ratio, throughput := 0.0, 0.0
+			if first.PerOp() > 0 {
+				ratio = float64(perOp) / float64(first.PerOp())
+			}
+			if perOp > 0 {
+				throughput = float64(m.MessageSize) / perOp.Seconds() / 1e6
+			}
+			// The size dependent cost, i.e. hashing, exceeds the fixed cost once it doubled
+			if dominated < 0 && ratio >= 2 {
+				dominated = m.MessageSize
+			}
+			bar := 0
+			if slowest > 0 {
+				bar = int(40 * perOp / slowest)
+			}
+			fmt.Printf("  %8s %12.2f %10.2f %10.2f %8d  %s\n", formatSize(m.MessageSize),
+				float64(perOp.Nanoseconds())/1000, ratio, throughput, m.Iterations, strings.Repeat("#", bar))
+		}
+		if dominated >= 0 {
+			fmt.Printf("  The message size dominates the cost from %s on\n", formatSize(dominated))
+		}
+	}
+}
+
+/*
+ * Prints per algorithm and operation how latency and operations per second
+ * change with the number of workers. The speedup is relative to one worker,
+ * the efficiency is the speedup per worker.
+ */
+func printScaling(measurements []*Measurement) {
+	fmt.Printf("Tested using a %v-byte input\n", msgLen)
+	groups := groupMeasurements(measurements, func(m *Measurement) string {
+		return fmt.Sprintf("%s/%d", m.Algorithm, m.Operation)
+	})
+
+	for _, group := range groups {
+		first := group[0]
+		fmt.Printf("\n%s %s, %d-bit key\n", first.Algorithm, OperationName(first.Kind, first.Operation),
+			first.KeyBits)
+		fmt.Printf("  %7s %12s %14s %8s %10s\n", "Workers", "us/op", "ops/s", "speedup", "efficiency")
+		for _, m := range group {
+			if len(m.Error) > 0 {
+				fmt.Printf("  %7d  %s\n", m.Workers, m.Error)
+				continue
+			}
+			speedup := 0.0
+			if first.Throughput() > 0 {
+				speedup = m.Throughput() / first.Throughput()
+			}
+			fmt.Printf("  %7d %12.2f %14.0f %8.2f %9.0f%%\n", m.Workers, float64(m.PerOp().Nanoseconds())/1000,
+				m.Throughput(), speedup, 100*speedup/float64(m.Workers))
+		}
+	}
+}
+
+// Prints what the server does with the request, gives up if it was rejected
+func printStatus(status *JobStatus) {
+	switch status.State {
+	case StateQueued:
+		fmt.Printf("Request %d queued at position %d\n", status.ID, status.Position)
+	case StateRunning:
+		fmt.Printf("Request %d is being benchmarked\n", status.ID)
+	case StateRejected:
+		LogFatal("Request rejected by the server", "reason", status.Reason)
+	}
+}
+
+func formatSize(size int) string {
+	switch {
+	case size >= 1<<20 && size%(1<<20) == 0:
+		return fmt.Sprintf("%dM", size>>20)
+	case size >= 1<<10 && size%(1<<10) == 0:
+		return fmt.Sprintf("%dK", size>>10)
+	}
+	return fmt.Sprintf("%dB", size)
 }
 
 func Check(e error) {
@@ -83,76 +254,29 @@ func ChoosePath(interactive bool, pathAlgo string, local snet.Addr, remote snet.
 		}
 	} else {
 		// when in non-interactive mode, use path selection function to choose path
-		selectedPath = pathSelection(pathSet, pathAlgo)
+		selectedPath = pathSelection(appPaths, pathAlgo)
 	}
 	entry := selectedPath.Entry
 	fmt.Printf("Using path:\n  %s\n", entry.Path.String())
 	return entry
 }
 
-// Computes a path based on the indicated path algorithm
-func pathSelection(pathSet spathmeta.AppPathSet, pathAlgo string) *spathmeta.AppPath {
-	var selectedPath *spathmeta.AppPath
-	var metric float64
-	// A path selection algorithm consists of a simple comparision function selecting the best path according
-	// to some path property and a metric function normalizing that property to a value in [0,1], where larger is better
-	// Available path selection algorithms, the metric returned must be normalized between [0,1]:
-	pathAlgos := map[string](func(spathmeta.AppPathSet) (*spathmeta.AppPath, float64)){
-		"shortest": selectShortestPath,
-		"mtu":      selectLargestMTUPath,
-	}
-	switch pathAlgo {
-	case "shortest":
-		log.Debug("Path selection algorithm", "pathAlgo", "shortest")
-		selectedPath, metric = pathAlgos[pathAlgo](pathSet)
-	case "mtu":
-		log.Debug("Path selection algorithm", "pathAlgo", "MTU")
-		selectedPath, metric = pathAlgos[pathAlgo](pathSet)
-	default:
-		// Default is to take result with best score
-		for _, algo := range pathAlgos {
-			cadidatePath, cadidateMetric := algo(pathSet)
-			if cadidateMetric > metric {
-				selectedPath = cadidatePath
-				metric = cadidateMetric
-			}
-		}
-	}
-	log.Debug("Path selection algorithm choice", "path", selectedPath.Entry.Path.String(), "score", metric)
-	return selectedPath
-}
-
-func selectShortestPath(pathSet spathmeta.AppPathSet) (selectedPath *spathmeta.AppPath, metric float64) {
-	// Selects shortest path by number of hops
-	for _, appPath := range pathSet {
-		if selectedPath == nil || len(appPath.Entry.Path.Interfaces) < len(selectedPath.Entry.Path.Interfaces) {
-			selectedPath = appPath
-		}
-	}
-	metric_fn := func(rawMetric []sciond.PathInterface) (result float64) {
-		hopCount := float64(len(rawMetric))
-		midpoint := 7.0
-		result = math.Exp(-(hopCount - midpoint)) / (1 + math.Exp(-(hopCount - midpoint)))
-		return result
-	}
-	return selectedPath, metric_fn(selectedPath.Entry.Path.Interfaces)
-}
+/*
+ * Selects the path with the best weighted score of the policies in
+ * pathAlgo, see ParsePathWeights, and prints the scores of all paths
+ */
+func pathSelection(appPaths []*spathmeta.AppPath, pathAlgo string) *spathmeta.AppPath {
+	weights, err := ParsePathWeights(pathAlgo)
+	Check(err)
+	log.Debug("Path selection algorithm", "pathAlgo", pathAlgo)
 
-func selectLargestMTUPath(pathSet spathmeta.AppPathSet) (selectedPath *spathmeta.AppPath, metric float64) {
-	// Selects path with largest MTU
-	for _, appPath := range pathSet {
-		if selectedPath == nil || appPath.Entry.Path.Mtu > selectedPath.Entry.Path.Mtu {
-			selectedPath = appPath
-		}
-	}
-	metric_fn := func(rawMetric uint16) (result float64) {
-		mtu := float64(rawMetric)
-		midpoint := 1500.0
-		tilt := 0.004
-		result = 1 / (1 + math.Exp(-tilt*(mtu-midpoint)))
-		return result
-	}
-	return selectedPath, metric_fn(selectedPath.Entry.Path.Mtu)
+	scores := ScorePaths(appPaths, weights)
+	selected := bestPathScore(scores)
+	printPathScores(scores, weights, selected)
+	selectedPath := appPaths[selected]
+	log.Debug("Path selection algorithm choice", "path", selectedPath.Entry.Path.String(),
+		"score", scores[selected].Total)
+	return selectedPath
 }
 
 var (
@@ -168,8 +292,25 @@ var (
 	interactive     bool
 	pathAlgo        string
 	msgLen       int
+	algs            string
+	sweep           string
+	sweepFactor     int
+	seed            int64
+	sweepSizes      []int
+	workers         int
+	requestID       uint32
+	timeout         time.Duration
+	retransmitInterval time.Duration
+	knownServersPath string
+	serverKey       string
+	serverPubFile   string
+	allowUnsigned   bool
+	verifier        *ServerVerifier
 )
 
+// Longest wait before the request is sent again
+const maxRetransmitInterval = 16 * time.Second
+
 func main() {
 	// Parsing the Flags
 	flag.StringVar(&clientCCAddrStr, "c", "", "Client SCION Address")
@@ -179,10 +320,22 @@ func main() {
 	flag.StringVar(&dispatcherPath, "dispatcher", "/run/shm/dispatcher/default.sock",
 		"Path to dispatcher socket")
 	flag.BoolVar(&interactive, "i", false, "Interactive mode")
-	flag.StringVar(&pathAlgo, "pathAlgo", "", "Path selection algorithm / metric (\"shortest\", \"mtu\")")
+	flag.StringVar(&pathAlgo, "pathAlgo", "", "Path selection policies with optional weights, e.g. \"shortest=2,mtu\"")
 	id := flag.String("id", "client", "Element ID")
 	logDir := flag.String("log_dir", "./logs", "Log directory")
 	flag.IntVar(&msgLen, "msg_len", 0, "Length of the message to be sent to the server")
+	flag.StringVar(&algs, "algs", "", "Algorithms to benchmark, comma separated or \"all\"")
+	flag.StringVar(&sweep, "sweep", "", "Sweep over message sizes Min:Max, e.g. 16:1M")
+	flag.IntVar(&sweepFactor, "sweep_factor", 4, "Each size of a sweep is this many times the one before")
+	flag.Int64Var(&seed, "seed", 0, "Seed of the sweep messages, random if 0")
+	flag.IntVar(&workers, "workers", 1, "Run the algorithms on up to this many cores of the server")
+	flag.DurationVar(&timeout, "timeout", 5*time.Minute, "Give up if there is no result after this long")
+	flag.DurationVar(&retransmitInterval, "retransmit", time.Second,
+		"Send the request again after this long without a result, doubling up to 16s")
+	flag.StringVar(&knownServersPath, "known_servers", "", "File of the pinned server keys")
+	flag.StringVar(&serverKey, "server_key", "", "Fingerprint of the server key, instead of trusting the first one")
+	flag.StringVar(&serverPubFile, "pub", "", "File of the server public key, instead of trusting the first one")
+	flag.BoolVar(&allowUnsigned, "allow_unsigned", false, "Accept the unsigned replies of old servers")
 	flag.Parse()
 
 	// Setup logging
@@ -197,6 +350,40 @@ func main() {
 				fmt15.Fmt15Format(nil)))))
 	log.Debug("Setup info:", "id", *id)
 
+	if _, err := ParsePathWeights(pathAlgo); err != nil {
+		printUsage()
+		Check(err)
+	}
+	// Replies carry the id, so they are not mixed up with those of earlier runs
+	requestID = rand.New(rand.NewSource(time.Now().UnixNano())).Uint32() | 1
+	if timeout <= 0 || retransmitInterval <= 0 {
+		printUsage()
+		Check(fmt.Errorf("Error, -timeout and -retransmit need to be above 0"))
+	}
+	if workers < 1 || workers > 255 {
+		printUsage()
+		Check(fmt.Errorf("Error, -workers needs to be between 1 and 255"))
+	}
+	if len(sweep) > 0 {
+		bounds := strings.Split(sweep, ":")
+		if len(bounds) != 2 {
+			printUsage()
+			Check(fmt.Errorf("Error, -sweep needs to be given as Min:Max"))
+		}
+		min, err := ParseSize(bounds[0])
+		Check(err)
+		max, err := ParseSize(bounds[1])
+		Check(err)
+		if max > MaxSweepSize {
+			Check(fmt.Errorf("Error, the server sweeps up to %d bytes", MaxSweepSize))
+		}
+		sweepSizes, err = SweepSizes(min, max, sweepFactor)
+		Check(err)
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+	}
+
 	// Create SCION UDP socket
 	if len(clientCCAddrStr) > 0 {
 		clientCCAddr, err = snet.AddrFromString(clientCCAddrStr)
@@ -212,6 +399,21 @@ func main() {
 		printUsage()
 		Check(fmt.Errorf("Error, server address needs to be specified with -s"))
 	}
+	if len(serverPubFile) > 0 {
+		pub, err := keys.LoadPublicKey(serverPubFile)
+		Check(err)
+		fingerprint, err := keys.Fingerprint(pub)
+		Check(err)
+		if len(serverKey) > 0 && serverKey != fingerprint {
+			Check(fmt.Errorf("Error, the key in %s has the fingerprint %s, not -server_key", serverPubFile, fingerprint))
+		}
+		serverKey = fingerprint
+	}
+	var knownServers *KnownServers
+	knownServers, err = LoadKnownServers(knownServersPath)
+	Check(err)
+	verifier, err = NewServerVerifier(knownServers, serverCCAddrStr, serverKey)
+	Check(err)
 
 	if sciondFromIA {
 		if sciondPath != "" {
@@ -267,6 +469,9 @@ func main() {
 	CCConn, err = <To be completed>
 	Check(err)
 
+	time.AfterFunc(timeout, func() {
+		LogFatal("No result from the server", "timeout", timeout)
+	})
 	go Send(CCConn)
 	Read(CCConn)
 }
@@ -284,34 +489,52 @@ func Send(CCConn *snet.Conn) {
 	 */
 	msgStr := <To be completed>
 
-	sendPacketBuffer:=[]byte(msgStr)
+	// Ask for the algorithms, the server replies with a measurement per operation.
+	// Old servers take the whole request as the message and reply with an AppMessage.
+	req := &BenchRequest{Algorithms: ParseAlgorithms(algs), Message: []byte(msgStr),
+		Sizes: sweepSizes, Seed: seed, Workers: workers, ID: requestID}
+	sendPacketBuffer, err := EncodeRequest(req)
+	Check(err)
 
-	var MaxTries int64 = 5
-	var numtries int64 = 0
-	for numtries < MaxTries {
-        /*
-         * Task 4: Send the above message to the server; the server address is
-         *         specified by the serverCCAddr variable.
-         *
-         *  HINT: Use the func WriteToSCION
-         */
-		_, err := <To be completed>
-		if err != nil {
-			// Check(err)
-			numtries++
-			fmt.Println("Retrying")
-			continue
+	// The request is repeated until the result arrives and Read ends the program,
+	// the server benchmarks a request id only once.
+	backoff := retransmitInterval
+	for {
+		var MaxTries int64 = 5
+		var numtries int64 = 0
+		for numtries < MaxTries {
+		/*
+		 * Task 4: Send the above message to the server; the server address is
+		 *         specified by the serverCCAddr variable.
+		 *
+		 *  HINT: Use the func WriteToSCION
+		 */
+			_, err := <To be completed>
+			if err != nil {
+				// Check(err)
+				numtries++
+				fmt.Println("Retrying")
+				continue
+			}
+
+			if numtries == MaxTries && err != nil {
+				Check(err)
+			}
+			break
 		}
 
-		if numtries == MaxTries && err != nil {
-			Check(err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxRetransmitInterval {
+			backoff = maxRetransmitInterval
 		}
-		break
+		log.Debug("Retransmitting request", "id", requestID)
 	}
 }
 
 func Read(CCConn *snet.Conn) {
 	receivePacketBuffer := make([]byte, 2500)
+	assembler := NewResultAssembler()
+	var lastStatus JobStatus
 
 	for {
         /*
@@ -328,6 +551,47 @@ func Read(CCConn *snet.Conn) {
 			serverCCAddrStr := serverCCAddr.String()
 			fmt.Println("Received response:", serverCCAddrStr)
 
+			reply, sig, err := DecodeReply(receivePacketBuffer[:n])
+			if err == errNotReply {
+				if !allowUnsigned {
+					log.Error("Unsigned reply, the server is too old to sign, see -allow_unsigned")
+					continue
+				}
+			} else if err != nil {
+				log.Error("Invalid reply", "err", err)
+				continue
+			} else if err = verifier.Verify(sig); err != nil {
+				if _, changed := err.(*KeyChangedError); changed {
+					LogFatal("The server key changed, someone may pretend to be the server", "err", err)
+				}
+				log.Error("Reply not signed by the server, ignored", "err", err)
+				continue
+			}
+			switch reply := reply.(type) {
+			case *JobStatus:
+				// Each retransmission is answered, only print changes
+				if reply.ID == requestID && *reply != lastStatus {
+					printStatus(reply)
+					lastStatus = *reply
+				}
+				continue
+			case *ResultPart:
+				if reply.ID != requestID {
+					continue
+				}
+				if measurements, ok := assembler.Add(reply); ok {
+					if len(sweepSizes) > 0 {
+						printSweep(measurements)
+					} else if workers > 1 {
+						printScaling(measurements)
+					} else {
+						printResults(measurements)
+					}
+					return
+				}
+				continue
+			}
+
 			// Parse the response from the server
 			data := AppMessage{}
 			err = binary.Read(bytes.NewReader(receivePacketBuffer), binary.BigEndian, &data)
@@ -344,6 +608,14 @@ func Read(CCConn *snet.Conn) {
 			fmt.Printf("Sig Computation (RSA)     : %.2f\tus per operation (Averaged over %v runs)\n",
 						float64(data.SigTime.Nanoseconds()/1000)/float64(data.NumSigCompute),
 						data.NumSigCompute)
+			if data.MacVerifyTime > 0 || data.SigVerifyTime > 0 {
+				fmt.Printf("MAC Verification (AES-CMAC): %.2f\tus per operation (Averaged over %v runs)\n",
+							float64(data.MacVerifyTime.Nanoseconds()/1000)/float64(data.NumMacCompute),
+							data.NumMacCompute)
+				fmt.Printf("Sig Verification (RSA)     : %.2f\tus per operation (Averaged over %v runs)\n",
+							float64(data.SigVerifyTime.Nanoseconds()/1000)/float64(data.NumSigCompute),
+							data.NumSigCompute)
+			}
 			break
 		}
 	}
@@ -0,0 +1,350 @@
+// Queue of benchmark requests of the server
+// Build together with the server: go run server.go mac_sig_api.go algorithms.go jobs.go
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+/*
+ * Results are kept for clients that ask again because they lost them, at
+ * most maxKeptResults for at most keepResults. Rejected jobs count as well.
+ */
+const (
+	keepResults    = 10 * time.Minute
+	maxKeptResults = 256
+)
+
+/*
+ * A kept result is sent again at most maxResends times per job and at most
+ * once per resendInterval, the client's first retransmit interval. Results
+ * are large, repeated requests must not turn the server into an amplifier.
+ */
+const (
+	maxResends     = 3
+	resendInterval = time.Second
+)
+
+/*
+ * Datagrams a client may send per second and at once, the client
+ * retransmits about once a second. Beyond that its datagrams are dropped
+ * before anything is signed for them.
+ */
+const (
+	requestRate  = 2
+	requestBurst = 5
+	/* Buckets kept before the full ones are dropped */
+	maxBuckets = 4096
+)
+
+/*
+ * A request waiting for, being or done benchmarked
+ *
+ *	- Client: where the status and the result go
+ *	- Legacy: the request of an old client, it gets an AppMessage
+ */
+type Job struct {
+	Request *BenchRequest
+	Client  *snet.Addr
+	Legacy  bool
+
+	state   uint8
+	result  [][]byte
+	done    time.Time
+	reason  string /* Why a done job has no result */
+	resends int
+	resent  time.Time
+
+	/* The last status sent, signed once for all clients asking again */
+	statusMu     sync.Mutex
+	signedStatus []byte
+	signedFor    JobStatus
+}
+
+/*
+ * Clients are counted by host, a client that restarts gets a new port
+ */
+func clientKey(client *snet.Addr) string {
+	return fmt.Sprintf("%s,[%v]", client.IA, client.Host)
+}
+
+func (job *Job) clientKey() string {
+	return clientKey(job.Client)
+}
+
+/*
+ * The signed status of the job, signed again only when it changed
+ */
+func (job *Job) signStatus(status *JobStatus, signer *ReplySigner) ([]byte, error) {
+	job.statusMu.Lock()
+	defer job.statusMu.Unlock()
+	if job.signedStatus != nil && job.signedFor == *status {
+		return job.signedStatus, nil
+	}
+	datagram, err := EncodeStatus(status, signer)
+	if err != nil {
+		return nil, err
+	}
+	job.signedStatus, job.signedFor = datagram, *status
+	return datagram, nil
+}
+
+/*
+ * Token buckets per client, each refills at requestRate datagrams per
+ * second up to requestBurst. Not safe for concurrent use.
+ */
+type ClientLimiter struct {
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewClientLimiter() *ClientLimiter {
+	return &ClientLimiter{buckets: make(map[string]*bucket)}
+}
+
+/* Takes a token from the bucket of the client if there is one */
+func (l *ClientLimiter) Allow(client *snet.Addr, now time.Time) bool {
+	key := clientKey(client)
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.prune(now)
+		}
+		b = &bucket{tokens: requestBurst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * requestRate
+	if b.tokens > requestBurst {
+		b.tokens = requestBurst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+/* Forgets buckets that refilled completely, they start out full anyway */
+func (l *ClientLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*requestRate >= requestBurst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+/* Identifies the request of a client */
+func (job *Job) key() string {
+	return fmt.Sprintf("%s/%d", job.clientKey(), job.Request.ID)
+}
+
+/*
+ * Runs jobs in arrival order, at most maxRunning at the same time. At most
+ * maxQueued jobs wait, and a client has at most perClient jobs queued or
+ * running, anything beyond that is rejected. Rejected jobs are kept like
+ * done ones, so a client asking again gets the same signed status.
+ *
+ * A request that arrives again, because the client did not hear back, is
+ * not run again. The client gets the status or the kept result instead.
+ */
+type JobQueue struct {
+	mu         sync.Mutex
+	queue      []*Job
+	running    int
+	perClient  map[string]int
+	known      map[string]*Job
+	maxRunning int
+	maxQueued  int
+	maxClient  int
+
+	/* Benchmarks a job and sends the result, returns what it sent */
+	run func(job *Job) [][]byte
+	/* Tells the client of a queued job that it started */
+	started func(job *Job)
+}
+
+func NewJobQueue(maxRunning, maxQueued, maxClient int, run func(job *Job) [][]byte,
+	started func(job *Job)) *JobQueue {
+	return &JobQueue{perClient: make(map[string]int), known: make(map[string]*Job),
+		maxRunning: maxRunning, maxQueued: maxQueued, maxClient: maxClient, run: run,
+		started: started}
+}
+
+/*
+ * Adds a job, it starts right away if fewer than maxRunning jobs run
+ *
+ *	Output:
+ *		- known: the job the status is of, an earlier one if the request
+ *		  arrived before
+ *		- status: running, queued at a position, or rejected with a reason
+ *		- result: the kept result if the request was already benchmarked,
+ *		  status is nil then. Both are nil if the result was sent again
+ *		  too often or too recently, the request is dropped.
+ */
+func (q *JobQueue) Submit(job *Job) (*Job, *JobStatus, [][]byte) {
+	status := &JobStatus{ID: job.Request.ID}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.forget()
+	if known, ok := q.known[job.key()]; ok && !job.Legacy {
+		status := q.status(known)
+		if status != nil {
+			return known, status, nil
+		}
+		if known.resends >= maxResends || time.Since(known.resent) < resendInterval {
+			return known, nil, nil
+		}
+		known.resends++
+		known.resent = time.Now()
+		return known, nil, known.result
+	}
+
+	key := job.clientKey()
+	switch {
+	case q.perClient[key] >= q.maxClient:
+		return job, q.reject(job, fmt.Sprintf("at most %d requests per client", q.maxClient)), nil
+	case q.running < q.maxRunning && len(q.queue) == 0:
+		q.perClient[key]++
+		q.running++
+		status.State = StateRunning
+		q.remember(job, StateRunning)
+		go q.execute(job)
+	case len(q.queue) >= q.maxQueued:
+		return job, q.reject(job, fmt.Sprintf("queue full, %d requests waiting", len(q.queue))), nil
+	default:
+		q.perClient[key]++
+		q.queue = append(q.queue, job)
+		status.State = StateQueued
+		status.Position = len(q.queue)
+		q.remember(job, StateQueued)
+	}
+	return job, status, nil
+}
+
+/*
+ * Rejects a job without running it, e.g. one whose benchmarks take too
+ * long. A job known already keeps its status.
+ *
+ *	Output:
+ *		- known: the job the status is of, as for Submit
+ *		- status: the status of the known job, nil if its result is kept
+ */
+func (q *JobQueue) Reject(job *Job, reason string) (*Job, *JobStatus) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.forget()
+	if known, ok := q.known[job.key()]; ok && !job.Legacy {
+		return known, q.status(known)
+	}
+	return job, q.reject(job, reason)
+}
+
+/* Keeps job as done without a result, q.mu must be held */
+func (q *JobQueue) reject(job *Job, reason string) *JobStatus {
+	job.done = time.Now()
+	job.reason = reason
+	q.remember(job, StateRejected)
+	return &JobStatus{ID: job.Request.ID, State: StateRejected, Reason: reason}
+}
+
+/*
+ * Status of a job that is already known, nil if its result is kept. Jobs
+ * that were rejected or whose benchmark failed have no result.
+ */
+func (q *JobQueue) status(job *Job) *JobStatus {
+	status := &JobStatus{ID: job.Request.ID, State: job.state}
+	switch {
+	case job.state == StateQueued:
+		for i, queued := range q.queue {
+			if queued == job {
+				status.Position = i + 1
+			}
+		}
+	case !job.done.IsZero() && job.result != nil:
+		return nil
+	case !job.done.IsZero():
+		status.State = StateRejected
+		status.Reason = job.reason
+	}
+	return status
+}
+
+func (q *JobQueue) remember(job *Job, state uint8) {
+	job.state = state
+	if !job.Legacy {
+		q.known[job.key()] = job
+	}
+}
+
+/* Drops the oldest done jobs, once there are too many or they are too old */
+func (q *JobQueue) forget() {
+	var oldest *Job
+	done := 0
+	for key, job := range q.known {
+		if job.done.IsZero() {
+			continue
+		}
+		if time.Since(job.done) > keepResults {
+			delete(q.known, key)
+			continue
+		}
+		done++
+		if oldest == nil || job.done.Before(oldest.done) {
+			oldest = job
+		}
+	}
+	if done >= maxKeptResults {
+		delete(q.known, oldest.key())
+	}
+}
+
+/* Runs a job and then the queued ones, as long as there are any */
+func (q *JobQueue) execute(job *Job) {
+	for job != nil {
+		result := q.run(job)
+		job = q.finish(job, result)
+		if job != nil {
+			q.started(job)
+		}
+	}
+}
+
+/*
+ * Keeps the result of a finished job and takes the next one off the
+ * queue
+ */
+func (q *JobQueue) finish(job *Job, result [][]byte) *Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job.result = result
+	job.done = time.Now()
+	job.resent = job.done
+	if result == nil {
+		job.reason = "benchmark failed"
+	}
+
+	key := job.clientKey()
+	if q.perClient[key]--; q.perClient[key] <= 0 {
+		delete(q.perClient, key)
+	}
+	if len(q.queue) == 0 {
+		q.running--
+		return nil
+	}
+	next := q.queue[0]
+	q.queue = q.queue[1:]
+	next.state = StateRunning
+	return next
+}
@@ -0,0 +1,196 @@
+// Server keys the client trusts, pinned when the client first talks to a server
+// Build together with the client: go run client.go mac_sig_api.go known_servers.go path_policy.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// Where the pinned keys are kept unless -known_servers says otherwise
+const defaultKnownServers = ".scion-homeworks/known_servers"
+
+/*
+ * Keys of the servers the client talked to. The file has a line per server,
+ * lines starting with # are comments:
+ *
+ *	address signature-algorithm base64(public key)
+ */
+type KnownServers struct {
+	path string
+	keys map[string]*knownKey
+}
+
+type knownKey struct {
+	Alg       uint8
+	PublicKey []byte
+}
+
+/*
+ * Reads the pinned keys, a file that does not exist yet has none
+ *	Input:
+ *		- path: file of the keys, defaultKnownServers in the home directory if empty
+ */
+func LoadKnownServers(path string) (*KnownServers, error) {
+	if len(path) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(home, defaultKnownServers)
+	}
+	known := &KnownServers{path: path, keys: make(map[string]*knownKey)}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return known, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected address, algorithm and key", path, line)
+		}
+		alg, err := ParseSignatureAlgorithm(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		known.keys[fields[0]] = &knownKey{Alg: alg, PublicKey: key}
+	}
+	return known, scanner.Err()
+}
+
+func (k *KnownServers) Lookup(server string) (*knownKey, bool) {
+	key, ok := k.keys[server]
+	return key, ok
+}
+
+// Pins the key of a server, it is appended to the file
+func (k *KnownServers) Pin(server string, alg uint8, publicKey []byte) error {
+	if err := os.MkdirAll(filepath.Dir(k.path), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(k.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = fmt.Fprintf(file, "%s %s %s\n", server, SignatureName(alg),
+		base64.StdEncoding.EncodeToString(publicKey))
+	if err != nil {
+		return err
+	}
+	k.keys[server] = &knownKey{Alg: alg, PublicKey: publicKey}
+	return nil
+}
+
+/*
+ * The server signed with another key than the pinned or expected one,
+ * someone may pretend to be the server
+ */
+type KeyChangedError struct {
+	Server   string
+	Expected string
+	Received string
+}
+
+func (e *KeyChangedError) Error() string {
+	return fmt.Sprintf("Key of %s is %s, expected %s", e.Server, e.Received, e.Expected)
+}
+
+var errUnknownKey = errors.New("Reply without key from a server whose key is not known yet")
+
+/*
+ * Checks that the replies of a server are signed with its key. The first
+ * valid key the server sends is pinned (trust on first use), unless the
+ * user gave the fingerprint of the key to expect.
+ */
+type ServerVerifier struct {
+	server      string
+	known       *KnownServers
+	fingerprint string
+	key         *knownKey
+}
+
+/*
+ * Creates the verifier of the replies of a server
+ *	Input:
+ *		- known: pinned keys
+ *		- server: address of the server as given by the user
+ *		- fingerprint: fingerprint of the expected key, empty to trust on first use
+ */
+func NewServerVerifier(known *KnownServers, server string, fingerprint string) (*ServerVerifier, error) {
+	v := &ServerVerifier{server: server, known: known, fingerprint: fingerprint}
+	if key, ok := known.Lookup(server); ok {
+		if len(fingerprint) > 0 && KeyFingerprint(key.PublicKey) != fingerprint {
+			return nil, &KeyChangedError{Server: server, Expected: fingerprint,
+				Received: KeyFingerprint(key.PublicKey) + " (pinned in " + known.path + ")"}
+		}
+		v.key = key
+	}
+	return v, nil
+}
+
+/*
+ * Checks the signature of a reply, the reply must be ignored unless it
+ * returns nil. A *KeyChangedError means the server has another key than
+ * the trusted one.
+ */
+func (v *ServerVerifier) Verify(sig *ReplySignature) error {
+	if len(sig.PublicKey) == 0 {
+		if v.key == nil {
+			return errUnknownKey
+		}
+		if sig.Alg != v.key.Alg {
+			return fmt.Errorf("Signed with %s, the key is %s", SignatureName(sig.Alg),
+				SignatureName(v.key.Alg))
+		}
+		return sig.Verify(v.key.PublicKey)
+	}
+
+	// Only a key the reply is signed with can change the trusted one
+	if err := sig.Verify(sig.PublicKey); err != nil {
+		return err
+	}
+	if v.key != nil {
+		if !bytes.Equal(sig.PublicKey, v.key.PublicKey) {
+			return &KeyChangedError{Server: v.server, Expected: KeyFingerprint(v.key.PublicKey),
+				Received: KeyFingerprint(sig.PublicKey)}
+		}
+		return nil
+	}
+	if len(v.fingerprint) > 0 && KeyFingerprint(sig.PublicKey) != v.fingerprint {
+		return &KeyChangedError{Server: v.server, Expected: v.fingerprint,
+			Received: KeyFingerprint(sig.PublicKey)}
+	}
+
+	v.key = &knownKey{Alg: sig.Alg, PublicKey: append([]byte(nil), sig.PublicKey...)}
+	fmt.Printf("Pinned %s key %s of %s\n", SignatureName(sig.Alg), KeyFingerprint(sig.PublicKey), v.server)
+	if err := v.known.Pin(v.server, sig.Alg, v.key.PublicKey); err != nil {
+		// The key is trusted for this run nevertheless
+		log.Error("Unable to pin the server key", "file", v.known.path, "err", err)
+	}
+	return nil
+}
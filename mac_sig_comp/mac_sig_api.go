@@ -0,0 +1,951 @@
+// Messages and algorithm registry shared by the client and the server
+// Build together with the program, e.g. go run client.go mac_sig_api.go known_servers.go path_policy.go
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	KindMAC uint8 = 1
+	KindSig uint8 = 2
+
+	/* Requests start with the magic and the version, anything else is a
+	 * plain message of an old client that gets the AppMessage reply */
+	messageMagic  = "MSC"
+	wireVersion   = 1
+	maxAlgorithms = 32
+
+	/* Limits of a message size sweep */
+	maxSweepSizes = 32
+	MaxSweepSize  = 4 << 20
+)
+
+// Benchmarked when the client does not ask for anything else
+var DefaultAlgorithms = []string{"aes-cmac", "rsa-pss-2048"}
+
+/*
+ * A keyed MAC or signature operation ready to be timed. Implementations
+ * must be safe for concurrent use.
+ *
+ *	- Compute: creates the tag or signature of the message
+ *	- Verify: checks a tag or signature created by Compute, MACs are
+ *	  recomputed and compared in constant time
+ */
+type Operation interface {
+	Compute(message []byte) ([]byte, error)
+	Verify(message, tag []byte) error
+}
+
+/*
+ * An algorithm the server can benchmark
+ *
+ *	- Name: what clients ask for, e.g. "ecdsa-p256"
+ *	- Kind: KindMAC or KindSig
+ *	- KeyBits: size of the key, for the report
+ *	- Iterations: how often Compute and Verify are timed per request
+ *	- Cost: rough time of one Compute and one Verify of a short message,
+ *	  the server estimates the time of a request with it
+ *	- Setup: creates the key, called once on first use
+ */
+type Algorithm struct {
+	Name       string
+	Kind       uint8
+	KeyBits    int
+	Iterations int
+	Cost       time.Duration
+	Setup      func() (Operation, error)
+}
+
+var algorithms = make(map[string]*Algorithm)
+
+// Makes an algorithm available by its name. Names are unique.
+func RegisterAlgorithm(alg *Algorithm) {
+	if _, ok := algorithms[alg.Name]; ok {
+		panic("algorithm registered twice: " + alg.Name)
+	}
+	algorithms[alg.Name] = alg
+}
+
+func LookupAlgorithm(name string) (*Algorithm, bool) {
+	alg, ok := algorithms[name]
+	return alg, ok
+}
+
+// Names of all registered algorithms, MACs first
+func AlgorithmNames() []string {
+	var names []string
+	for name := range algorithms {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := algorithms[names[i]], algorithms[names[j]]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Name < b.Name
+	})
+	return names
+}
+
+func KindName(kind uint8) string {
+	switch kind {
+	case KindMAC:
+		return "MAC"
+	case KindSig:
+		return "Sig"
+	}
+	return "?"
+}
+
+/*
+ * A benchmark request: the algorithms to time and the input message
+ *
+ *	"MSC" | version | #algorithms | (len | name)* | #options | option* | message
+ *	option: tag | length | value
+ *
+ * All options are optional, the server skips options it does not know:
+ *	- sizes, size (4)*: the server sweeps over messages of these sizes
+ *	  instead of using the message, generated from the seed (see SweepMessage)
+ *	- seed (8): seed of the sweep messages
+ *	- workers (1): the server also runs every algorithm on 2, 4, ... up to
+ *	  that many goroutines to show how throughput scales
+ *	- request id (4): carried by the replies, the server picks one if missing
+ */
+type BenchRequest struct {
+	ID         uint32
+	Algorithms []string
+	Message    []byte
+	Sizes      []int
+	Seed       int64
+	Workers    int
+}
+
+func EncodeRequest(req *BenchRequest) ([]byte, error) {
+	if len(req.Algorithms) > maxAlgorithms {
+		return nil, fmt.Errorf("At most %d algorithms per request", maxAlgorithms)
+	}
+	if len(req.Sizes) > maxSweepSizes {
+		return nil, fmt.Errorf("At most %d message sizes per request", maxSweepSizes)
+	}
+	buf := bytes.NewBufferString(messageMagic)
+	buf.WriteByte(wireVersion)
+	buf.WriteByte(uint8(len(req.Algorithms)))
+	for _, name := range req.Algorithms {
+		if len(name) == 0 || len(name) > 255 {
+			return nil, fmt.Errorf("Invalid algorithm name %q", name)
+		}
+		buf.WriteByte(uint8(len(name)))
+		buf.WriteString(name)
+	}
+	if req.Workers < 0 || req.Workers > 255 {
+		return nil, fmt.Errorf("Invalid number of workers %d", req.Workers)
+	}
+
+	options := new(bytes.Buffer)
+	count := 0
+	if len(req.Sizes) > 0 {
+		sizes := new(bytes.Buffer)
+		for _, size := range req.Sizes {
+			if size < 0 || size > MaxSweepSize {
+				return nil, fmt.Errorf("Message size %d not within [0, %d]", size, MaxSweepSize)
+			}
+			binary.Write(sizes, binary.BigEndian, uint32(size))
+		}
+		writeField(options, optionSizes, sizes.Bytes())
+		writeUintField(options, optionSeed, uint64(req.Seed), 8)
+		count += 2
+	}
+	if req.Workers > 0 {
+		writeUintField(options, optionWorkers, uint64(req.Workers), 1)
+		count++
+	}
+	if req.ID != 0 {
+		writeUintField(options, optionID, uint64(req.ID), 4)
+		count++
+	}
+	buf.WriteByte(uint8(count))
+	buf.Write(options.Bytes())
+	buf.Write(req.Message)
+	return buf.Bytes(), nil
+}
+
+// Tags of the request options
+const (
+	optionSizes uint8 = iota + 1
+	optionSeed
+	optionWorkers
+	optionID
+)
+
+/*
+ * Parses a request. Messages of old clients do not start with the magic,
+ * they are returned as a request for the default algorithms with legacy set.
+ */
+func DecodeRequest(b []byte) (req *BenchRequest, legacy bool, err error) {
+	if !bytes.HasPrefix(b, []byte(messageMagic)) {
+		return &BenchRequest{Algorithms: DefaultAlgorithms, Message: b}, true, nil
+	}
+	b = b[len(messageMagic):]
+	if len(b) < 2 {
+		return nil, false, fmt.Errorf("Request too short")
+	}
+	if b[0] != wireVersion {
+		return nil, false, fmt.Errorf("Unsupported request version %d", b[0])
+	}
+	num := int(b[1])
+	b = b[2:]
+	req = &BenchRequest{}
+	for i := 0; i < num; i++ {
+		if len(b) < 1 || len(b) < 1+int(b[0]) {
+			return nil, false, fmt.Errorf("Request too short")
+		}
+		req.Algorithms = append(req.Algorithms, string(b[1:1+b[0]]))
+		b = b[1+b[0]:]
+	}
+	if len(req.Algorithms) == 0 {
+		req.Algorithms = DefaultAlgorithms
+	}
+
+	if len(b) < 1 {
+		return nil, false, fmt.Errorf("Request too short")
+	}
+	num, b = int(b[0]), b[1:]
+	for i := 0; i < num; i++ {
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return nil, false, fmt.Errorf("Request option truncated")
+		}
+		tag, value := b[0], b[2:2+b[1]]
+		b = b[2+b[1]:]
+		if tag != optionSizes && len(value) > 8 {
+			return nil, false, fmt.Errorf("Request option %d too long", tag)
+		}
+		switch tag {
+		case optionSizes:
+			if len(value)%4 != 0 || len(value)/4 > maxSweepSizes {
+				return nil, false, fmt.Errorf("Invalid message sizes")
+			}
+			req.Sizes = nil
+			for ; len(value) > 0; value = value[4:] {
+				size := int(binary.BigEndian.Uint32(value))
+				if size > MaxSweepSize {
+					return nil, false, fmt.Errorf("Message size %d above %d", size, MaxSweepSize)
+				}
+				req.Sizes = append(req.Sizes, size)
+			}
+		case optionSeed:
+			req.Seed = int64(uintValue(value))
+		case optionWorkers:
+			v := uintValue(value)
+			if v > 255 {
+				return nil, false, fmt.Errorf("Invalid number of workers %d", v)
+			}
+			req.Workers = int(v)
+		case optionID:
+			req.ID = uint32(uintValue(value))
+		}
+	}
+	req.Message = b
+	return req, false, nil
+}
+
+/*
+ * Message of a sweep. All sizes are prefixes of the same pseudo random
+ * bytes, so the client only sends the seed.
+ */
+func SweepMessage(seed int64, size int) []byte {
+	message := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(message)
+	return message
+}
+
+/*
+ * Sizes from min to max, each factor times the one before. Max is always
+ * included.
+ */
+func SweepSizes(min, max, factor int) ([]int, error) {
+	if min < 1 || max < min || factor < 2 {
+		return nil, fmt.Errorf("Invalid sweep from %d to %d by %d", min, max, factor)
+	}
+	var sizes []int
+	for size := min; size < max; size *= factor {
+		sizes = append(sizes, size)
+	}
+	sizes = append(sizes, max)
+	if len(sizes) > maxSweepSizes {
+		return nil, fmt.Errorf("Sweep has %d sizes, at most %d are allowed", len(sizes), maxSweepSizes)
+	}
+	return sizes, nil
+}
+
+/*
+ * Parses a size in bytes with an optional K or M suffix, e.g. "64K"
+ */
+func ParseSize(s string) (int, error) {
+	digits := strings.ToUpper(strings.TrimSpace(s))
+	unit := 1
+	if strings.HasSuffix(digits, "K") {
+		unit, digits = 1<<10, strings.TrimSuffix(digits, "K")
+	} else if strings.HasSuffix(digits, "M") {
+		unit, digits = 1<<20, strings.TrimSuffix(digits, "M")
+	}
+	n, err := strconv.Atoi(digits)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid size %q", s)
+	}
+	return n * unit, nil
+}
+
+const (
+	OpCompute uint8 = 1
+	OpVerify  uint8 = 2
+)
+
+// Name of an operation of an algorithm kind, e.g. "sign"
+func OperationName(kind, op uint8) string {
+	switch {
+	case kind == KindMAC && op == OpCompute:
+		return "mac"
+	case kind == KindMAC && op == OpVerify:
+		return "mac-verify"
+	case kind == KindSig && op == OpCompute:
+		return "sign"
+	case op == OpCompute:
+		return "compute"
+	case op == OpVerify:
+		return "verify"
+	}
+	return "?"
+}
+
+/*
+ * Timing of one operation of an algorithm, Error is set instead if it
+ * could not be run
+ *
+ *	- Total: all Iterations together, summed over the workers
+ *	- Min, Max: fastest and slowest operation. Cheap operations are
+ *	  timed in batches, so these are averages over a batch for them.
+ *	- Workers: goroutines that shared the Iterations
+ *	- Wall: time from starting the first worker to the end of the last
+ */
+type Measurement struct {
+	Algorithm   string
+	Operation   uint8
+	Kind        uint8
+	KeyBits     int
+	MessageSize int
+	Iterations  int
+	Total       time.Duration
+	Min         time.Duration
+	Max         time.Duration
+	Workers     int
+	Wall        time.Duration
+	Error       string
+}
+
+// Average time of one operation
+func (m *Measurement) PerOp() time.Duration {
+	if m.Iterations == 0 {
+		return 0
+	}
+	return m.Total / time.Duration(m.Iterations)
+}
+
+// Operations per second of all workers together
+func (m *Measurement) Throughput() float64 {
+	if m.Wall <= 0 {
+		return 0
+	}
+	return float64(m.Iterations) / m.Wall.Seconds()
+}
+
+/*
+ * Replies to a request, network byte order:
+ *
+ *	"MSC" | version | type | request id (4) | signature algorithm |
+ *		key len (2) | public key | signature len (2) | signature | body
+ *
+ * The server signs every reply with its key, the signature covers all of
+ * the reply except for the signature and its length. The public key (PKIX,
+ * DER) is sent in every status and in the first part of every result, it
+ * is left out of the other parts to save space.
+ *
+ * A status tells the client what happens to its request, it is sent when
+ * the request arrives and when it starts running:
+ *
+ *	state | queue position (2) | len | reason
+ *
+ * The result is sent as one or more datagrams once the request is done:
+ *
+ *	part | #parts | measurement*
+ *	measurement: length (2) | field*
+ *	field: tag | length | value
+ *
+ * Integers are sent with as many bytes as the field length says. Decoders
+ * skip fields they do not know, so fields can be added without a new
+ * version. Old clients that send a plain message get the AppMessage
+ * struct instead, it is not signed.
+ */
+const (
+	replyStatus uint8 = 1
+	replyResult uint8 = 2
+
+	/* Results are split to stay below the smallest SCION MTU */
+	maxResultDatagram = 1000
+	replyHeaderLen    = len(messageMagic) + 6
+	resultHeaderLen   = replyHeaderLen + 2
+	/* Left for measurements in the first part, next to the signing key */
+	minResultSpace = 256
+)
+
+const (
+	StateQueued uint8 = iota + 1
+	StateRunning
+	StateRejected
+)
+
+// What the server does with a request, Position counts from 1
+type JobStatus struct {
+	ID       uint32
+	State    uint8
+	Position int
+	Reason   string
+}
+
+func EncodeStatus(status *JobStatus, signer *ReplySigner) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(status.State)
+	binary.Write(buf, binary.BigEndian, uint16(status.Position))
+	reason := status.Reason
+	if len(reason) > 255 {
+		reason = reason[:255]
+	}
+	buf.WriteByte(uint8(len(reason)))
+	buf.WriteString(reason)
+	return signer.seal(replyHeader(replyStatus, status.ID), buf.Bytes(), true)
+}
+
+func replyHeader(kind uint8, id uint32) []byte {
+	buf := bytes.NewBufferString(messageMagic)
+	buf.WriteByte(wireVersion)
+	buf.WriteByte(kind)
+	binary.Write(buf, binary.BigEndian, id)
+	return buf.Bytes()
+}
+
+const (
+	fieldAlgorithm uint8 = iota + 1
+	fieldOperation
+	fieldKind
+	fieldKeyBits
+	fieldMessageSize
+	fieldIterations
+	fieldTotal
+	fieldMin
+	fieldMax
+	fieldError
+	fieldWorkers
+	fieldWall
+)
+
+// One datagram of a result
+type ResultPart struct {
+	ID           uint32
+	Part         int
+	Parts        int
+	Measurements []*Measurement
+}
+
+/*
+ * Encodes the measurements of a result into as many signed datagrams as
+ * needed, each at most maxResultDatagram bytes
+ */
+func EncodeResult(id uint32, measurements []*Measurement, signer *ReplySigner) ([][]byte, error) {
+	var bodies [][]byte
+	var body []byte
+	/* The first part carries the public key, it has the least space */
+	space := maxResultDatagram - resultHeaderLen - signer.overhead(true)
+	for _, m := range measurements {
+		entry := encodeMeasurement(m)
+		if len(entry) > maxResultDatagram-resultHeaderLen-signer.overhead(true) {
+			return nil, fmt.Errorf("Measurement of %s too large", m.Algorithm)
+		}
+		if len(body)+len(entry) > space {
+			bodies = append(bodies, body)
+			body = nil
+			space = maxResultDatagram - resultHeaderLen - signer.overhead(false)
+		}
+		body = append(body, entry...)
+	}
+	bodies = append(bodies, body)
+	if len(bodies) > 255 {
+		return nil, fmt.Errorf("Result too large, %d datagrams", len(bodies))
+	}
+
+	var datagrams [][]byte
+	for i, body := range bodies {
+		body = append([]byte{uint8(i), uint8(len(bodies))}, body...)
+		datagram, err := signer.seal(replyHeader(replyResult, id), body, i == 0)
+		if err != nil {
+			return nil, err
+		}
+		datagrams = append(datagrams, datagram)
+	}
+	return datagrams, nil
+}
+
+func encodeMeasurement(m *Measurement) []byte {
+	fields := new(bytes.Buffer)
+	writeField(fields, fieldAlgorithm, []byte(m.Algorithm))
+	writeUintField(fields, fieldOperation, uint64(m.Operation), 1)
+	writeUintField(fields, fieldKind, uint64(m.Kind), 1)
+	writeUintField(fields, fieldKeyBits, uint64(m.KeyBits), 2)
+	writeUintField(fields, fieldMessageSize, uint64(m.MessageSize), 4)
+	writeUintField(fields, fieldIterations, uint64(m.Iterations), 4)
+	writeUintField(fields, fieldTotal, uint64(m.Total), 8)
+	writeUintField(fields, fieldMin, uint64(m.Min), 8)
+	writeUintField(fields, fieldMax, uint64(m.Max), 8)
+	writeUintField(fields, fieldWorkers, uint64(m.Workers), 1)
+	writeUintField(fields, fieldWall, uint64(m.Wall), 8)
+	if len(m.Error) > 0 {
+		writeField(fields, fieldError, []byte(m.Error))
+	}
+	entry := make([]byte, 2, 2+fields.Len())
+	binary.BigEndian.PutUint16(entry, uint16(fields.Len()))
+	return append(entry, fields.Bytes()...)
+}
+
+func writeField(buf *bytes.Buffer, tag uint8, value []byte) {
+	if len(value) > 255 {
+		value = value[:255]
+	}
+	buf.WriteByte(tag)
+	buf.WriteByte(uint8(len(value)))
+	buf.Write(value)
+}
+
+func writeUintField(buf *bytes.Buffer, tag uint8, v uint64, size int) {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, v)
+	writeField(buf, tag, value[8-size:])
+}
+
+var errNotReply = errors.New("Not a reply message")
+
+/*
+ * Parses a reply, either a *JobStatus or a *ResultPart, and its signature.
+ * The signature still needs to be verified. Datagrams that do not start
+ * with the magic are not replies, e.g. the AppMessage of an old server.
+ */
+func DecodeReply(b []byte) (interface{}, *ReplySignature, error) {
+	if !bytes.HasPrefix(b, []byte(messageMagic)) {
+		return nil, nil, errNotReply
+	}
+	if len(b) < replyHeaderLen {
+		return nil, nil, fmt.Errorf("Reply too short")
+	}
+	if b[len(messageMagic)] != wireVersion {
+		return nil, nil, fmt.Errorf("Unsupported reply version %d", b[len(messageMagic)])
+	}
+	kind := b[len(messageMagic)+1]
+	id := binary.BigEndian.Uint32(b[len(messageMagic)+2:])
+	sig, body, err := decodeSignature(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch kind {
+	case replyStatus:
+		if len(body) < 4 || len(body) < 4+int(body[3]) {
+			return nil, nil, fmt.Errorf("Status too short")
+		}
+		return &JobStatus{ID: id, State: body[0], Position: int(binary.BigEndian.Uint16(body[1:])),
+			Reason: string(body[4 : 4+body[3]])}, sig, nil
+	case replyResult:
+		part, err := decodeResultPart(id, body)
+		return part, sig, err
+	}
+	return nil, nil, fmt.Errorf("Unknown reply type %d", kind)
+}
+
+func decodeResultPart(id uint32, b []byte) (*ResultPart, error) {
+	if len(b) < 2 {
+		return nil, fmt.Errorf("Result too short")
+	}
+	part := &ResultPart{ID: id, Part: int(b[0]), Parts: int(b[1])}
+	if part.Part >= part.Parts {
+		return nil, fmt.Errorf("Invalid result part %d of %d", part.Part, part.Parts)
+	}
+	b = b[2:]
+	for len(b) > 0 {
+		if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b)) {
+			return nil, fmt.Errorf("Measurement truncated")
+		}
+		n := 2 + int(binary.BigEndian.Uint16(b))
+		m, err := decodeMeasurement(b[2:n])
+		if err != nil {
+			return nil, err
+		}
+		part.Measurements = append(part.Measurements, m)
+		b = b[n:]
+	}
+	return part, nil
+}
+
+func decodeMeasurement(b []byte) (*Measurement, error) {
+	m := &Measurement{}
+	for len(b) > 0 {
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return nil, fmt.Errorf("Measurement field truncated")
+		}
+		tag, value := b[0], b[2:2+b[1]]
+		b = b[2+b[1]:]
+		v := uintValue(value)
+		switch tag {
+		case fieldAlgorithm:
+			m.Algorithm = string(value)
+		case fieldError:
+			m.Error = string(value)
+		case fieldOperation:
+			m.Operation = uint8(v)
+		case fieldKind:
+			m.Kind = uint8(v)
+		case fieldKeyBits:
+			m.KeyBits = int(v)
+		case fieldMessageSize:
+			m.MessageSize = int(v)
+		case fieldIterations:
+			m.Iterations = int(v)
+		case fieldTotal:
+			m.Total = time.Duration(v)
+		case fieldMin:
+			m.Min = time.Duration(v)
+		case fieldMax:
+			m.Max = time.Duration(v)
+		case fieldWorkers:
+			m.Workers = int(v)
+		case fieldWall:
+			m.Wall = time.Duration(v)
+		}
+	}
+	if len(m.Algorithm) == 0 {
+		return nil, fmt.Errorf("Measurement without algorithm")
+	}
+	return m, nil
+}
+
+func uintValue(value []byte) uint64 {
+	var v uint64
+	for _, c := range value {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// Algorithms the server signs its replies with
+const (
+	SigRSAPSS uint8 = iota + 1
+	SigEd25519
+	SigECDSAP256
+)
+
+var signatureNames = map[uint8]string{
+	SigRSAPSS:    "rsa-pss",
+	SigEd25519:   "ed25519",
+	SigECDSAP256: "ecdsa-p256",
+}
+
+func SignatureName(alg uint8) string {
+	if name, ok := signatureNames[alg]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", alg)
+}
+
+func ParseSignatureAlgorithm(name string) (uint8, error) {
+	for alg, n := range signatureNames {
+		if n == name {
+			return alg, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown signature algorithm %q", name)
+}
+
+/*
+ * Signs the replies of the server
+ *
+ *	- Alg: signature algorithm, must match the key
+ *	- Key: private key of the server
+ *	- PublicKey: public key of the server, PKIX DER as sent in the replies
+ */
+type ReplySigner struct {
+	Alg       uint8
+	Key       crypto.Signer
+	PublicKey []byte
+
+	sigLen int
+}
+
+/*
+ * Creates the signer of the replies
+ *	Input:
+ *		- alg: signature algorithm, SigRSAPSS, SigEd25519 or SigECDSAP256
+ *		- key: private key of the server, of the type alg needs
+ */
+func NewReplySigner(alg uint8, key crypto.Signer) (*ReplySigner, error) {
+	if !signatureKeyMatches(alg, key.Public()) {
+		return nil, fmt.Errorf("%s needs another key than %T", SignatureName(alg), key.Public())
+	}
+	s := &ReplySigner{Alg: alg, Key: key}
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		s.sigLen = pub.Size()
+	case ed25519.PublicKey:
+		s.sigLen = ed25519.SignatureSize
+	case *ecdsa.PublicKey:
+		/* ASN.1 sequence of two integers, each at most one byte longer */
+		s.sigLen = 6 + 2*((pub.Curve.Params().BitSize+7)/8+1)
+	}
+
+	var err error
+	s.PublicKey, err = x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	if resultHeaderLen+s.overhead(true)+minResultSpace > maxResultDatagram {
+		return nil, fmt.Errorf("%s key too large to sign replies", SignatureName(alg))
+	}
+	return s, nil
+}
+
+func signatureKeyMatches(alg uint8, pub crypto.PublicKey) bool {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return alg == SigRSAPSS
+	case ed25519.PublicKey:
+		return alg == SigEd25519
+	case *ecdsa.PublicKey:
+		return alg == SigECDSAP256 && pub.Curve == elliptic.P256()
+	}
+	return false
+}
+
+// The signature algorithm a key signs replies with, false if there is none
+func SignatureAlgorithmFor(pub crypto.PublicKey) (uint8, bool) {
+	for alg := range signatureNames {
+		if signatureKeyMatches(alg, pub) {
+			return alg, true
+		}
+	}
+	return 0, false
+}
+
+func (s *ReplySigner) Fingerprint() string {
+	return KeyFingerprint(s.PublicKey)
+}
+
+// Fingerprint of a public key in PKIX DER, shown to and compared by users
+func KeyFingerprint(publicKey []byte) string {
+	sum := sha256.Sum256(publicKey)
+	return "SHA256:" + hex.EncodeToString(sum[:])
+}
+
+/* Bytes the signature block takes at most */
+func (s *ReplySigner) overhead(withKey bool) int {
+	n := 1 + 2 + 2 + s.sigLen
+	if withKey {
+		n += len(s.PublicKey)
+	}
+	return n
+}
+
+/*
+ * Adds the signature block between header and body. The signature covers
+ * all but itself and its length.
+ */
+func (s *ReplySigner) seal(header []byte, body []byte, withKey bool) ([]byte, error) {
+	var key []byte
+	if withKey {
+		key = s.PublicKey
+	}
+	buf := bytes.NewBuffer(append([]byte(nil), header...))
+	buf.WriteByte(s.Alg)
+	binary.Write(buf, binary.BigEndian, uint16(len(key)))
+	buf.Write(key)
+	signed := buf.Len()
+	buf.Write(body)
+
+	sig, err := signReply(s.Alg, s.Key, buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, buf.Len()+2+len(sig))
+	out = append(out, buf.Bytes()[:signed]...)
+	out = append(out, uint8(len(sig)>>8), uint8(len(sig)))
+	out = append(out, sig...)
+	return append(out, body...), nil
+}
+
+func signReply(alg uint8, key crypto.Signer, covered []byte) ([]byte, error) {
+	if alg == SigEd25519 {
+		return key.Sign(crand.Reader, covered, crypto.Hash(0))
+	}
+	digest := sha256.Sum256(covered)
+	if alg == SigRSAPSS {
+		return key.Sign(crand.Reader, digest[:],
+			&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256})
+	}
+	return key.Sign(crand.Reader, digest[:], crypto.SHA256)
+}
+
+/*
+ * Signature of a reply as received, PublicKey is empty in all but the first
+ * part of a result
+ */
+type ReplySignature struct {
+	Alg       uint8
+	PublicKey []byte
+	Signature []byte
+
+	covered []byte
+}
+
+var errBadSignature = errors.New("Signature does not verify")
+
+/*
+ * Checks the signature of a reply
+ *	Input:
+ *		- publicKey: key of the server in PKIX DER, the pinned one or the
+ *		  one the reply came with
+ */
+func (sig *ReplySignature) Verify(publicKey []byte) error {
+	parsed, err := x509.ParsePKIXPublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	if !signatureKeyMatches(sig.Alg, parsed) {
+		return fmt.Errorf("%s signature with a %T key", SignatureName(sig.Alg), parsed)
+	}
+	digest := sha256.Sum256(sig.covered)
+	switch pub := parsed.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPSS(pub, crypto.SHA256, digest[:], sig.Signature,
+			&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256})
+		if err != nil {
+			return errBadSignature
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, sig.covered, sig.Signature) {
+			return errBadSignature
+		}
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest[:], sig.Signature) {
+			return errBadSignature
+		}
+	}
+	return nil
+}
+
+/* Splits the signature block off a reply, returns the body after it */
+func decodeSignature(b []byte) (*ReplySignature, []byte, error) {
+	rest := b[replyHeaderLen:]
+	if len(rest) < 3 {
+		return nil, nil, fmt.Errorf("Reply without signature")
+	}
+	sig := &ReplySignature{Alg: rest[0]}
+	keyLen := int(binary.BigEndian.Uint16(rest[1:]))
+	rest = rest[3:]
+	if len(rest) < keyLen+2 {
+		return nil, nil, fmt.Errorf("Signature block too short")
+	}
+	sig.PublicKey = rest[:keyLen]
+	signed := len(b) - len(rest) + keyLen
+	rest = rest[keyLen:]
+	sigLen := int(binary.BigEndian.Uint16(rest))
+	rest = rest[2:]
+	if len(rest) < sigLen {
+		return nil, nil, fmt.Errorf("Signature block too short")
+	}
+	sig.Signature = rest[:sigLen]
+	body := rest[sigLen:]
+	sig.covered = append(append([]byte(nil), b[:signed]...), body...)
+	return sig, body, nil
+}
+
+/*
+ * Collects the datagrams of results until one is complete. Parts may
+ * arrive in any order, repeated parts are ignored.
+ */
+type ResultAssembler struct {
+	parts map[uint32][]*ResultPart
+}
+
+func NewResultAssembler() *ResultAssembler {
+	return &ResultAssembler{parts: make(map[uint32][]*ResultPart)}
+}
+
+// Adds a part, returns the measurements once all parts of its result are in
+func (a *ResultAssembler) Add(part *ResultPart) ([]*Measurement, bool) {
+	parts, ok := a.parts[part.ID]
+	if !ok || len(parts) != part.Parts {
+		parts = make([]*ResultPart, part.Parts)
+		a.parts[part.ID] = parts
+	}
+	parts[part.Part] = part
+	var measurements []*Measurement
+	for _, p := range parts {
+		if p == nil {
+			return nil, false
+		}
+		measurements = append(measurements, p.Measurements...)
+	}
+	delete(a.parts, part.ID)
+	return measurements, true
+}
+
+// Splits a comma separated list of algorithms
+func ParseAlgorithms(list string) []string {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); len(name) > 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Replaces "all" in a request by every registered algorithm, dropping repeats
+func ExpandAlgorithms(names []string) []string {
+	var expanded []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		list := []string{name}
+		if name == "all" {
+			list = AlgorithmNames()
+		}
+		for _, n := range list {
+			if !seen[n] {
+				seen[n] = true
+				expanded = append(expanded, n)
+			}
+		}
+	}
+	return expanded
+}
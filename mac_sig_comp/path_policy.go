@@ -0,0 +1,203 @@
+// Path selection policies of the client
+// Build together with the client: go run client.go mac_sig_api.go known_servers.go path_policy.go
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/spath/spathmeta"
+)
+
+/*
+ * A path selection policy scores a path by one of its properties. Scores
+ * are normalized to [0,1], larger is better, so the scores of different
+ * policies can be weighted and added. The score is 0.5 for a typical path
+ * and goes from about 0.1 to 0.9 over the range paths usually span.
+ *
+ *	- Name: how users choose the policy with -pathAlgo
+ *	- Description: shown in the usage
+ *	- Score: the score of a path, must not depend on the other paths
+ */
+type PathPolicy struct {
+	Name        string
+	Description string
+	Score       func(path *spathmeta.AppPath) float64
+}
+
+var pathPolicies = make(map[string]*PathPolicy)
+
+// Makes a policy available to -pathAlgo, names are unique
+func RegisterPathPolicy(policy *PathPolicy) {
+	if _, ok := pathPolicies[policy.Name]; ok {
+		panic("path policy registered twice: " + policy.Name)
+	}
+	pathPolicies[policy.Name] = policy
+}
+
+func LookupPathPolicy(name string) (*PathPolicy, bool) {
+	policy, ok := pathPolicies[name]
+	return policy, ok
+}
+
+// Names of the registered policies, sorted
+func PathPolicyNames() []string {
+	var names []string
+	for name := range pathPolicies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterPathPolicy(&PathPolicy{Name: "shortest", Description: "fewer links, 0.5 at 4 links",
+		Score: hopScore})
+	RegisterPathPolicy(&PathPolicy{Name: "mtu", Description: "larger MTU, 0.5 at 1500 bytes",
+		Score: mtuScore})
+	RegisterPathPolicy(&PathPolicy{Name: "expiry", Description: "expires later, 0.5 at one hour",
+		Score: expiryScore})
+}
+
+/* A path lists the interfaces on both ends of every link it crosses */
+func hopScore(path *spathmeta.AppPath) float64 {
+	links := float64(len(path.Entry.Path.Interfaces) / 2)
+	midpoint := 4.0
+	tilt := 1.0
+	return 1 / (1 + math.Exp(tilt*(links-midpoint)))
+}
+
+func mtuScore(path *spathmeta.AppPath) float64 {
+	mtu := float64(path.Entry.Path.Mtu)
+	midpoint := 1500.0
+	tilt := 0.004
+	return 1 / (1 + math.Exp(-tilt*(mtu-midpoint)))
+}
+
+func expiryScore(path *spathmeta.AppPath) float64 {
+	remaining := time.Until(time.Unix(int64(path.Entry.Path.ExpTime), 0)).Hours()
+	if remaining <= 0 {
+		return 0
+	}
+	midpoint := 1.0
+	tilt := 3.0
+	return 1 / (1 + math.Exp(-tilt*(remaining-midpoint)))
+}
+
+// A policy and how much its score counts
+type PathWeight struct {
+	Policy *PathPolicy
+	Weight float64
+}
+
+/*
+ * Parses the policies of -pathAlgo, a comma separated list of policies
+ * with optional weights, e.g. "shortest=2,mtu". Policies without weight
+ * count once. An empty list weights all policies equally.
+ */
+func ParsePathWeights(spec string) ([]PathWeight, error) {
+	var weights []PathWeight
+	if len(strings.TrimSpace(spec)) == 0 {
+		for _, name := range PathPolicyNames() {
+			weights = append(weights, PathWeight{Policy: pathPolicies[name], Weight: 1})
+		}
+		return weights, nil
+	}
+
+	total := 0.0
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(spec, ",") {
+		name, weight := strings.TrimSpace(item), 1.0
+		if i := strings.Index(name, "="); i >= 0 {
+			w, err := strconv.ParseFloat(strings.TrimSpace(name[i+1:]), 64)
+			name = strings.TrimSpace(name[:i])
+			if err != nil || w < 0 || math.IsInf(w, 0) {
+				return nil, fmt.Errorf("Invalid weight %q of path policy %s", item, name)
+			}
+			weight = w
+		}
+		policy, ok := LookupPathPolicy(name)
+		if !ok {
+			return nil, fmt.Errorf("Unknown path policy %q, available are %s", name,
+				strings.Join(PathPolicyNames(), ", "))
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("Path policy %s given twice", name)
+		}
+		seen[name] = true
+		weights = append(weights, PathWeight{Policy: policy, Weight: weight})
+		total += weight
+	}
+	if total <= 0 {
+		return nil, fmt.Errorf("At least one path policy needs a weight above 0")
+	}
+	return weights, nil
+}
+
+/*
+ * Scores of a path, Scores has one score per policy in the order of the
+ * weights. Total is their weighted mean, in [0,1] like the scores.
+ */
+type PathScore struct {
+	Path   *spathmeta.AppPath
+	Scores []float64
+	Total  float64
+}
+
+func ScorePaths(paths []*spathmeta.AppPath, weights []PathWeight) []*PathScore {
+	sum := 0.0
+	for _, w := range weights {
+		sum += w.Weight
+	}
+	var scores []*PathScore
+	for _, path := range paths {
+		score := &PathScore{Path: path}
+		for _, w := range weights {
+			s := w.Policy.Score(path)
+			score.Scores = append(score.Scores, s)
+			score.Total += w.Weight * s / sum
+		}
+		scores = append(scores, score)
+	}
+	return scores
+}
+
+// Index of the path with the highest total, the first one of equal paths
+func bestPathScore(scores []*PathScore) int {
+	best := 0
+	for i, score := range scores {
+		if score.Total > scores[best].Total {
+			best = i
+		}
+	}
+	return best
+}
+
+// Prints the score of every policy and the total per path, marks the selected path
+func printPathScores(scores []*PathScore, weights []PathWeight, selected int) {
+	var policies []string
+	for _, w := range weights {
+		policies = append(policies, fmt.Sprintf("%s x%g", w.Policy.Name, w.Weight))
+	}
+	fmt.Printf("Path scores (%s):\n", strings.Join(policies, ", "))
+	fmt.Printf("  %4s", "Path")
+	for _, w := range weights {
+		fmt.Printf(" %10s", w.Policy.Name)
+	}
+	fmt.Printf(" %10s\n", "total")
+	for i, score := range scores {
+		fmt.Printf("  [%2d]", i)
+		for _, s := range score.Scores {
+			fmt.Printf(" %10.3f", s)
+		}
+		fmt.Printf(" %10.3f", score.Total)
+		if i == selected {
+			fmt.Print("  selected")
+		}
+		fmt.Println()
+	}
+}
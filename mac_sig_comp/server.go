@@ -1,10 +1,14 @@
 // A simple server application
+// Run with: go run server.go mac_sig_api.go algorithms.go jobs.go
 package main
 
 import (
 	"bytes"
 	"crypto"
 	"crypto/aes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	_ "crypto/sha256"
@@ -12,28 +16,53 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/inconshreveable/log15"
 	"github.com/kormat/fmt15"
 	"github.com/aead/cmac"
 
+	"github.com/netsec-ethz/scion-homeworks/lib/keys"
+
 	"github.com/scionproto/scion/go/lib/snet"
 	"github.com/scionproto/scion/go/lib/sciond"
 )
 
 // Structure of the message between client and server
+// Only sent to old clients, see EncodeResult for the current format
 type AppMessage struct {
     NumMacCompute uint32
     MacTime time.Duration
 	NumSigCompute uint32
     SigTime time.Duration
+	// Appended for the verification, old clients ignore them
+	MacVerifyTime time.Duration
+	SigVerifyTime time.Duration
 }
 
 func printUsage() {
 	fmt.Println("server -s ServerSCIONAddress")
 	fmt.Println("The SCION address is specified as ISD-AS,[IP Address]:Port")
 	fmt.Println("Example SCION address 17-ffaa:0:1102,[192.33.93.173]:42002")
+	fmt.Println("Clients choose the algorithms to benchmark, available are:")
+	for _, name := range AlgorithmNames() {
+		alg, _ := LookupAlgorithm(name)
+		fmt.Printf("  %-18s %s, %d-bit key, %d iterations\n", name, KindName(alg.Kind), alg.KeyBits, alg.Iterations)
+	}
+	fmt.Println("-jobs limits the requests benchmarked at the same time, -queue the requests waiting")
+	fmt.Println("and -client_jobs the requests of one client, further requests are rejected")
+	fmt.Println("Requests whose benchmarks are estimated to take longer than -max_cost are rejected right away")
+	fmt.Println("Rejected requests get a signed status with the reason, clients sending more than a few")
+	fmt.Println("datagrams a second get no answer")
+	fmt.Println("Replies are signed with -sign_alg: rsa-pss (the RSA-2048 key), ed25519 or ecdsa-p256,")
+	fmt.Println("clients pin the key fingerprint the server prints at startup")
+	fmt.Println("Keys are read from files with -key (RSA-2048), -mac_key (AES-CMAC) and -sign_key (replies),")
+	fmt.Println("in PEM, PKCS#8, PKCS#1, SEC1, raw or, for -mac_key, hex. Without them the server uses the")
+	fmt.Println("RFC 4493 test key for AES-CMAC and generates the others at every start. Create keys with")
+	fmt.Println("  server keygen -type rsa-2048|ecdsa-p256|ed25519|sym -key FILE [-pub FILE]")
 }
 
 func Check(e error) {
@@ -102,6 +131,27 @@ func computeSignature(privKey *rsa.PrivateKey, message []byte) (sig string, err
 	return
 }
 
+/*
+ * Verifies a signature created by computeSignature
+ *
+ *	Input:
+ *		- pubKey: public key of the key pair that signed the message
+ *		- message: input message that is provided by the client
+ *		- sig: signature to check
+ *
+ *	Output:
+ *		- err: nil if the signature is valid
+ */
+func verifySignature(pubKey *rsa.PublicKey, message []byte, sig []byte) (err error) {
+	var opts rsa.PSSOptions
+	opts.SaltLength = rsa.PSSSaltLengthAuto
+	newhash := crypto.SHA256
+	pssh := newhash.New()
+	pssh.Write(message)
+	hashed := pssh.Sum(nil)
+	return rsa.VerifyPSS(pubKey, newhash, hashed, sig, &opts)
+}
+
 var (
 	serverCCAddrStr string
 	serverCCAddr    *snet.Addr
@@ -110,9 +160,22 @@ var (
 	sciondPath      *string
 	sciondFromIA    *bool
 	dispatcherPath  *string
+	maxJobs         *int
+	maxQueued       *int
+	maxClientJobs   *int
+	maxCost         *time.Duration
+	signAlg         *string
+	keyFile         *string
+	macKeyFile      *string
+	signKeyFile     *string
+	replySigner     *ReplySigner
 )
 
 func main() {
+	if keys.IsKeygen(os.Args) {
+		Check(keys.Keygen("server keygen", os.Args[2:], "rsa-2048", "server.pem"))
+		return
+	}
 
 	flag.StringVar(&serverCCAddrStr, "s", "", "Server SCION Address")
 	id := flag.String("id", "server", "Element ID")
@@ -121,8 +184,21 @@ func main() {
 	sciondFromIA = flag.Bool("sciondFromIA", false, "SCIOND socket path from IA address:ISD-AS")
 	dispatcherPath = flag.String("dispatcher", "/run/shm/dispatcher/default.sock",
 		"Path to dispatcher socket")
+	maxJobs = flag.Int("jobs", 1, "Requests benchmarked at the same time")
+	maxQueued = flag.Int("queue", 16, "Requests waiting at most")
+	maxClientJobs = flag.Int("client_jobs", 2, "Requests of a client waiting or running at most")
+	maxCost = flag.Duration("max_cost", time.Minute, "Estimated benchmark time of a request at most")
+	signAlg = flag.String("sign_alg", "rsa-pss", "Algorithm replies are signed with, unless -sign_key is given")
+	keyFile = flag.String("key", "", "File of the RSA-2048 private key, generated if empty")
+	macKeyFile = flag.String("mac_key", "", "File of the AES-CMAC key, the RFC 4493 test key if empty")
+	signKeyFile = flag.String("sign_key", "", "File of the private key replies are signed with")
 	flag.Parse()
 
+	if *maxJobs < 1 || *maxQueued < 0 || *maxClientJobs < 1 {
+		printUsage()
+		LogFatal("Error, -jobs and -client_jobs need to be at least 1 and -queue at least 0")
+	}
+
 	// Setup logging
 	if _, err := os.Stat(*logDir); os.IsNotExist(err) {
 		os.Mkdir(*logDir, 0744)
@@ -146,15 +222,35 @@ func main() {
 					  0x28, 0xae, 0xd2, 0xa6,
 					  0xab, 0xf7, 0x15, 0x88,
 					  0x09, 0xcf, 0x4f, 0x3c}
+	if len(*macKeyFile) > 0 {
+		cmacKey, err = loadMACKey(*macKeyFile)
+		Check(err)
+	}
 
-	/*
-     * Task 1: Generate a 2048-bit random RSA key pair 
-     */
-	privKey, err := <To be completed>
+	var privKey *rsa.PrivateKey
+	if len(*keyFile) > 0 {
+		privKey, err = loadRSAKey(*keyFile)
+		Check(err)
+	} else {
+		/*
+	     * Task 1: Generate a 2048-bit random RSA key pair 
+	     */
+		privKey, err = <To be completed>
+		if err != nil {
+			fmt.Println (err.Error)
+			os.Exit (1)
+		}
+	}
+
+	registerHomeworkAlgorithms(cmacKey, privKey)
+
+	replySigner, err = newReplySigner(*signAlg, *signKeyFile, privKey)
 	if err != nil {
-		fmt.Println (err.Error)
-		os.Exit (1)
+		printUsage()
+		LogFatal("Unable to sign replies", "err", err)
 	}
+	fmt.Println("Replies signed with", SignatureName(replySigner.Alg), "key", replySigner.Fingerprint())
+	log.Info("Reply signing key", "alg", SignatureName(replySigner.Alg), "fingerprint", replySigner.Fingerprint())
 
 	if len(serverCCAddrStr) > 0 {
 		runServer(serverCCAddrStr, cmacKey, privKey)
@@ -168,20 +264,396 @@ func main() {
 	}
 }
 
+/*
+ * Reads the AES-CMAC key, AES takes 16, 24 or 32 bytes
+ */
+func loadMACKey(path string) ([]byte, error) {
+	key, err := keys.LoadSymmetricKey(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = aes.NewCipher(key); err != nil {
+		return nil, fmt.Errorf("%s: not an AES key, %v", path, err)
+	}
+	return key, nil
+}
+
+/*
+ * Reads the RSA key of the homework, the algorithms are benchmarked with
+ * 2048 bits
+ */
+func loadRSAKey(path string) (*rsa.PrivateKey, error) {
+	key, err := keys.LoadPrivateKey(path)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok || rsaKey.N.BitLen() != 2048 {
+		return nil, fmt.Errorf("%s: %s key, RSA-2048 is needed", path, keys.TypeOf(key.Public()))
+	}
+	return rsaKey, nil
+}
+
+/*
+ * Creates the signer of the replies. The key in keyFile signs with the
+ * algorithm its type asks for. Otherwise the RSA key of the homework signs
+ * with RSA-PSS, the other algorithms get a key of their own.
+ *
+ *	Input:
+ *		- name: signature algorithm, see ParseSignatureAlgorithm
+ *		- keyFile: file of the signing key, may be empty
+ *		- privKey: RSA key pair of the homework
+ */
+func newReplySigner(name string, keyFile string, privKey *rsa.PrivateKey) (*ReplySigner, error) {
+	if len(keyFile) > 0 {
+		key, err := keys.LoadPrivateKey(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		alg, ok := SignatureAlgorithmFor(key.Public())
+		if !ok {
+			return nil, fmt.Errorf("%s: %s keys do not sign replies", keyFile, keys.TypeOf(key.Public()))
+		}
+		return NewReplySigner(alg, key)
+	}
+
+	alg, err := ParseSignatureAlgorithm(name)
+	if err != nil {
+		return nil, err
+	}
+	var key crypto.Signer = privKey
+	switch alg {
+	case SigEd25519:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	case SigECDSAP256:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewReplySigner(alg, key)
+}
+
 const numMacCompute = 500000
 const numSigCompute = 5000
 
+/*
+ * Registers the algorithms of the homework, AES-CMAC and RSA-2048, which
+ * use the keys created in main. RSA-2048 is also offered with PKCS #1 v1.5
+ * padding. The other algorithms create their own keys (algorithms.go).
+ */
+func registerHomeworkAlgorithms(cmacKey []byte, privKey *rsa.PrivateKey) {
+	RegisterAlgorithm(&Algorithm{Name: "aes-cmac", Kind: KindMAC, KeyBits: 8 * len(cmacKey),
+		Iterations: numMacCompute, Cost: 2 * time.Microsecond, Setup: func() (Operation, error) {
+			return macOperation(func(message []byte) ([]byte, error) {
+				/*
+				 * Task 4: Compute the CMAC for the client's message
+				 *
+				 *  HINT:
+				 *	 - We have already implemented the function for you;
+				 *     You just need to find it.
+				 */
+				tag, err := <To be completed>
+				return []byte(tag), err
+			}), nil
+		}})
+	RegisterAlgorithm(&Algorithm{Name: "rsa-pss-2048", Kind: KindSig, KeyBits: 2048,
+		Iterations: numSigCompute, Cost: 1500 * time.Microsecond, Setup: func() (Operation, error) {
+			return &operation{
+				compute: func(message []byte) ([]byte, error) {
+					/*
+					 * Task 5: Compute the RSA signature for the client's message
+					 *
+					 *  HINT:
+					 *	 - We have already implemented the function for you;
+					 *	   You just need to find it.
+					 */
+					sig, err := <To be completed>
+					return []byte(sig), err
+				},
+				verify: func(message, sig []byte) error {
+					return verifySignature(&privKey.PublicKey, message, sig)
+				},
+			}, nil
+		}})
+	RegisterAlgorithm(&Algorithm{Name: "rsa-pkcs1v15-2048", Kind: KindSig, KeyBits: 2048,
+		Iterations: numSigCompute, Cost: 1500 * time.Microsecond, Setup: func() (Operation, error) {
+			return rsaOperation(privKey, true), nil
+		}})
+}
+
+var (
+	/* Operations set up so far, keys are created once per algorithm */
+	operations   = make(map[string]Operation)
+	operationsMu sync.Mutex
+)
+
+func getOperation(alg *Algorithm) (Operation, error) {
+	operationsMu.Lock()
+	defer operationsMu.Unlock()
+	if op, ok := operations[alg.Name]; ok {
+		return op, nil
+	}
+	op, err := alg.Setup()
+	if err != nil {
+		return nil, err
+	}
+	operations[alg.Name] = op
+	return op, nil
+}
+
+/*
+ * In a sweep, messages above this size get fewer iterations so that the
+ * time per algorithm and size stays about the same
+ */
+const sweepBaseSize = 1024
+const minSweepIterations = 10
+
+func sweepIterations(iterations int, size int) int {
+	if size > sweepBaseSize {
+		iterations = int(int64(iterations) * sweepBaseSize / int64(size))
+	}
+	if iterations < minSweepIterations {
+		iterations = minSweepIterations
+	}
+	return iterations
+}
+
+/* Hashing a byte for a Compute and a Verify, on top of Algorithm.Cost */
+const costPerByte = 2 * time.Nanosecond
+
+/*
+ * Estimates how long the server is busy with a request, the sum over its
+ * algorithms, messages and worker counts as runJob benchmarks them.
+ * Unknown algorithms cost nothing, they are not run.
+ */
+func requestCost(req *BenchRequest) time.Duration {
+	sweep := len(req.Sizes) > 0
+	sizes := []int{len(req.Message)}
+	if sweep {
+		sizes = req.Sizes
+	}
+	runs := time.Duration(len(workerCounts(req.Workers)))
+
+	var cost time.Duration
+	for _, name := range ExpandAlgorithms(req.Algorithms) {
+		alg, ok := LookupAlgorithm(name)
+		if !ok {
+			continue
+		}
+		for _, size := range sizes {
+			iterations := alg.Iterations
+			if sweep {
+				iterations = sweepIterations(iterations, size)
+			}
+			perOp := alg.Cost + time.Duration(size)*costPerByte
+			cost += time.Duration(iterations) * perOp * runs
+		}
+	}
+	return cost
+}
+
+/*
+ * Times an algorithm on the message, first computing the MAC or signature
+ * and then verifying one of them
+ *
+ *	Input:
+ *		- sweep: the message is one of a sweep, large ones get fewer iterations
+ *		- workers: goroutines that share the iterations
+ *
+ *	Output:
+ *		- measurements: one per operation, or the error that stopped them
+ */
+func benchmark(name string, message []byte, sweep bool, workers int) []*Measurement {
+	alg, ok := LookupAlgorithm(name)
+	if !ok {
+		return []*Measurement{{Algorithm: name, Operation: OpCompute,
+			MessageSize: len(message), Error: "unknown algorithm"}}
+	}
+	measurement := func(operation uint8) *Measurement {
+		return &Measurement{Algorithm: name, Operation: operation, Kind: alg.Kind,
+			KeyBits: alg.KeyBits, MessageSize: len(message), Workers: workers}
+	}
+	compute := measurement(OpCompute)
+	iterations := alg.Iterations
+	if sweep {
+		iterations = sweepIterations(iterations, len(message))
+	}
+	if iterations < workers {
+		iterations = workers
+	}
+
+	op, err := getOperation(alg)
+	if err != nil {
+		compute.Error = err.Error()
+		return []*Measurement{compute}
+	}
+	timeParallel(compute, iterations, workers, func() error {
+		_, err := op.Compute(message)
+		return err
+	})
+	if len(compute.Error) > 0 {
+		return []*Measurement{compute}
+	}
+
+	verify := measurement(OpVerify)
+	tag, err := op.Compute(message)
+	if err != nil {
+		verify.Error = err.Error()
+		return []*Measurement{compute, verify}
+	}
+	timeParallel(verify, iterations, workers, func() error {
+		return op.Verify(message, tag)
+	})
+	return []*Measurement{compute, verify}
+}
+
+/* The clock is read about this often per measurement */
+const timingBatches = 1000
+
+/*
+ * Runs an operation iterations times. Cheap operations are timed in batches
+ * so that reading the clock does not add to their time, Min and Max are the
+ * averages of the fastest and slowest batch.
+ */
+func timeOperation(m *Measurement, iterations int, run func() error) {
+	batch := iterations / timingBatches
+	if batch < 1 {
+		batch = 1
+	}
+	for m.Iterations < iterations {
+		n := batch
+		if iterations-m.Iterations < n {
+			n = iterations - m.Iterations
+		}
+		start := time.Now()
+		for i := 0; i < n; i++ {
+			if err := run(); err != nil {
+				m.Error = err.Error()
+				return
+			}
+		}
+		elapsed := time.Since(start)
+		perOp := elapsed / time.Duration(n)
+		if m.Iterations == 0 || perOp < m.Min {
+			m.Min = perOp
+		}
+		if perOp > m.Max {
+			m.Max = perOp
+		}
+		m.Total += elapsed
+		m.Iterations += n
+	}
+}
+
+/*
+ * Shares the iterations of an operation among workers running at the same
+ * time and adds up their measurements
+ */
+func timeParallel(m *Measurement, iterations int, workers int, run func() error) {
+	parts := make([]*Measurement, workers)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range parts {
+		share := iterations / workers
+		if i < iterations%workers {
+			share++
+		}
+		parts[i] = &Measurement{}
+		wg.Add(1)
+		go func(part *Measurement, share int) {
+			defer wg.Done()
+			timeOperation(part, share, run)
+		}(parts[i], share)
+	}
+	wg.Wait()
+	m.Wall = time.Since(start)
+
+	for _, part := range parts {
+		if len(part.Error) > 0 && len(m.Error) == 0 {
+			m.Error = part.Error
+		}
+		if part.Iterations == 0 {
+			continue
+		}
+		if m.Iterations == 0 || part.Min < m.Min {
+			m.Min = part.Min
+		}
+		if part.Max > m.Max {
+			m.Max = part.Max
+		}
+		m.Total += part.Total
+		m.Iterations += part.Iterations
+	}
+}
+
+/*
+ * Worker counts to measure the scaling with: 1, 2, 4, ... up to workers,
+ * which is at most GOMAXPROCS
+ */
+func workerCounts(workers int) []int {
+	if max := runtime.GOMAXPROCS(0); workers > max {
+		workers = max
+	}
+	counts := []int{1}
+	for n := 2; n < workers; n *= 2 {
+		counts = append(counts, n)
+	}
+	if workers > 1 {
+		counts = append(counts, workers)
+	}
+	return counts
+}
+
+// Measurement of an operation, an empty one if it was not measured
+func findMeasurement(measurements []*Measurement, name string, op uint8) *Measurement {
+	for _, m := range measurements {
+		if m.Algorithm == name && m.Operation == op {
+			return m
+		}
+	}
+	return &Measurement{}
+}
+
+// Messages of a sweep, prefixes of the message of the largest size
+func sweepMessages(req *BenchRequest) [][]byte {
+	largest := 0
+	for _, size := range req.Sizes {
+		if size > largest {
+			largest = size
+		}
+	}
+	message := SweepMessage(req.Seed, largest)
+	var messages [][]byte
+	for _, size := range req.Sizes {
+		messages = append(messages, message[:size])
+	}
+	return messages
+}
+
+/* Ids of requests of clients that do not pick one */
+var lastRequestID uint32
+
 /*
  * The main server routine.
  *	1. Waits and then reads the input message from the client.
  *	2. Computes MACs using the client's message as the input.
  *	   Repeats the computation for 500K times and computes
- *     the average performance.
+ *     the average performance. Then verifies a MAC as often.
  *	3. Computes signatures using the client's message as the input.
  *     Repeats the computation for 5K time and computes
- *	   the average performance.
+ *	   the average performance. Then verifies a signature as often.
+ *	   Clients may ask for other algorithms than AES-CMAC and RSA-2048,
+ *	   for a sweep over message sizes and for running them on several
+ *	   cores, see mac_sig_api.go.
  *	4. Returns the performance result back to the client.
- *	   See the AppMessage struct for more detail.
+ *	   See the AppMessage struct for more detail, clients that asked
+ *	   for algorithms get a measurement per operation instead.
+ *
+ *	Requests are queued (see jobs.go), the server keeps reading requests
+ *	while it benchmarks and tells clients whether their request runs or
+ *	at which position it waits. A request that arrives again gets its
+ *	status or its result again, it is benchmarked once.
  *
  *	Input:
  *	  - serverCCAddrStr: Address at which the server listens
@@ -226,8 +698,16 @@ func runServer(serverCCAddrStr string, cmacKey []byte, privKey *rsa.PrivateKey)
 	CCConn, err = <To be completed>
 	Check(err)
 
+	// Requests are benchmarked one after the other, the socket is read meanwhile
+	jobs := NewJobQueue(*maxJobs, *maxQueued, *maxClientJobs, runJob, func(job *Job) {
+		if !job.Legacy {
+			sendStatus(job, job.Client, &JobStatus{ID: job.Request.ID, State: StateRunning})
+		}
+	})
+
 	// Creates the receive buffer
 	receivePacketBuffer := make([]byte, 2500)
+	limiter := NewClientLimiter()
 
 	for {
 		/*
@@ -250,64 +730,145 @@ func runServer(serverCCAddrStr string, cmacKey []byte, privKey *rsa.PrivateKey)
 			continue
 		}
 		if n > 0 {
+			// Clients over their quota get no answer, nothing is signed for them
+			if !limiter.Allow(clientCCAddr, time.Now()) {
+				continue
+			}
 			clientCCAddrStr := clientCCAddr.String()
 			fmt.Println("Received request from ", clientCCAddrStr)
 
-			start := time.Now ()
-			for i := 0; i < numMacCompute; i++ {
-				/*
-				 * Task 4: Compute the CMAC for the client's message
-				 *
-				 *  HINT:
-				 *	 - We have already implemented the function for you;
-				 *     You just need to find it.
-				 */
-				_, err := <To be completed>
-				if err != nil {
-					fmt.Println (err.Error)
+			// The job runs later, it must not share the receive buffer
+			datagram := append([]byte(nil), receivePacketBuffer[:n]...)
+			req, legacy, err := DecodeRequest(datagram)
+			if err != nil {
+				log.Error("Invalid request", "client", clientCCAddrStr, "err", err)
+				continue
+			}
+			if req.ID == 0 {
+				req.ID = atomic.AddUint32(&lastRequestID, 1)
+			}
+
+			job := &Job{Request: req, Client: clientCCAddr, Legacy: legacy}
+			var known *Job
+			var status *JobStatus
+			var result [][]byte
+			if cost := requestCost(req); cost > *maxCost {
+				known, status = jobs.Reject(job, fmt.Sprintf("benchmarks take about %v, at most %v",
+					cost.Round(time.Second), *maxCost))
+			} else {
+				known, status, result = jobs.Submit(job)
+			}
+			switch {
+			case status == nil && result != nil:
+				// The client lost the result of a request it sent before
+				sendDatagrams(job, result)
+			case status == nil:
+				// The result was sent again too often already
+			default:
+				if status.State == StateRejected {
+					log.Info("Request rejected", "client", clientCCAddrStr, "reason", status.Reason)
+				}
+				// The status of a job is signed once, however often the client asks
+				if !legacy {
+					sendStatus(known, clientCCAddr, status)
 				}
 			}
-			macTime := time.Since (start)
+		}
+	}
+}
 
-			start = time.Now ()
-			for i := 0; i < numSigCompute; i++ {
-				/*
-				 * Task 5: Compute the RSA signature for the client's message
-				 *
-				 *  HINT:
-				 *	 - We have already implemented the function for you;
-				 *	   You just need to find it.
-				 */
-				_, err := <To be completed>
-				if err != nil {
-					fmt.Println (err.Error)
+/*
+ * Benchmarks the algorithms of a request and sends the result to the client
+ *
+ *	Output:
+ *		- result: datagrams sent to the client, nil for old clients
+ */
+func runJob(job *Job) [][]byte {
+	req := job.Request
+	clientCCAddr := job.Client
+	clientCCAddrStr := clientCCAddr.String()
+
+	messages := [][]byte{req.Message}
+	if len(req.Sizes) > 0 {
+		messages = sweepMessages(req)
+	}
+
+	var measurements []*Measurement
+	for _, name := range ExpandAlgorithms(req.Algorithms) {
+		for _, message := range messages {
+			for _, workers := range workerCounts(req.Workers) {
+				for _, m := range benchmark(name, message, len(req.Sizes) > 0, workers) {
+					if len(m.Error) > 0 {
+						fmt.Println(name, OperationName(m.Kind, m.Operation), "failed:", m.Error)
+					}
+					measurements = append(measurements, m)
 				}
 			}
-			sigTime := time.Since (start)
-
-			/*
-			 * Task 6: Create and send the performance report message to the client.
-			 *
-			 *	Requirement:
-			 *	  - The message must be organized as specified by
-			 *		the AppMessage struct.
-			 *	  - Each field must be in network-byte order.
-			 *
-			 *  HINTS:
-			 * 	  - Use CCConn.WriteToSCION to send a packet to the client:
-			 *
-			 *		  func (c *Conn) WriteToSCION(b []byte, raddr *Addr) (int, error)
-			 *
-			 *		  - Input Arguments:
-			 *			 - 1st Argument: Buffer with the outgoing message
-			 *			 - 2nd Argument: Client address (e.g., clientCCAddr)
-			 *
-			 *		  - Output Arguments:
-			 *			 - 1st Argument: Number of bytes sent
-			 *			 - 2nd Argument: Specifies the error, if any.
-			 */
-
-			<To be completed>
 		}
 	}
+
+	if !job.Legacy {
+		datagrams, err := EncodeResult(req.ID, measurements, replySigner)
+		if err != nil {
+			log.Error("Unable to encode result", "client", clientCCAddrStr, "err", err)
+			return nil
+		}
+		sendDatagrams(job, datagrams)
+		return datagrams
+	}
+	macTime := findMeasurement(measurements, "aes-cmac", OpCompute).Total
+	sigTime := findMeasurement(measurements, "rsa-pss-2048", OpCompute).Total
+	macVerifyTime := findMeasurement(measurements, "aes-cmac", OpVerify).Total
+	sigVerifyTime := findMeasurement(measurements, "rsa-pss-2048", OpVerify).Total
+
+	/*
+	 * Task 6: Create and send the performance report message to the client.
+	 *
+	 *	Requirement:
+	 *	  - The message must be organized as specified by
+	 *		the AppMessage struct.
+	 *	  - Fill in all fields, MacVerifyTime and SigVerifyTime
+	 *		with macVerifyTime and sigVerifyTime from above.
+	 *		The client reads them after SigTime.
+	 *	  - Each field must be in network-byte order.
+	 *
+	 *  HINTS:
+	 * 	  - Use CCConn.WriteToSCION to send a packet to the client:
+	 *
+	 *		  func (c *Conn) WriteToSCION(b []byte, raddr *Addr) (int, error)
+	 *
+	 *		  - Input Arguments:
+	 *			 - 1st Argument: Buffer with the outgoing message
+	 *			 - 2nd Argument: Client address (e.g., clientCCAddr)
+	 *
+	 *		  - Output Arguments:
+	 *			 - 1st Argument: Number of bytes sent
+	 *			 - 2nd Argument: Specifies the error, if any.
+	 */
+
+	<To be completed>
+	return nil
+}
+
+func sendDatagrams(job *Job, datagrams [][]byte) {
+	for _, datagram := range datagrams {
+		_, err := CCConn.WriteToSCION(datagram, job.Client)
+		if err != nil {
+			log.Error("Unable to send result", "client", job.Client.String(), "err", err)
+			return
+		}
+	}
+}
+
+/* Sends the status of a job to a client, the same status is signed once */
+func sendStatus(job *Job, client *snet.Addr, status *JobStatus) {
+	datagram, err := job.signStatus(status, replySigner)
+	if err != nil {
+		log.Error("Unable to sign status", "client", client.String(), "err", err)
+		return
+	}
+	_, err = CCConn.WriteToSCION(datagram, client)
+	if err != nil {
+		log.Error("Unable to send status", "client", client.String(), "err", err)
+	}
 }
@@ -0,0 +1,547 @@
+// Web dashboard of the monitor, plots the history of every measured path
+// and shows which ASes and interfaces the paths traverse.
+// Built together with monitor.go
+
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/netsec-ethz/scion-homeworks/lib/history"
+)
+
+const (
+	/* Plotted unless the page asks for another range */
+	DEFAULT_DASHBOARD_RANGE time.Duration = 7 * 24 * time.Hour
+	/* Newest values of a metric sent to the page per path */
+	MAX_POINTS int = 2000
+)
+
+/* Daily percentiles of a metric as sent to the page */
+type DayView struct {
+	Date string `json:"date"`
+	N int `json:"n"`
+	Min float64 `json:"min"`
+	P10 float64 `json:"p10"`
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	Max float64 `json:"max"`
+}
+
+type MetricView struct {
+	Points [][2]float64 `json:"points"` /* [unix ms, value] */
+	Days []DayView `json:"days"`
+}
+
+/* Everything measured on one path between a source and a destination */
+type PathView struct {
+	Src string `json:"src"`
+	Dst string `json:"dst"`
+	Path string `json:"path"`
+	Hops []string `json:"hops"`
+	Runs int `json:"runs"`
+	Last time.Time `json:"last"`
+	Metrics map[string]*MetricView `json:"metrics"`
+}
+
+type TopoAS struct {
+	IA string `json:"ia"`
+	Column int `json:"column"` /* Fewest ASes any path crosses before it */
+}
+
+/* Link between two ASes, from the interface pairs of the paths */
+type TopoLink struct {
+	From string `json:"from"`
+	FromIf string `json:"from_if"`
+	To string `json:"to"`
+	ToIf string `json:"to_if"`
+	Paths []string `json:"paths"`
+}
+
+type Topology struct {
+	ASes []*TopoAS `json:"ases"`
+	Links []*TopoLink `json:"links"`
+	Paths map[string][]string `json:"paths"` /* Fingerprint: ASes in order */
+}
+
+/* Splits ISD-AS#IfID */
+func splitHop(hop string) (string, string) {
+	i := strings.LastIndex(hop, "#")
+	if i < 0 {
+		return hop, ""
+	}
+	return hop[:i], hop[i+1:]
+}
+
+/* Records selected by the page, the last DEFAULT_DASHBOARD_RANGE if it does not say */
+func (mon *Monitor) dashboardRecords(w http.ResponseWriter, r *http.Request) ([]*history.Record, bool) {
+	query, err := queryFromRequest(r, DEFAULT_DASHBOARD_RANGE)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	recs, _, err := history.Load(mon.config.DB, query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return recs, true
+}
+
+func (mon *Monitor) handlePaths(w http.ResponseWriter, r *http.Request) {
+	recs, ok := mon.dashboardRecords(w, r)
+	if !ok {
+		return
+	}
+
+	byKey := make(map[string][]*history.Record)
+	var keys []string
+	for _, rec := range recs {
+		if _, ok := byKey[rec.Key()]; !ok {
+			keys = append(keys, rec.Key())
+		}
+		byKey[rec.Key()] = append(byKey[rec.Key()], rec)
+	}
+	sort.Strings(keys)
+
+	views := []*PathView{}
+	for _, key := range keys {
+		recs := byKey[key]
+		last := recs[len(recs)-1]
+		view := &PathView{
+			Src: last.Src,
+			Dst: last.Dst,
+			Path: last.Path,
+			Hops: last.Hops,
+			Runs: len(recs),
+			Last: last.Time,
+			Metrics: make(map[string]*MetricView),
+		}
+		for _, rec := range recs {
+			for metric := range rec.Values {
+				if _, ok := view.Metrics[metric]; ok {
+					continue
+				}
+				points := history.Series(recs, metric)
+				mv := &MetricView{}
+				for _, day := range history.Daily(points) {
+					mv.Days = append(mv.Days, DayView{day.Date.Format("2006-01-02"), day.N,
+						day.Min, day.P10, day.P50, day.P90, day.Max})
+				}
+				if len(points) > MAX_POINTS {
+					points = points[len(points)-MAX_POINTS:]
+				}
+				for _, p := range points {
+					mv.Points = append(mv.Points, [2]float64{float64(p.Time.UnixNano() / 1e6), p.Value})
+				}
+				view.Metrics[metric] = mv
+			}
+		}
+		views = append(views, view)
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+/* ASes and links of every measured path. Path.Interfaces lists both ends of
+ * every link the path crosses, so interfaces 2k and 2k+1 form a link. */
+func (mon *Monitor) handleTopology(w http.ResponseWriter, r *http.Request) {
+	recs, ok := mon.dashboardRecords(w, r)
+	if !ok {
+		return
+	}
+
+	topo := &Topology{Paths: make(map[string][]string)}
+	columns := make(map[string]int)
+	links := make(map[string]*TopoLink)
+	for _, rec := range recs {
+		if len(rec.Hops) == 0 {
+			continue
+		}
+		if _, ok := topo.Paths[rec.Path]; ok {
+			continue
+		}
+
+		var ases []string
+		for _, hop := range rec.Hops {
+			ia, _ := splitHop(hop)
+			if len(ases) == 0 || ases[len(ases)-1] != ia {
+				ases = append(ases, ia)
+			}
+		}
+		topo.Paths[rec.Path] = ases
+		for i, ia := range ases {
+			if col, ok := columns[ia]; !ok || i < col {
+				columns[ia] = i
+			}
+		}
+
+		for i := 0; i+1 < len(rec.Hops); i += 2 {
+			from, fromIf := splitHop(rec.Hops[i])
+			to, toIf := splitHop(rec.Hops[i+1])
+			key := rec.Hops[i] + " " + rec.Hops[i+1]
+			link, ok := links[key]
+			if !ok {
+				link = &TopoLink{From: from, FromIf: fromIf, To: to, ToIf: toIf}
+				links[key] = link
+				topo.Links = append(topo.Links, link)
+			}
+			link.Paths = append(link.Paths, rec.Path)
+		}
+	}
+
+	for ia, col := range columns {
+		topo.ASes = append(topo.ASes, &TopoAS{ia, col})
+	}
+	sort.Slice(topo.ASes, func(i, j int) bool {
+		if topo.ASes[i].Column != topo.ASes[j].Column {
+			return topo.ASes[i].Column < topo.ASes[j].Column
+		}
+		return topo.ASes[i].IA < topo.ASes[j].IA
+	})
+	if topo.Links == nil {
+		topo.Links = []*TopoLink{}
+	}
+	writeJSON(w, http.StatusOK, topo)
+}
+
+func (mon *Monitor) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(DASHBOARD_HTML))
+}
+
+/* Single page without outside resources, the charts are drawn as SVG */
+const DASHBOARD_HTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>SCION path monitor</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; color: #222; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.1em; margin-top: 1.5em; }
+table { border-collapse: collapse; font-size: 0.85em; }
+td, th { padding: 2px 8px; text-align: left; border-bottom: 1px solid #ddd; }
+.fail { color: #b00; }
+.chart { margin: 0.5em 0; }
+.chart text, #topology text { font-size: 11px; fill: #444; }
+.axis { stroke: #999; stroke-width: 1; }
+.grid { stroke: #eee; stroke-width: 1; }
+#legend label { margin-right: 1em; font-size: 0.85em; white-space: nowrap; }
+.swatch { display: inline-block; width: 10px; height: 10px; margin-right: 3px; }
+#controls { margin: 0.5em 0; }
+</style>
+</head>
+<body>
+<h1>SCION path monitor</h1>
+<div id="summary"></div>
+<div id="controls">
+Range
+<select id="range">
+<option value="24h">1 day</option>
+<option value="168h" selected>7 days</option>
+<option value="720h">30 days</option>
+</select>
+<button id="reload">Reload</button>
+</div>
+
+<h2>Jobs</h2>
+<table id="jobs"></table>
+
+<h2>Paths</h2>
+<div id="legend"></div>
+<table id="paths"></table>
+
+<h2>RTT</h2>
+<div class="chart" id="rtt"></div>
+<h2>RTT distribution</h2>
+<div class="chart" id="rttdist"></div>
+<h2>Bandwidth estimate</h2>
+<div class="chart" id="bw"></div>
+<h2>Loss</h2>
+<div class="chart" id="loss"></div>
+<h2>Topology</h2>
+<div id="topology"></div>
+
+<script>
+"use strict";
+var COLORS = ["#1f77b4", "#d62728", "#2ca02c", "#ff7f0e", "#9467bd", "#8c564b",
+	"#e377c2", "#7f7f7f", "#bcbd22", "#17becf"];
+var SVGNS = "http://www.w3.org/2000/svg";
+var paths = [], hidden = {}, highlight = null, topo = null;
+
+function el(name, attrs, text) {
+	var e = document.createElementNS(SVGNS, name);
+	for (var k in attrs) e.setAttribute(k, attrs[k]);
+	if (text !== undefined) e.textContent = text;
+	return e;
+}
+
+function cell(row, text, cls) {
+	var td = document.createElement("td");
+	td.textContent = text;
+	if (cls) td.className = cls;
+	row.appendChild(td);
+	return td;
+}
+
+function pathName(p) { return p.dst + " " + p.path; }
+function color(i) { return COLORS[i % COLORS.length]; }
+function visible(i) { return !hidden[i] && (highlight === null || highlight === i); }
+
+function niceMax(v) {
+	if (!(v > 0)) return 1;
+	var mag = Math.pow(10, Math.floor(Math.log10(v)));
+	var steps = [1, 2, 2.5, 5, 10];
+	for (var i = 0; i < steps.length; i++) if (steps[i] * mag >= v) return steps[i] * mag;
+	return 10 * mag;
+}
+
+function fmtTime(ms, span) {
+	var d = new Date(ms);
+	var pad = function(n) { return (n < 10 ? "0" : "") + n; };
+	var day = (d.getMonth() + 1) + "/" + d.getDate();
+	if (span > 3 * 86400e3) return day;
+	return day + " " + pad(d.getHours()) + ":" + pad(d.getMinutes());
+}
+
+/* Frame with axes, returns functions mapping values to pixels */
+function frame(svg, W, H, xmin, xmax, ymax, unit, xlabels) {
+	var L = 60, R = 10, T = 10, B = 25;
+	var x = function(v) { return L + (v - xmin) / ((xmax - xmin) || 1) * (W - L - R); };
+	var y = function(v) { return H - B - v / ymax * (H - T - B); };
+	for (var i = 0; i <= 4; i++) {
+		var v = ymax * i / 4;
+		svg.appendChild(el("line", {x1: L, x2: W - R, y1: y(v), y2: y(v), "class": "grid"}));
+		svg.appendChild(el("text", {x: L - 5, y: y(v) + 4, "text-anchor": "end"}, +v.toPrecision(3) + " " + unit));
+	}
+	svg.appendChild(el("line", {x1: L, x2: L, y1: T, y2: H - B, "class": "axis"}));
+	svg.appendChild(el("line", {x1: L, x2: W - R, y1: H - B, y2: H - B, "class": "axis"}));
+	if (xlabels) {
+		for (var i = 0; i <= 5; i++) {
+			var t = xmin + (xmax - xmin) * i / 5;
+			svg.appendChild(el("text", {x: x(t), y: H - 8, "text-anchor": "middle"}, fmtTime(t, xmax - xmin)));
+		}
+	}
+	return {x: x, y: y, L: L, R: R, B: B};
+}
+
+/* One line per visible path over time */
+function lineChart(id, metric, unit) {
+	var div = document.getElementById(id);
+	div.innerHTML = "";
+	var W = 900, H = 220, xmin = Infinity, xmax = -Infinity, ymax = 0, any = false;
+	paths.forEach(function(p, i) {
+		var m = p.metrics[metric];
+		if (!m || !visible(i)) return;
+		m.points.forEach(function(pt) {
+			xmin = Math.min(xmin, pt[0]); xmax = Math.max(xmax, pt[0]); ymax = Math.max(ymax, pt[1]);
+			any = true;
+		});
+	});
+	if (!any) { div.textContent = "No " + metric + " measurements."; return; }
+	var svg = el("svg", {width: W, height: H});
+	var f = frame(svg, W, H, xmin, xmax, niceMax(ymax), unit, true);
+	paths.forEach(function(p, i) {
+		var m = p.metrics[metric];
+		if (!m || !visible(i)) return;
+		var pts = m.points.map(function(pt) { return f.x(pt[0]).toFixed(1) + "," + f.y(pt[1]).toFixed(1); });
+		svg.appendChild(el("polyline", {points: pts.join(" "), fill: "none", stroke: color(i), "stroke-width": 1.5}));
+		m.points.forEach(function(pt) {
+			var c = el("circle", {cx: f.x(pt[0]), cy: f.y(pt[1]), r: 2, fill: color(i)});
+			c.appendChild(el("title", {}, pathName(p) + "\n" + new Date(pt[0]).toLocaleString() + "\n" +
+				pt[1].toFixed(3) + " " + unit));
+			svg.appendChild(c);
+		});
+	});
+	div.appendChild(svg);
+}
+
+function percentile(sorted, p) {
+	var pos = p / 100 * (sorted.length - 1), lo = Math.floor(pos);
+	if (lo >= sorted.length - 1) return sorted[sorted.length - 1];
+	return sorted[lo] + (pos - lo) * (sorted[lo + 1] - sorted[lo]);
+}
+
+/* Box per visible path: whiskers min and max, box P10 to P90, line the median */
+function boxChart(id, metric, unit) {
+	var div = document.getElementById(id);
+	div.innerHTML = "";
+	var boxes = [];
+	paths.forEach(function(p, i) {
+		var m = p.metrics[metric];
+		if (!m || !visible(i) || m.points.length === 0) return;
+		var v = m.points.map(function(pt) { return pt[1]; }).sort(function(a, b) { return a - b; });
+		boxes.push({i: i, p: p, n: v.length, min: v[0], max: v[v.length - 1],
+			p10: percentile(v, 10), p50: percentile(v, 50), p90: percentile(v, 90)});
+	});
+	if (boxes.length === 0) { div.textContent = "No " + metric + " measurements."; return; }
+	var W = 900, H = 220, ymax = 0;
+	boxes.forEach(function(b) { ymax = Math.max(ymax, b.max); });
+	var svg = el("svg", {width: W, height: H});
+	var f = frame(svg, W, H, 0, boxes.length, niceMax(ymax), unit, false);
+	var bw = Math.min(40, (W - f.L - f.R) / boxes.length * 0.5);
+	boxes.forEach(function(b, k) {
+		var cx = f.x(k + 0.5), c = color(b.i);
+		var g = el("g", {});
+		g.appendChild(el("line", {x1: cx, x2: cx, y1: f.y(b.min), y2: f.y(b.max), stroke: c}));
+		g.appendChild(el("rect", {x: cx - bw / 2, width: bw, y: f.y(b.p90), height: Math.max(1, f.y(b.p10) - f.y(b.p90)),
+			fill: c, "fill-opacity": 0.3, stroke: c}));
+		g.appendChild(el("line", {x1: cx - bw / 2, x2: cx + bw / 2, y1: f.y(b.p50), y2: f.y(b.p50), stroke: c, "stroke-width": 2}));
+		g.appendChild(el("text", {x: cx, y: H - 8, "text-anchor": "middle"}, b.p.path));
+		g.appendChild(el("title", {}, pathName(b.p) + "\n" + b.n + " values\nmin " + b.min.toFixed(3) +
+			"  p10 " + b.p10.toFixed(3) + "  median " + b.p50.toFixed(3) + "  p90 " + b.p90.toFixed(3) +
+			"  max " + b.max.toFixed(3) + " " + unit));
+		svg.appendChild(g);
+	});
+	div.appendChild(svg);
+}
+
+/* ASes in columns by how far from the source they are, links between them */
+function drawTopology() {
+	var div = document.getElementById("topology");
+	div.innerHTML = "";
+	if (!topo || topo.ases.length === 0) {
+		div.textContent = "No measured path with known interfaces.";
+		return;
+	}
+	var cols = {}, pos = {}, ncols = 0, nrows = 0;
+	topo.ases.forEach(function(as) {
+		var row = cols[as.column] = (cols[as.column] || 0) + 1;
+		pos[as.ia] = {col: as.column, row: row - 1};
+		ncols = Math.max(ncols, as.column + 1);
+		nrows = Math.max(nrows, row);
+	});
+	var CW = 190, RH = 60, W = ncols * CW + 40, H = nrows * RH + 40;
+	var xy = function(ia) { return {x: 20 + pos[ia].col * CW + 70, y: 20 + pos[ia].row * RH + 20}; };
+
+	var selected = highlight === null ? null : paths[highlight].path;
+	var svg = el("svg", {width: W, height: H});
+	topo.links.forEach(function(l) {
+		var a = xy(l.from), b = xy(l.to);
+		var on = selected === null || l.paths.indexOf(selected) >= 0;
+		var line = el("line", {x1: a.x, y1: a.y, x2: b.x, y2: b.y,
+			stroke: on ? (selected === null ? "#888" : color(highlight)) : "#ddd", "stroke-width": on ? 2 + Math.min(l.paths.length, 4) : 1});
+		line.appendChild(el("title", {}, l.from + "#" + l.from_if + " - " + l.to + "#" + l.to_if +
+			"\n" + l.paths.length + " measured path(s): " + l.paths.join(", ")));
+		svg.appendChild(line);
+		if (on) {
+			svg.appendChild(el("text", {x: a.x + (b.x - a.x) * 0.2, y: a.y + (b.y - a.y) * 0.2 - 4}, l.from_if));
+			svg.appendChild(el("text", {x: a.x + (b.x - a.x) * 0.8, y: a.y + (b.y - a.y) * 0.8 - 4}, l.to_if));
+		}
+	});
+	topo.ases.forEach(function(as) {
+		var p = xy(as.ia);
+		var on = selected === null || (topo.paths[selected] || []).indexOf(as.ia) >= 0;
+		svg.appendChild(el("rect", {x: p.x - 65, y: p.y - 12, width: 130, height: 24, rx: 5,
+			fill: on ? "#f4f8fc" : "#fafafa", stroke: on ? "#557" : "#ccc"}));
+		svg.appendChild(el("text", {x: p.x, y: p.y + 4, "text-anchor": "middle"}, as.ia));
+	});
+	div.appendChild(svg);
+}
+
+function drawAll() {
+	lineChart("rtt", "rtt_ms", "ms");
+	boxChart("rttdist", "rtt_ms", "ms");
+	lineChart("bw", "bw_mbps", "Mbps");
+	lineChart("loss", "loss_pct", "%");
+	drawTopology();
+}
+
+function latest(p, metric) {
+	var m = p.metrics[metric];
+	if (!m || m.points.length === 0) return "-";
+	return m.points[m.points.length - 1][1].toFixed(2);
+}
+
+function showPaths() {
+	var legend = document.getElementById("legend"), table = document.getElementById("paths");
+	legend.innerHTML = "";
+	table.innerHTML = "<tr><th></th><th>Destination</th><th>Path</th><th>Runs</th><th>Last</th>" +
+		"<th>RTT ms</th><th>BW Mbps</th><th>Loss %</th><th>Hops</th></tr>";
+	paths.forEach(function(p, i) {
+		var label = document.createElement("label");
+		var box = document.createElement("input");
+		box.type = "checkbox";
+		box.checked = !hidden[i];
+		box.onchange = function() { hidden[i] = !box.checked; drawAll(); };
+		var sw = document.createElement("span");
+		sw.className = "swatch";
+		sw.style.background = color(i);
+		label.appendChild(box);
+		label.appendChild(sw);
+		label.appendChild(document.createTextNode(pathName(p)));
+		legend.appendChild(label);
+
+		var row = table.insertRow();
+		var sw2 = sw.cloneNode();
+		cell(row, "").appendChild(sw2);
+		cell(row, p.dst);
+		cell(row, p.path);
+		cell(row, p.runs);
+		cell(row, new Date(p.last).toLocaleString());
+		cell(row, latest(p, "rtt_ms"));
+		cell(row, latest(p, "bw_mbps"));
+		cell(row, latest(p, "loss_pct"));
+		cell(row, p.hops ? p.hops.join(" ") : "chosen by sciond");
+		row.style.cursor = "pointer";
+		row.title = "Click to show only this path";
+		row.onclick = function() { highlight = highlight === i ? null : i; drawAll(); };
+	});
+}
+
+function showJobs(status) {
+	document.getElementById("summary").textContent = "Source " + status.source + ", running since " +
+		new Date(status.started).toLocaleString() + ", results in " + status.db;
+	var table = document.getElementById("jobs");
+	table.innerHTML = "<tr><th>Job</th><th>Target</th><th>Every</th><th>Runs</th><th>Failures</th>" +
+		"<th>Last run</th><th>Next run</th><th>Last error</th></tr>";
+	status.jobs.forEach(function(j) {
+		var row = table.insertRow();
+		cell(row, j.name);
+		cell(row, j.target);
+		cell(row, j.every);
+		cell(row, j.runs);
+		cell(row, j.failures, j.failures > 0 ? "fail" : "");
+		cell(row, j.running ? "running" : (j.runs > 0 ? new Date(j.last_start).toLocaleString() +
+			" (" + j.last_duration + ")" : "-"));
+		cell(row, new Date(j.next_run).toLocaleString());
+		cell(row, j.last_error || "", "fail");
+	});
+}
+
+function getJSON(url) {
+	return fetch(url).then(function(r) {
+		if (!r.ok) throw new Error(url + ": " + r.status);
+		return r.json();
+	});
+}
+
+function load() {
+	var since = "?since=" + document.getElementById("range").value;
+	Promise.all([getJSON("/status"), getJSON("/paths" + since), getJSON("/topology" + since)]).then(function(res) {
+		showJobs(res[0]);
+		paths = res[1];
+		topo = res[2];
+		if (highlight !== null && highlight >= paths.length) highlight = null;
+		showPaths();
+		drawAll();
+	}).catch(function(err) {
+		document.getElementById("summary").textContent = "Could not load: " + err.message;
+	});
+}
+
+document.getElementById("reload").onclick = load;
+document.getElementById("range").onchange = load;
+load();
+setInterval(load, 60000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,558 @@
+// Daemon that keeps measuring the latency and bandwidth to a list of targets
+// Runs the homework clients on a schedule, they append their results to the
+// history file. Status, results and a dashboard are served over HTTP on localhost.
+// Run from the repository root with:
+// go run monitor/monitor.go monitor/dashboard.go -c monitor/example.json
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/netsec-ethz/scion-homeworks/lib/history"
+)
+
+const (
+	DEFAULT_LISTEN string = "127.0.0.1:8077"
+	DEFAULT_JITTER float64 = 0.1
+	DEFAULT_TIMEOUT time.Duration = 5 * time.Minute
+	DEFAULT_MAX_BANDWIDTH int = 1
+	/* Runs closer together than this would only measure each other */
+	MIN_INTERVAL time.Duration = time.Second
+	/* Output of the last run kept for the status */
+	OUTPUT_TAIL int = 4096
+	DEFAULT_RESULTS int = 100
+)
+
+/* Programs run for each kind of measurement, over one or all paths. The
+ * source, destination and history file are appended as -s, -d and -db. */
+var DEFAULT_PROGRAMS = map[string][]string{
+	"latency": {"go", "run", "latency/controlplane_client.go"},
+	"latency_all": {"go", "run", "latency/controlplane_client.go", "-all"},
+	"bandwidth": {"go", "run", "bottleneck_bw_est/v2_bw_est_client.go", "bottleneck_bw_est/bw_est_api.go"},
+	"bandwidth_all": {"go", "run", "bottleneck_bw_est/bottleneck_path_client.go", "bottleneck_bw_est/bw_est_api.go"},
+}
+
+/* Duration written as "30s" or "15m" in the configuration */
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	var err error
+	d.Duration, err = time.ParseDuration(s)
+	return err
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+type Schedule struct {
+	Kind string `json:"kind"` /* latency or bandwidth */
+	Every Duration `json:"every"`
+	Paths string `json:"paths"` /* one (default) or all */
+	Args []string `json:"args"` /* Passed on to the program, e.g. ["-n", "20"] */
+}
+
+type Target struct {
+	Name string `json:"name"`
+	Address string `json:"address"`
+	Schedules []*Schedule `json:"schedules"`
+}
+
+type Config struct {
+	Source string `json:"source"`
+	DB string `json:"db"`
+	Listen string `json:"listen"`
+	Jitter float64 `json:"jitter"` /* Runs are moved by up to this fraction of their interval */
+	Timeout Duration `json:"timeout"`
+	MaxBandwidth int `json:"max_bandwidth"` /* Bandwidth tests running at once */
+	Programs map[string][]string `json:"programs"`
+	Targets []*Target `json:"targets"`
+}
+
+/* What the HTTP API tells about a job */
+type JobStatus struct {
+	Name string `json:"name"`
+	Target string `json:"target"`
+	Kind string `json:"kind"`
+	Paths string `json:"paths"`
+	Every Duration `json:"every"`
+	Running bool `json:"running"`
+	Runs int `json:"runs"`
+	Failures int `json:"failures"`
+	LastStart time.Time `json:"last_start,omitempty"`
+	LastDuration Duration `json:"last_duration"`
+	LastError string `json:"last_error,omitempty"`
+	LastOutput string `json:"last_output,omitempty"`
+	NextRun time.Time `json:"next_run"`
+}
+
+/* One schedule of one target */
+type Job struct {
+	argv []string
+	every time.Duration
+	trigger chan struct{}
+
+	/* Guarded by Monitor.mu */
+	status JobStatus
+}
+
+type Monitor struct {
+	config *Config
+	jobs []*Job
+	byName map[string]*Job
+	/* Slots for bandwidth tests, they would skew each other */
+	bandwidth chan struct{}
+	started time.Time
+
+	mu sync.Mutex
+	wg sync.WaitGroup
+	ctx context.Context
+}
+
+func check(e error) {
+	if e != nil {
+		log.Fatal(e)
+	}
+}
+
+func printUsage() {
+	fmt.Println("\nmonitor -c Config.json [-listen Address]")
+	fmt.Println("\tMeasures the latency and bandwidth to the targets of the configuration on a schedule")
+	fmt.Println("\tby running the homework clients, which append their results to the history file.")
+	fmt.Println("\tEvery run is moved by a random part of its interval (jitter), so tests of different")
+	fmt.Println("\tdaemons and targets do not line up. At most max_bandwidth bandwidth tests run at once.")
+	fmt.Println("\tThe source is given without port, or with port 0, so runs do not collide.")
+	fmt.Println("\tSee monitor/example.json for the format of the configuration.")
+	fmt.Println("\nHTTP API")
+	fmt.Println("\tGET  /         Dashboard with RTT, bandwidth and loss of every path and the topology they cross")
+	fmt.Println("\tGET  /status   State of every job")
+	fmt.Println("\tGET  /results  Recent results, filtered by src, dst, path, kind, since (e.g. 24h) and limit")
+	fmt.Println("\tGET  /paths    Values and daily percentiles per path, same filters, since defaults to 7 days")
+	fmt.Println("\tGET  /topology ASes and links of the measured paths")
+	fmt.Println("\tPOST /run?job=Name  Runs a job right away, needs Content-Type: application/json")
+	fmt.Println()
+}
+
+/* Reads the configuration and fills in the defaults */
+func loadConfig(filename string) (*Config, error) {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{
+		DB: history.DefaultFile(),
+		Listen: DEFAULT_LISTEN,
+		Jitter: DEFAULT_JITTER,
+		Timeout: Duration{DEFAULT_TIMEOUT},
+		MaxBandwidth: DEFAULT_MAX_BANDWIDTH,
+	}
+	if err = json.Unmarshal(raw, config); err != nil {
+		return nil, fmt.Errorf("Error in %s: %v", filename, err)
+	}
+
+	if len(config.Source) == 0 {
+		return nil, fmt.Errorf("Error, the configuration needs a source address")
+	}
+	if config.Jitter < 0 || config.Jitter >= 1 {
+		return nil, fmt.Errorf("Error, jitter needs to be at least 0 and below 1")
+	}
+	if config.MaxBandwidth < 1 || config.Timeout.Duration <= 0 {
+		return nil, fmt.Errorf("Error, max_bandwidth and timeout need to be above 0")
+	}
+	programs := make(map[string][]string)
+	for name, argv := range DEFAULT_PROGRAMS {
+		programs[name] = argv
+	}
+	for name, argv := range config.Programs {
+		if _, ok := DEFAULT_PROGRAMS[name]; !ok || len(argv) == 0 {
+			return nil, fmt.Errorf("Error, unknown or empty program %q", name)
+		}
+		programs[name] = argv
+	}
+	config.Programs = programs
+
+	names := make(map[string]bool)
+	for _, target := range config.Targets {
+		if len(target.Name) == 0 || len(target.Address) == 0 {
+			return nil, fmt.Errorf("Error, every target needs a name and an address")
+		}
+		if names[target.Name] {
+			return nil, fmt.Errorf("Error, target %s is listed twice", target.Name)
+		}
+		names[target.Name] = true
+		for _, sched := range target.Schedules {
+			if sched.Kind != "latency" && sched.Kind != "bandwidth" {
+				return nil, fmt.Errorf("Error, target %s: kind needs to be latency or bandwidth", target.Name)
+			}
+			if sched.Paths == "" {
+				sched.Paths = "one"
+			}
+			if sched.Paths != "one" && sched.Paths != "all" {
+				return nil, fmt.Errorf("Error, target %s: paths needs to be one or all", target.Name)
+			}
+			if sched.Every.Duration < MIN_INTERVAL {
+				return nil, fmt.Errorf("Error, target %s: %s runs need to be at least %v apart",
+					target.Name, sched.Kind, MIN_INTERVAL)
+			}
+		}
+	}
+	return config, nil
+}
+
+func NewMonitor(ctx context.Context, config *Config) (*Monitor, error) {
+	mon := &Monitor{
+		config: config,
+		byName: make(map[string]*Job),
+		bandwidth: make(chan struct{}, config.MaxBandwidth),
+		started: time.Now(),
+		ctx: ctx,
+	}
+	for _, target := range config.Targets {
+		for _, sched := range target.Schedules {
+			program := sched.Kind
+			if sched.Paths == "all" {
+				program += "_all"
+			}
+			name := target.Name + "/" + program
+			if _, ok := mon.byName[name]; ok {
+				return nil, fmt.Errorf("Error, target %s has two %s schedules", target.Name, program)
+			}
+
+			var argv []string
+			argv = append(argv, config.Programs[program]...)
+			argv = append(argv, sched.Args...)
+			argv = append(argv, "-s", config.Source, "-d", target.Address, "-db", config.DB)
+			job := &Job{
+				argv: argv,
+				every: sched.Every.Duration,
+				trigger: make(chan struct{}, 1),
+				status: JobStatus{
+					Name: name,
+					Target: target.Address,
+					Kind: sched.Kind,
+					Paths: sched.Paths,
+					Every: sched.Every,
+				},
+			}
+			mon.jobs = append(mon.jobs, job)
+			mon.byName[name] = job
+		}
+	}
+	if len(mon.jobs) == 0 {
+		return nil, fmt.Errorf("Error, the configuration has no schedules")
+	}
+	return mon, nil
+}
+
+/* Interval moved by up to Jitter of it in either direction */
+func (mon *Monitor) jittered(every time.Duration) time.Duration {
+	return time.Duration(float64(every) * (1 + mon.config.Jitter*(2*rand.Float64()-1)))
+}
+
+func (mon *Monitor) Start() {
+	for _, job := range mon.jobs {
+		mon.wg.Add(1)
+		go mon.schedule(job)
+	}
+}
+
+/* Runs a job until the monitor is stopped. The first run is at a random
+ * point of the first interval, so jobs started together spread out. */
+func (mon *Monitor) schedule(job *Job) {
+	defer mon.wg.Done()
+	wait := time.Duration(rand.Int63n(int64(job.every)))
+	for {
+		mon.mu.Lock()
+		job.status.NextRun = time.Now().Add(wait)
+		mon.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-mon.ctx.Done():
+			timer.Stop()
+			return
+		case <-job.trigger:
+			timer.Stop()
+		case <-timer.C:
+		}
+
+		mon.run(job)
+		wait = mon.jittered(job.every)
+	}
+}
+
+/* Runs the program of a job once and records how it went */
+func (mon *Monitor) run(job *Job) {
+	if job.status.Kind == "bandwidth" {
+		select {
+		case mon.bandwidth <- struct{}{}:
+			defer func() { <-mon.bandwidth }()
+		case <-mon.ctx.Done():
+			return
+		}
+	}
+
+	start := time.Now()
+	mon.mu.Lock()
+	job.status.Running = true
+	job.status.LastStart = start
+	mon.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(mon.ctx, mon.config.Timeout.Duration)
+	cmd := exec.Command(job.argv[0], job.argv[1:]...)
+	/* go run starts the compiled client as a child of its own. Killing
+	 * only go would leave the client running, so the job gets a process
+	 * group and the whole group is killed. */
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Start()
+	if err == nil {
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			err = <-done
+		}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %v", mon.config.Timeout.Duration)
+	}
+	cancel()
+
+	tail := output.Bytes()
+	if len(tail) > OUTPUT_TAIL {
+		tail = tail[len(tail)-OUTPUT_TAIL:]
+	}
+
+	mon.mu.Lock()
+	defer mon.mu.Unlock()
+	job.status.Running = false
+	job.status.Runs += 1
+	job.status.LastDuration = Duration{time.Since(start)}
+	job.status.LastOutput = string(tail)
+	job.status.LastError = ""
+	if err != nil {
+		job.status.Failures += 1
+		job.status.LastError = err.Error()
+		log.Printf("%s failed after %v: %v", job.status.Name, job.status.LastDuration.Duration, err)
+	} else {
+		log.Printf("%s done in %v", job.status.Name, job.status.LastDuration.Duration)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Println("Could not answer:", err)
+	}
+}
+
+func (mon *Monitor) handleStatus(w http.ResponseWriter, r *http.Request) {
+	mon.mu.Lock()
+	jobs := make([]JobStatus, len(mon.jobs))
+	for i, job := range mon.jobs {
+		jobs[i] = job.status
+	}
+	mon.mu.Unlock()
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Name < jobs[j].Name })
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"started": mon.started,
+		"source": mon.config.Source,
+		"db": mon.config.DB,
+		"jobs": jobs,
+	})
+}
+
+/* History query from the src, dst, path, kind and since (e.g. 24h)
+ * parameters of a request. since defaults to the given range, 0 is all. */
+func queryFromRequest(r *http.Request, since time.Duration) (*history.Query, error) {
+	params := r.URL.Query()
+	query := &history.Query{
+		Kind: params.Get("kind"),
+		Src: params.Get("src"),
+		Dst: params.Get("dst"),
+		Path: params.Get("path"),
+	}
+	if s := params.Get("since"); len(s) > 0 {
+		var err error
+		if since, err = time.ParseDuration(s); err != nil {
+			return nil, fmt.Errorf("since needs to be a duration, e.g. 24h")
+		}
+	}
+	if since > 0 {
+		query.Since = time.Now().Add(-since)
+	}
+	return query, nil
+}
+
+/* Most recent results of the history file, newest last */
+func (mon *Monitor) handleResults(w http.ResponseWriter, r *http.Request) {
+	query, err := queryFromRequest(r, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := DEFAULT_RESULTS
+	if l := r.URL.Query().Get("limit"); len(l) > 0 {
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 {
+			http.Error(w, "limit needs to be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	recs, _, err := history.Load(mon.config.DB, query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(recs) > limit {
+		recs = recs[len(recs)-limit:]
+	}
+	if recs == nil {
+		recs = []*history.Record{}
+	}
+	writeJSON(w, http.StatusOK, recs)
+}
+
+/* Tells whether a request that starts measurements comes from a page of the
+ * API itself. Other pages can send forms, but not with a JSON content type,
+ * and their Origin differs. Host names other than the listen address are
+ * refused as well, they point a foreign name at us (DNS rebinding). */
+func (mon *Monitor) checkOrigin(r *http.Request) error {
+	mediaType := strings.Split(r.Header.Get("Content-Type"), ";")[0]
+	if !strings.EqualFold(strings.TrimSpace(mediaType), "application/json") {
+		return fmt.Errorf("needs Content-Type: application/json")
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	listenHost, _, _ := net.SplitHostPort(mon.config.Listen)
+	if host != "localhost" && host != listenHost && net.ParseIP(strings.Trim(host, "[]")) == nil {
+		return fmt.Errorf("unknown host %s", r.Host)
+	}
+	if origin := r.Header.Get("Origin"); len(origin) > 0 {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			return fmt.Errorf("cross-origin request from %s", origin)
+		}
+	}
+	return nil
+}
+
+func (mon *Monitor) handleRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := mon.checkOrigin(r); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	job, ok := mon.byName[r.URL.Query().Get("job")]
+	if !ok {
+		http.Error(w, "no such job, see /status", http.StatusNotFound)
+		return
+	}
+	/* A run that is already asked for is not queued twice */
+	select {
+	case job.trigger <- struct{}{}:
+	default:
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"job": job.status.Name, "status": "queued"})
+}
+
+func main() {
+	var (
+		configFile string
+		listen string
+	)
+
+	flag.StringVar(&configFile, "c", "", "Configuration File")
+	flag.StringVar(&listen, "listen", "", "Address Of The HTTP API, Overrides The Configuration")
+	flag.Usage = printUsage
+	flag.Parse()
+
+	if len(configFile) == 0 {
+		printUsage()
+		check(fmt.Errorf("Error, configuration needs to be specified with -c"))
+	}
+	config, err := loadConfig(configFile)
+	check(err)
+	if len(listen) > 0 {
+		config.Listen = listen
+	}
+
+	/* The API can start measurements, keep it off the network by default */
+	host, _, err := net.SplitHostPort(config.Listen)
+	check(err)
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		log.Printf("Warning, the HTTP API on %s is reachable from other hosts", config.Listen)
+	}
+
+	rand.Seed(time.Now().UnixNano())
+	ctx, cancel := context.WithCancel(context.Background())
+	mon, err := NewMonitor(ctx, config)
+	check(err)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", mon.handleStatus)
+	mux.HandleFunc("/results", mon.handleResults)
+	mux.HandleFunc("/run", mon.handleRun)
+	mux.HandleFunc("/paths", mon.handlePaths)
+	mux.HandleFunc("/topology", mon.handleTopology)
+	mux.HandleFunc("/", mon.handleDashboard)
+	ln, err := net.Listen("tcp", config.Listen)
+	check(err)
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(ln); err != http.ErrServerClosed {
+			check(err)
+		}
+	}()
+
+	mon.Start()
+	log.Printf("Monitoring %d schedules, dashboard on http://%s/, results in %s", len(mon.jobs), ln.Addr(), config.DB)
+
+	/* Stop running measurements on SIGINT or SIGTERM */
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	log.Println("Stopping")
+	cancel()
+	server.Close()
+	mon.wg.Wait()
+}
@@ -12,6 +12,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/netsec-ethz/scion-homeworks/lib/keys"
+	"github.com/netsec-ethz/scion-homeworks/lib/pacer"
 	"github.com/scionproto/scion/go/lib/snet"
 	"github.com/scionproto/scion/go/lib/sciond"
 )
@@ -41,8 +43,22 @@ func check(e error) {
 }
 
 func printUsage() {
-	fmt.Println("\nflood -s SourceSCIONAddress -d DestinationSCIONAddress")
+	fmt.Println("\nflood -s SourceSCIONAddress -d DestinationSCIONAddress [-key PrivateKeyFile]")
 	fmt.Println("\tThe SCION address is specified as ISD-AS,[IP Address]:Port")
+	fmt.Println("\tReal users sign with the private key created by keygen.go (RSA, ECDSA or Ed25519,")
+	fmt.Println("\tPEM, DER or raw), -f reads the signature from an old sig_info.txt file instead")
+}
+
+func readPrivateKey(filename string) {
+	key, err := keys.LoadPrivateKey(filename)
+	if os.IsNotExist(err) {
+		check(fmt.Errorf("%v, create the keys with go run keygen.go", err))
+	}
+	check(err)
+	RealSignature, err = SignMessage(key, []byte(SIGNED_MESSAGE))
+	check(err)
+	FakeSignature = FakeSignatureOf(RealSignature)
+	fmt.Println("Signing with", keys.TypeOf(key.Public()), "key")
 }
 
 func readSigInfo(filename string) {
@@ -63,10 +79,7 @@ func readSigInfo(filename string) {
   if err != nil {
     check(fmt.Errorf("Cannot get signature to use"))
   }
-	FakeSignature := make([]byte, len(RealSignature))
-	copy(FakeSignature, RealSignature)
-	FakeSignature[0] = byte('A')
-	FakeSignature[10] = byte('A')
+	FakeSignature = FakeSignatureOf(RealSignature)
 
   /* Get N for RSA and create big.Int from string. */
   /* Don't need values for RSA PublicKey. */
@@ -135,18 +148,22 @@ func startSigStream(realUser bool, Wg *sync.WaitGroup) {
 
 
 	var sendPacketBuffer []byte
-	nap := time.Second / time.Duration(rate)
+	/* Wait for correct time interval, time.Sleep overshoots at high rates. */
+	pace := pacer.NewRate(float64(rate), 1)
 	i := 0
 	for i < iters {
+		pace.Wait()
 		sendPacketBuffer = generatePayload(realUser)
 		_, err = udpConnection.Write(append(sendPacketBuffer, sig...))
 		check(err)
-
-		/* Wait for correct time interval.*/
-		time.Sleep(nap)
 		i += 1
 	}
 
+	if realUser {
+		fmt.Println("User stream timing:", pace.Stats())
+	} else {
+		fmt.Println("Attacker stream timing:", pace.Stats())
+	}
 	Wg.Done()
 }
 
@@ -158,6 +175,7 @@ func main() {
 		err    error
 
 		filename string
+		keyFilename string
 	)
 
 	/* Fetch arguments from command line */
@@ -165,12 +183,17 @@ func main() {
 	flag.StringVar(&destinationAddress, "d", "", "Destination SCION Address")
 	flag.IntVar(&Scale, "c", 5, "Constant Scale Of Attacker To Regular Throughput")
 	flag.IntVar(&PacketGroupSize, "n", DEFAULT_PACKET_GROUP_SIZE, "Number Of Real User Packets To Send. Attacker Will Be Scaled")
-	flag.StringVar(&filename, "f", "sig_info.txt", "CryptoFileName")
+	flag.StringVar(&filename, "f", "", "Old CryptoFileName (sig_info.txt), instead of -key")
+	flag.StringVar(&keyFilename, "key", DEFAULT_KEY_FILE, "PrivateKeyFileName")
 	m := flag.String("m", "normal", "SigFloodMethod")
 	flag.Parse()
 
 	/* Get Crypto Info */
-	readSigInfo(filename)
+	if len(filename) > 0 {
+		readSigInfo(filename)
+	} else {
+		readPrivateKey(keyFilename)
+	}
 	setupMethod(*m)
 
 	/* Create the SCION UDP socket */
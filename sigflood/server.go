@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"crypto"
 	"crypto/rsa"
+	"crypto/sha256"
 	"flag"
 	"encoding/binary"
 	"encoding/hex"
@@ -14,13 +15,15 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/netsec-ethz/scion-homeworks/lib/keys"
 	"github.com/scionproto/scion/go/lib/snet"
 	"github.com/scionproto/scion/go/lib/sciond"
 )
 
 var (
+	Message []byte
 	Hash []byte
-	PubKey rsa.PublicKey
+	PubKey crypto.PublicKey
 
 	Method int
 	RequestHandler defense
@@ -46,8 +49,23 @@ func check(e error) {
 }
 
 func printUsage() {
-	fmt.Println("\nserver -s ServerSCIONAddress")
+	fmt.Println("\nserver -s ServerSCIONAddress [-pub PublicKeyFile]")
 	fmt.Println("\tThe SCION address is specified as ISD-AS,[IP Address]:Port")
+	fmt.Println("\tThe public key (RSA, ECDSA or Ed25519, PEM, DER or raw) is created by keygen.go,")
+	fmt.Println("\t-f reads the RSA key from an old sig_info.txt file instead")
+}
+
+func readPublicKey(filename string) {
+	var err error
+	PubKey, err = keys.LoadPublicKey(filename)
+	if os.IsNotExist(err) {
+		check(fmt.Errorf("%v, create the keys with go run keygen.go", err))
+	}
+	check(err)
+	Message = []byte(SIGNED_MESSAGE)
+	hashed := sha256.Sum256(Message)
+	Hash = hashed[:]
+	fmt.Println("Verifying", keys.TypeOf(PubKey), "signatures")
 }
 
 func readSigInfo(filename string) {
@@ -87,7 +105,7 @@ func readSigInfo(filename string) {
 		check(fmt.Errorf("Could not create public key"))
 	}
 
-	PubKey = rsa.PublicKey{N: N, E: int(E)}
+	PubKey = &rsa.PublicKey{N: N, E: int(E)}
 }
 
 func defaultRequestHandler(req []byte, n int) bool {
@@ -173,13 +191,7 @@ func setupMethod(method string) {
 }
 
 func verifySig(sig []byte) bool {
-	if err := rsa.VerifyPKCS1v15(&PubKey, crypto.SHA256, Hash, sig); err != nil {
-		// fmt.Println("Fake")
-		return false
-	} else {
-		// fmt.Println("Real")
-		return true
-	}
+	return VerifySignature(PubKey, Message, Hash, sig)
 }
 
 func main() {
@@ -190,16 +202,22 @@ func main() {
 		udpConnection *snet.Conn
 
 		filename string
+		pubFilename string
 	)
 
 	/* Fetch arguments from command line */
 	flag.StringVar(&serverAddress, "s", "", "Server SCION Address")
-	flag.StringVar(&filename, "f", "sig_info.txt", "CryptoFileName")
+	flag.StringVar(&filename, "f", "", "Old CryptoFileName (sig_info.txt), instead of -pub")
+	flag.StringVar(&pubFilename, "pub", DEFAULT_PUB_FILE, "PublicKeyFileName")
 	m := flag.String("m", "normal", "SigFloodMethod")
 	flag.Parse()
 
 	/* Get Crypto Info */
-	readSigInfo(filename)
+	if len(filename) > 0 {
+		readSigInfo(filename)
+	} else {
+		readPublicKey(pubFilename)
+	}
 	setupMethod(*m)
 
 	/* Create the SCION UDP socket */
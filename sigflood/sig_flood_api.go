@@ -1,6 +1,12 @@
 package main
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
 	"math/rand"
 	"sort"
 	"strings"
@@ -9,6 +15,13 @@ import (
 const (
 	TIMESTAMP_SIZE = 16
 	PAYLOAD_SIZE = 48
+
+	/* Real users send the signature of this message, attackers cannot create it. */
+	SIGNED_MESSAGE = "message to be signed"
+
+	/* Where keygen.go puts the keys, -key and -pub change them. */
+	DEFAULT_KEY_FILE = "sig_key.pem"
+	DEFAULT_PUB_FILE = "sig_key.pub.pem"
 )
 
 var METHODS = map[string]int{"normal":0, "binning":1, "puzzle":2}
@@ -56,3 +69,34 @@ func GetRandomPath(seed rand.Source, realUser bool) string {
 		return FAKE_PATHS[rand.New(seed).Intn(len(FAKE_PATHS))]
 	}
 }
+
+/* RSA signs with PKCS #1 v1.5 and ECDSA in ASN.1, both over the SHA-256 of the message. */
+func SignMessage(key crypto.Signer, msg []byte) ([]byte, error) {
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		return key.Sign(crand.Reader, msg, crypto.Hash(0))
+	}
+	hashed := sha256.Sum256(msg)
+	return key.Sign(crand.Reader, hashed[:], crypto.SHA256)
+}
+
+/* Ed25519 needs the message, the others verify the hash. Old sig_info.txt files only have the hash. */
+func VerifySignature(pub crypto.PublicKey, msg []byte, hashed []byte, sig []byte) bool {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed, sig) == nil
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(pub, hashed, sig)
+	case ed25519.PublicKey:
+		return msg != nil && ed25519.Verify(pub, msg, sig)
+	}
+	return false
+}
+
+/* Breaks a real signature, attackers send it. */
+func FakeSignatureOf(sig []byte) []byte {
+	fake := make([]byte, len(sig))
+	copy(fake, sig)
+	fake[0] = byte('A')
+	fake[10] = byte('A')
+	return fake
+}